@@ -0,0 +1,55 @@
+package control
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Set up a manager which obtains and renews certificates for the given comma-separated hostnames
+// from an ACME certificate authority (Let's Encrypt, unless a directory URL is given), accepting
+// its terms of service, and keeps them in the cache directory, so that a restart does not ask for
+// them again. Certificates are obtained on the first handshake for each hostname, proving we hold
+// it with the tls-alpn-01 challenge, which the authority makes to port 443 of the hostname: we
+// must be listening there, on an address it can reach.
+func newACMEManager(hosts string, cacheDir string, email string, directoryURL string) (*autocert.Manager, error) {
+	var names []string
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if strings.ContainsAny(host, ":/") {
+			return nil, fmt.Errorf("invalid ACME hostname %q: it must be a bare hostname, without a scheme or port", host)
+		}
+		names = append(names, host)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no ACME hostnames in %q", hosts)
+	}
+	if cacheDir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("no -acme-cache given, and no cache directory to default to: %v", err)
+		}
+		cacheDir = filepath.Join(dir, "glitch-grid", "acme")
+	}
+	// Fail now, rather than on the first handshake, if the certificates cannot be kept.
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create the ACME cache: %v", err)
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(names...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+	if directoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+	return m, nil
+}
@@ -0,0 +1,175 @@
+package control
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+	"github.com/golang/glog"
+)
+
+// Take a snapshot of the current vault list. The returned slice must not be modified.
+func (s *ControlServer) vaultList() []string {
+	s.vaultsLock.RLock()
+	defer s.vaultsLock.RUnlock()
+	return s.Vaults
+}
+
+// Check that the request carries the admin bearer token, responding with an error if not.
+// If no admin token is configured, the admin API does not exist.
+func (s *ControlServer) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if s.adminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		glog.Warningf("Rejected unauthorized admin request from %s", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeProblem(w, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid admin token", nil)
+		return false
+	}
+	return true
+}
+
+// Manage the live set of vaults without restarting:
+// - GET /admin/vaults lists the vaults as JSON;
+// - POST /admin/vaults adds the vault whose address is in the body; and
+// - DELETE /admin/vaults/{addr} removes a vault.
+// The majority needed for reads and writes is re-evaluated against the new set immediately.
+func (s *ControlServer) handleAdminVaults(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	addr := strings.TrimPrefix(r.URL.Path, "/admin/vaults")
+	addr = strings.TrimPrefix(addr, "/")
+	switch {
+	case r.Method == http.MethodGet && addr == "":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(s.vaultList())
+	case r.Method == http.MethodPost && addr == "":
+		body, err := io.ReadAll(r.Body)
+		addr = strings.TrimSpace(string(body))
+		if err != nil || validVaultAddress(addr) != nil {
+			writeProblem(w, http.StatusBadRequest, codeBadBody, "Invalid or missing vault address", nil)
+			return
+		}
+		s.changeVaults(w, addr, true)
+	case r.Method == http.MethodDelete && addr != "":
+		for _, scheme := range []string{grpcScheme, httpsScheme} {
+			if hostPort, ok := strings.CutPrefix(addr, strings.TrimSuffix(scheme, "/")); ok && !strings.HasPrefix(hostPort, "/") {
+				// The mux collapses the double slash of a vault address with a scheme.
+				addr = scheme + hostPort
+			}
+		}
+		if path, ok := strings.CutPrefix(addr, "unix:/"); ok && !strings.HasPrefix(path, "/") {
+			// Likewise the triple slash of a Unix socket's address.
+			addr = unixScheme + "/" + path
+		}
+		s.changeVaults(w, addr, false)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Make the live set of vaults exactly these, in this order, keeping what we know about those which
+// stay, and saying why in the event log. Returns the vaults added and removed.
+func (s *ControlServer) replaceVaults(vaults []string, why string) (added []string, removed []string) {
+	s.vaultsLock.Lock()
+	previous := make(map[string]bool, len(s.Vaults))
+	for _, vault := range s.Vaults {
+		previous[vault] = true
+	}
+	wanted := make(map[string]bool, len(vaults))
+	for _, vault := range vaults {
+		wanted[vault] = true
+		if !previous[vault] {
+			added = append(added, vault)
+		}
+	}
+	for _, vault := range s.Vaults {
+		if !wanted[vault] {
+			removed = append(removed, vault)
+		}
+	}
+	s.Vaults = vaults
+	numVaults := len(s.Vaults)
+	s.vaultsLock.Unlock()
+	s.statusLock.Lock()
+	for _, vault := range added {
+		s.vaultStatus[vault] = &vaultStatus{Address: vault}
+	}
+	for _, vault := range removed {
+		delete(s.vaultStatus, vault)
+	}
+	s.statusLock.Unlock()
+	for _, vault := range added {
+		s.recordEvent(eventVaultAdded, vault, why)
+	}
+	for _, vault := range removed {
+		s.recordEvent(eventVaultRemoved, vault, why)
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		assert.Sometimes(true, "Control service: changed vault membership at runtime", Details{"added": added, "removed": removed, "numVaults": numVaults})
+	}
+	return added, removed
+}
+
+// Add a vault to (or remove it from) the live set, and tell the client what the set now is.
+func (s *ControlServer) changeVaults(w http.ResponseWriter, addr string, add bool) {
+	s.vaultsLock.Lock()
+	var vaults []string
+	found := false
+	for _, vault := range s.Vaults {
+		if vault == addr {
+			found = true
+		} else {
+			vaults = append(vaults, vault)
+		}
+	}
+	switch {
+	case add && found:
+		s.vaultsLock.Unlock()
+		writeProblem(w, http.StatusConflict, codeMembershipConflict, fmt.Sprintf("Vault %s is already a member", addr), nil)
+		return
+	case !add && !found:
+		s.vaultsLock.Unlock()
+		writeProblem(w, http.StatusNotFound, codeUnknownVault, fmt.Sprintf("Vault %s is not a member", addr), nil)
+		return
+	case !add && len(vaults) == 0:
+		s.vaultsLock.Unlock()
+		writeProblem(w, http.StatusConflict, codeMembershipConflict, "Cannot remove the last vault", nil)
+		return
+	}
+	var msg string
+	if add {
+		s.Vaults = append(vaults, addr)
+		msg = fmt.Sprintf("Added vault %s", addr)
+	} else {
+		s.Vaults = vaults
+		msg = fmt.Sprintf("Removed vault %s", addr)
+	}
+	numVaults := len(s.Vaults)
+	s.vaultsLock.Unlock()
+	s.statusLock.Lock()
+	if add {
+		s.vaultStatus[addr] = &vaultStatus{Address: addr}
+	} else {
+		delete(s.vaultStatus, addr)
+	}
+	s.statusLock.Unlock()
+	assert.Sometimes(true, "Control service: changed vault membership at runtime", Details{"vault": addr, "added": add, "numVaults": numVaults})
+	glog.Infof("%s; now have %d vaults, majority is %d", msg, numVaults, majorityOf(numVaults))
+	if add {
+		s.recordEvent(eventVaultAdded, addr, "")
+	} else {
+		s.recordEvent(eventVaultRemoved, addr, "")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("%s; now have %d vaults", msg, numVaults)))
+}
@@ -0,0 +1,153 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// One committed write, as recorded in the audit log.
+type auditEntry struct {
+	Time     time.Time       `json:"time"`
+	Value    json.RawMessage `json:"value"`
+	Version  int             `json:"version"`
+	Sequence int64           `json:"sequence"`
+	// Who sent the write: their address, whoever they say they forwarded it for, and what they
+	// say they are.
+	Client       string `json:"client"`
+	ForwardedFor string `json:"forwardedFor,omitempty"`
+	UserAgent    string `json:"userAgent,omitempty"`
+	RequestID    string `json:"requestId"`
+	// The vaults which acknowledged the write, and how many we sent it to.
+	Acked     []string `json:"acked"`
+	NumVaults int      `json:"numVaults"`
+}
+
+// A file to which every committed write is appended, one JSON object per line, so that the
+// history of the value can be reconstructed after an incident. Each entry is synced to disk
+// before the client is answered. Once the file reaches maxSize bytes, it is rotated: renamed
+// to path.1, with any older files shifted along to path.N and the oldest removed.
+type auditLog struct {
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+	lock    sync.Mutex
+}
+
+// Open the audit log at path, appending to it if it exists. A maxSize of zero never rotates it.
+func openAuditLog(path string, maxSize int64, backups int) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize, backups: backups}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, size, err := openAuditFile(a.path)
+	if err != nil {
+		return err
+	}
+	a.f, a.size = f, size
+	return nil
+}
+
+func openAuditFile(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("could not open audit log: %w", err)
+	}
+	return f, info.Size(), nil
+}
+
+// Start a new file, keeping up to the configured number of old ones. The current file stays open
+// until the new one has been opened, and if the new one cannot be, it is put back where it was,
+// so that a failed rotation leaves us appending to the file we had. The caller must hold the lock.
+func (a *auditLog) rotate() error {
+	for i := a.backups - 1; i > 0; i-- {
+		os.Rename(a.path+"."+strconv.Itoa(i), a.path+"."+strconv.Itoa(i+1))
+	}
+	// With no backups to keep, the old file is moved aside all the same, and removed only once
+	// the new one is open.
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return fmt.Errorf("could not rotate audit log: %w", err)
+	}
+	f, size, err := openAuditFile(a.path)
+	if err != nil {
+		os.Rename(a.path+".1", a.path)
+		return fmt.Errorf("could not rotate audit log: %w", err)
+	}
+	a.f.Close()
+	if a.backups == 0 {
+		os.Remove(a.path + ".1")
+	}
+	a.f, a.size = f, size
+	return nil
+}
+
+// Append an entry, rotating the file first if it would grow past its maximum size.
+func (a *auditLog) append(entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			// The entry still goes in the file we have, and rotation is tried again next time.
+			glog.Errorf("Appending to the audit log without rotating it: %v", err)
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return a.f.Sync()
+}
+
+// Record a committed write in the audit log, if there is one. resp holds the acknowledgements,
+// as filled in by postValueToVaults. The write has already been committed, so a failure to record
+// it is logged rather than returned to the client.
+func (s *ControlServer) auditWrite(r *http.Request, value string, version int, sequence int64, resp map[string]bool, numVaults int) {
+	if s.audit == nil {
+		return
+	}
+	acked := []string{}
+	for _, vault := range s.vaultList() {
+		// HTTP acknowledgements are recorded by URL, and gRPC ones by address.
+		if resp[vault] || resp[vaultURL(vault)] {
+			acked = append(acked, vault)
+		}
+	}
+	err := s.audit.append(auditEntry{
+		Time:         time.Now().UTC(),
+		Value:        s.valueType.toJSON(value),
+		Version:      version,
+		Sequence:     sequence,
+		Client:       r.RemoteAddr,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		UserAgent:    r.UserAgent(),
+		RequestID:    requestIDFrom(r.Context()),
+		Acked:        acked,
+		NumVaults:    numVaults,
+	})
+	if err != nil {
+		glog.Errorf("Could not record write of version %d in the audit log: %v", version, err)
+	}
+}
@@ -0,0 +1,141 @@
+package control
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What bench saw of one kind of call.
+type benchResults struct {
+	latencies []time.Duration
+	// How many calls succeeded, were refused with a 4xx (as a write which lost a race with a
+	// larger one is), failed with a 5xx, and could not be made at all.
+	ok, refused, failed, errors int
+}
+
+func (br *benchResults) add(latency time.Duration, statusCode int, err error) {
+	switch {
+	case err != nil:
+		br.errors++
+		return
+	case statusCode < 400:
+		br.ok++
+	case statusCode < 500:
+		br.refused++
+	default:
+		br.failed++
+	}
+	br.latencies = append(br.latencies, latency)
+}
+
+func (br *benchResults) print(name string, elapsed time.Duration) {
+	calls := len(br.latencies) + br.errors
+	if calls == 0 {
+		return
+	}
+	fmt.Printf("%-6s %d calls, %.1f/s: %d ok, %d refused, %d failed, %d errors\n",
+		name, calls, float64(calls)/elapsed.Seconds(), br.ok, br.refused, br.failed, br.errors)
+	if len(br.latencies) == 0 {
+		return
+	}
+	sort.Slice(br.latencies, func(i, j int) bool { return br.latencies[i] < br.latencies[j] })
+	percentile := func(p float64) float64 {
+		return float64(br.latencies[int(p*float64(len(br.latencies)-1))]) / float64(time.Millisecond)
+	}
+	fmt.Printf("       latency p50 %.3fms, p90 %.3fms, p99 %.3fms, max %.3fms\n",
+		percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+}
+
+// Measure the throughput and latency of a control server (or a single vault, which answers the
+// same calls): keep some number of clients reading the value, and writing it if asked to, for a
+// while or a number of calls, then report how the calls went. Writes set the value to increasing
+// numbers, starting from a little above the current time in nanoseconds so that they are larger
+// than any value written before; one which arrives after a larger one is refused, and counted as
+// such.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8000", "Control server or vault to call")
+	duration := fs.Duration("duration", 10*time.Second, "How long to run for, unless -calls is given")
+	calls := fs.Int("calls", 0, "How many calls to make in all, however long they take (run for -duration if 0)")
+	concurrency := fs.Int("concurrency", 8, "How many clients call at once, each waiting for its last call before the next")
+	writeRatio := fs.Float64("write-ratio", 0, "Fraction of calls, from 0 to 1, which are writes; writes change the value, so leave this at 0 against a grid in use")
+	timeout := fs.Duration("timeout", 5*time.Second, "How long to wait for each call")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fmt.Printf("unexpected argument %q\n", fs.Arg(0))
+		os.Exit(2)
+	}
+	if *concurrency < 1 || *calls < 0 || *duration <= 0 || *writeRatio < 0 || *writeRatio > 1 || *timeout <= 0 {
+		fmt.Printf("invalid benchmark: concurrency must be positive, calls not negative, the write ratio from 0 to 1, and the duration and timeout positive\n")
+		os.Exit(1)
+	}
+	url := strings.TrimSuffix(*target, "/") + "/"
+	client := &http.Client{Timeout: *timeout, Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}}
+	// Writes are spread evenly, one every nth call for n the reciprocal of the ratio rounded down,
+	// and every write takes the next value.
+	var next atomic.Int64
+	next.Store(time.Now().UnixNano())
+	var made atomic.Int64
+	writeEvery := 0
+	if *writeRatio > 0 {
+		writeEvery = int(1 / *writeRatio)
+	}
+	var lock sync.Mutex
+	var reads, writes benchResults
+	deadline := time.Now().Add(*duration)
+	fmt.Printf("Benchmarking %s with %d clients, %.0f%% writes\n", url, *concurrency, *writeRatio*100)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := made.Add(1)
+				if (*calls > 0 && n > int64(*calls)) || (*calls == 0 && time.Now().After(deadline)) {
+					return
+				}
+				write := writeEvery > 0 && n%int64(writeEvery) == 0
+				var req *http.Request
+				if write {
+					req, _ = http.NewRequest(http.MethodPost, url, strings.NewReader(strconv.FormatInt(next.Add(1), 10)))
+				} else {
+					req, _ = http.NewRequest(http.MethodGet, url, nil)
+				}
+				callStart := time.Now()
+				resp, err := client.Do(req)
+				statusCode := 0
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					statusCode = resp.StatusCode
+				}
+				latency := time.Since(callStart)
+				lock.Lock()
+				if write {
+					writes.add(latency, statusCode, err)
+				} else {
+					reads.add(latency, statusCode, err)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	fmt.Printf("Made %d calls in %v\n", len(reads.latencies)+reads.errors+len(writes.latencies)+writes.errors, elapsed.Round(time.Millisecond))
+	reads.print("reads", elapsed)
+	writes.print("writes", elapsed)
+	if reads.ok+writes.ok == 0 {
+		os.Exit(1)
+	}
+}
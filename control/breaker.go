@@ -0,0 +1,125 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Returned instead of calling a vault whose circuit is open.
+var errCircuitOpen = errors.New("circuit open")
+
+// The states of a vault's circuit breaker.
+const (
+	// Calls go through as normal.
+	circuitClosed = "closed"
+	// The vault has failed repeatedly, so calls fail immediately until the cooldown has passed.
+	circuitOpen = "open"
+	// The cooldown has passed, and a single probe call is allowed through to see if the vault
+	// has recovered.
+	circuitHalfOpen = "half-open"
+)
+
+// When to stop calling a vault which keeps failing, so that we do not spend our timeout on a
+// known-dead vault for every client request.
+type breakerPolicy struct {
+	// How many consecutive failures open the circuit; zero disables the breakers.
+	Failures int
+	// How long the circuit stays open before we probe the vault again.
+	Cooldown time.Duration
+}
+
+// The circuit breaker for a single vault, guarded by the server's breakerLock.
+type circuitBreaker struct {
+	state string
+	// Consecutive failures since the last success.
+	failures int
+	// When the circuit last opened.
+	opened time.Time
+}
+
+// Return nil if we may call a vault, or errCircuitOpen if its circuit is open. Once the cooldown
+// has passed, one caller at a time is let through as a probe, and must then settle it with
+// breakerRecord or breakerSettle, so this is to be checked last, just before the call is made.
+func (s *ControlServer) breakerAllow(vault string) error {
+	if s.breakerPolicy.Failures <= 0 {
+		return nil
+	}
+	s.breakerLock.Lock()
+	defer s.breakerLock.Unlock()
+	b := s.breakers[vault]
+	if b == nil || b.state == circuitClosed {
+		return nil
+	}
+	if b.state == circuitOpen && time.Since(b.opened) >= s.breakerPolicy.Cooldown {
+		glog.Infof("Probing vault %s after its circuit was open for %v", vault, s.breakerPolicy.Cooldown)
+		b.state = circuitHalfOpen
+		return nil
+	}
+	return errCircuitOpen
+}
+
+// Record the outcome of a call to a vault, opening its circuit if it has failed too many times in
+// a row (or failed a probe), and closing it again once a call succeeds. A failure also prompts us
+// to re-resolve the vaults' hostnames.
+func (s *ControlServer) breakerRecord(vault string, failed bool) {
+	if failed {
+		// The vault may have moved.
+		s.resolveSoon()
+	}
+	if s.breakerPolicy.Failures <= 0 {
+		return
+	}
+	s.breakerLock.Lock()
+	defer s.breakerLock.Unlock()
+	b := s.breakers[vault]
+	if b == nil {
+		b = &circuitBreaker{state: circuitClosed}
+		s.breakers[vault] = b
+	}
+	if !failed {
+		if b.state != circuitClosed {
+			glog.Infof("Closing the circuit for vault %s, which has recovered", vault)
+		}
+		b.state = circuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= s.breakerPolicy.Failures) {
+		glog.Warningf("Opening the circuit for vault %s after %d consecutive failures", vault, b.failures)
+		b.state = circuitOpen
+		b.opened = time.Now()
+	}
+}
+
+// Record the outcome of a call to a vault, as breakerRecord does, unless we cancelled it, in which
+// case it says nothing about the vault. A probe we cancelled puts the circuit back to open, with
+// its cooldown already passed, so that the next call probes again instead of the circuit staying
+// half-open for good.
+func (s *ControlServer) breakerSettle(ctx context.Context, vault string, failed bool) {
+	if ctx.Err() == nil {
+		s.breakerRecord(vault, failed)
+		return
+	}
+	if s.breakerPolicy.Failures <= 0 {
+		return
+	}
+	s.breakerLock.Lock()
+	defer s.breakerLock.Unlock()
+	if b := s.breakers[vault]; b != nil && b.state == circuitHalfOpen {
+		b.state = circuitOpen
+	}
+}
+
+// Return the state of a vault's circuit.
+func (s *ControlServer) breakerState(vault string) string {
+	s.breakerLock.Lock()
+	defer s.breakerLock.Unlock()
+	if b := s.breakers[vault]; b != nil {
+		return b.state
+	}
+	return circuitClosed
+}
@@ -0,0 +1,102 @@
+package control
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// How often the certificate and key files are checked for changes.
+const certPollInterval = 10 * time.Second
+
+// The certificate and key we serve HTTPS with, loaded again whenever their files change (or on
+// SIGHUP), so that a rotated certificate is picked up without a restart. Connections already open
+// keep the certificate they were made with; new ones get the new one.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+	// When the files were last changed, as of the last load; guarded by lock, which also keeps
+	// loads one at a time.
+	certModified time.Time
+	keyModified  time.Time
+	lock         sync.Mutex
+}
+
+// Load the certificate and key, failing if they cannot be.
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(true); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Return when each of the files was last changed.
+func (c *certReloader) modified() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// Load the certificate and key again if either file has changed since they were last loaded, or
+// regardless if forced, returning whether a new pair was loaded. A pair which cannot be loaded,
+// as while a rotation has written one file but not yet the other, leaves the one we have in
+// place, and is tried again on the next check.
+func (c *certReloader) reload(force bool) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	certModified, keyModified, err := c.modified()
+	if err != nil {
+		return false, fmt.Errorf("could not load the TLS certificate: %w", err)
+	}
+	if !force && certModified.Equal(c.certModified) && keyModified.Equal(c.keyModified) {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("could not load the TLS certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return false, fmt.Errorf("could not load the TLS certificate: %w", err)
+		}
+	}
+	c.cert.Store(&cert)
+	c.certModified, c.keyModified = certModified, keyModified
+	glog.Infof("Loaded TLS certificate %s for %v, valid until %v", c.certFile, cert.Leaf.Subject, cert.Leaf.NotAfter)
+	return true, nil
+}
+
+// Return the certificate to present, for tls.Config.GetCertificate.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// Check the files for changes every interval until we stop.
+func (c *certReloader) watch(interval time.Duration, stopping <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopping:
+			return
+		case <-ticker.C:
+		}
+		if _, err := c.reload(false); err != nil {
+			glog.Errorf("Keeping the TLS certificate we have: %v", err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package control
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Return the HTTP client with which we call the vaults, giving up on a call after the timeout and
+// on connecting after the dial timeout, and trusting the given certificate authorities (as well as
+// the system's) if they are set. We use our own client rather than http.DefaultClient,
+// so that our timeouts and connection pool do not leak into anything else in the process. Every
+// call goes to one of a handful of vaults, so we keep enough idle connections to each of them to
+// avoid a new connection for every fan-out.
+//
+// Calls go through the proxy if one is given, and otherwise through any proxy named by the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, except to Unix sockets.
+//
+// Vaults with unix:// addresses are dialed over their Unix sockets. HTTPS vaults are spoken to over
+// HTTP/2 if they support it. With h2c, so are plain HTTP vaults, without TLS, so that all our
+// concurrent calls to a vault share a single connection; every vault must then support h2c.
+func newVaultClient(cas *x509.CertPool, timeout time.Duration, dialTimeout time.Duration, h2c bool, proxy *url.URL) *http.Client {
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialVault(dialer)
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if strings.HasSuffix(req.URL.Hostname(), unixHostSuffix) {
+			return nil, nil
+		}
+		if proxy != nil {
+			return proxy, nil
+		}
+		return http.ProxyFromEnvironment(req)
+	}
+	transport.MaxIdleConnsPerHost = 32
+	transport.IdleConnTimeout = 90 * time.Second
+	if cas != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: cas}
+	}
+	if !h2c {
+		return &http.Client{Timeout: timeout, Transport: transport}
+	}
+	plain := &http2.Transport{
+		AllowHTTP: true,
+		// Despite its name, this dials every connection, and ours are not encrypted.
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialVault(dialer)(ctx, network, addr)
+		},
+		ReadIdleTimeout: 30 * time.Second,
+	}
+	return &http.Client{Timeout: timeout, Transport: h2cTransport{plain: plain, tls: transport}}
+}
+
+// Sends plain HTTP requests over h2c, and HTTPS requests as usual.
+type h2cTransport struct {
+	plain *http2.Transport
+	tls   *http.Transport
+}
+
+func (t h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.plain.RoundTrip(req)
+	}
+	return t.tls.RoundTrip(req)
+}
+
+// Called by http.Client.CloseIdleConnections.
+func (t h2cTransport) CloseIdleConnections() {
+	t.plain.CloseIdleConnections()
+	t.tls.CloseIdleConnections()
+}
+
+// Make a call with a context which times out, keeping the context alive until the response's
+// body is closed, since the body cannot be read once it is cancelled.
+func withTimeout(ctx context.Context, timeout time.Duration, call func(context.Context) (*http.Response, error)) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	resp, err := call(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = releasingBody{resp.Body, cancel}
+	return resp, nil
+}
@@ -0,0 +1,60 @@
+package control
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The commands the control server runs, given after its name, e.g. glitchgrid control serve. With
+// none, or with flags straight away, it serves, as it did before it had commands.
+const commandsUsage = `Usage: %s [command] [flags]
+
+Commands:
+  serve     Run the control server (the default)
+  check     Check the flags and the configuration they name, as serve would, then exit
+  version   Print what this binary was built from
+  bench     Measure the throughput and latency of a running control server or vault
+  help      Print this message
+
+Run "%s <command> -h" for the flags of serve or bench; check takes the same flags as serve.
+`
+
+// Print the commands, under the name we were run as, then the flags of serve, which are defined by
+// then.
+func usage(name string) {
+	fmt.Fprintf(flag.CommandLine.Output(), commandsUsage, name, name)
+	fmt.Fprintf(flag.CommandLine.Output(), "\nFlags of serve:\n")
+	flag.PrintDefaults()
+}
+
+// Print what this binary was built from, on one line.
+func printVersion() {
+	fmt.Println(currentBuild())
+}
+
+// Run the control server's command line: args are what follow name, the way it was run, e.g.
+// "glitchgrid control".
+func Main(name string, args []string) {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		runServer(name, args, false)
+		return
+	}
+	command, args := args[0], args[1:]
+	switch command {
+	case "serve":
+		runServer(name, args, false)
+	case "check":
+		runServer(name, args, true)
+	case "version":
+		printVersion()
+	case "bench":
+		runBench(args)
+	case "help":
+		fmt.Printf(commandsUsage, name, name)
+	default:
+		fmt.Printf("unknown command %q; run %s help for the commands\n", command, name)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,58 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// How many vaults a read must hear from before answering the client.
+type consistency string
+
+const (
+	// Answer with the first valid response from any vault; fast, but possibly stale.
+	consistencyOne consistency = "one"
+	// Answer once a majority of the vaults agree.
+	consistencyQuorum consistency = "quorum"
+	// Answer only if every vault which is not quarantined responds and they all agree.
+	consistencyAll consistency = "all"
+)
+
+// Convert a flag or query parameter value into a consistency level.
+func parseConsistency(name string) (consistency, error) {
+	switch c := consistency(name); c {
+	case consistencyOne, consistencyQuorum, consistencyAll:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown consistency level %q (expected %q, %q or %q)",
+			name, consistencyOne, consistencyQuorum, consistencyAll)
+	}
+}
+
+// Read a key from all the vaults at once and return whatever the first vault to give a valid answer
+// says. The remaining requests are left to finish in the background, so that what we know about
+// each vault stays up to date, unless the context is cancelled first.
+func (s *ControlServer) getValueFromAnyVault(ctx context.Context, key string) readResult {
+	_, vaults := s.quorumVaults()
+	// Buffered so that the stragglers never block once we've stopped listening.
+	reads := make(chan vaultRead, len(vaults))
+	for _, vault := range vaults {
+		go func(vault string) {
+			s.stagger(ctx)
+			reads <- s.readVault(ctx, key, vault)
+		}(vault)
+	}
+	result := readResult{}
+	for range vaults {
+		read := <-reads
+		result.reads = append(result.reads, read)
+		if read.err == nil || errors.Is(read.err, errValueExpired) {
+			result.value = read.value
+			result.expired = read.err != nil
+			result.ok = true
+			result.agreeing = 1
+			return result
+		}
+	}
+	return result
+}
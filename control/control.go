@@ -1,47 +1,405 @@
-package main
+package control
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/antithesishq/antithesis-sdk-go/assert"
 	"github.com/antithesishq/antithesis-sdk-go/lifecycle"
 	"github.com/golang/glog"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
+
+	"antithesis.com/glitch-grid/internal/flagconfig"
+	"antithesis.com/glitch-grid/internal/listen"
+	"antithesis.com/glitch-grid/internal/logging"
+	"antithesis.com/glitch-grid/internal/tlsutil"
 )
 
 type Details map[string]any
 
+// Settings for a control server, typically populated from command-line flags.
+type ControlConfig struct {
+	// Comma-separated list of vaults with which we will communicate.
+	Vaults string
+	// Whether the vaults store integers or opaque blobs.
+	ValueType valueType
+	// How many vaults a read must hear from, unless the client asks for something else.
+	Consistency consistency
+	// Which browser origins may call us directly.
+	CORS corsConfig
+	// Bearer token required by the admin API, which is disabled if empty.
+	AdminToken string
+	// Whether the metrics and admin endpoints are served only on the admin listener, and not on
+	// the data port.
+	AdminExclusive bool
+	// Shared secret presented to the vaults as a bearer token when writing, if they require one.
+	VaultToken string
+	// Extra certificate authorities to trust for https:// vaults, if any.
+	VaultCAs *x509.CertPool
+	// How we identify ourselves to the vaults as the writer of a value.
+	Name string
+	// How we retry calls to the vaults which may have failed transiently.
+	Retry retryPolicy
+	// When we stop calling a vault which keeps failing.
+	Breaker breakerPolicy
+	// How we resend committed writes to the vaults which missed them.
+	Repair repairPolicy
+	// The client with which to call the vaults over HTTP; if nil, one is created with the timeouts
+	// below, trusting VaultCAs. Tests may inject their own.
+	HTTPClient *http.Client
+	// How long to wait for a vault to answer a single call, and to connect to it.
+	VaultTimeout time.Duration
+	DialTimeout  time.Duration
+	// How long to wait for a vault to answer a read, and a write, if not the vault timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Whether to call plain HTTP vaults over HTTP/2 without TLS (h2c).
+	H2C bool
+	// The proxy through which to call the vaults over HTTP, if not the one named by the
+	// environment.
+	Proxy *url.URL
+	// How long a client may wait for us to answer a request (no limit if zero).
+	RequestDeadline time.Duration
+	// How long to wait for a vault to answer a read before sending it a duplicate (never if zero).
+	HedgeDelay time.Duration
+	// How many calls to the vaults may be outstanding at once, across all client requests (no
+	// limit if zero).
+	MaxVaultCalls int
+	// Up to how long to delay each call of a fan-out to the vaults, at random (none if zero).
+	FanoutStagger time.Duration
+	// How many client writes may be in flight at once; any more are turned away (no limit if zero).
+	MaxWrites int
+	// How often to re-resolve the vaults' hostnames (never if zero).
+	ResolveInterval time.Duration
+	// Where the vaults were discovered from, if they were, and how often to look them up again (or,
+	// for a source which watches, how long to wait after a failed lookup).
+	Discovery         vaultSource
+	DiscoveryInterval time.Duration
+	// How often to check the health of the vaults (never if zero).
+	HealthInterval time.Duration
+	// When we take a flapping vault out of service; this needs the health checker.
+	Quarantine quarantinePolicy
+	// The primary control server we stand by for, if we are a standby.
+	Primary string
+	// How long a primary keeps accepting writes without hearing from its standby, and so how long
+	// the standby waits before taking over (no failover if zero).
+	LeaseDuration time.Duration
+	// Whether to probe every vault before we start serving, opening connections to them.
+	WarmUp bool
+	// Whether to trace client requests and our calls to the vaults; the tracer provider is set
+	// up separately.
+	Tracing bool
+	// Where to log every request we answer, if anywhere.
+	AccessLog *logging.AccessLog
+	// The URL to POST to when the vaults stop, or start again, agreeing (none if empty).
+	WebhookURL string
+	// The URL to POST a report to when a handler panics (none if empty).
+	PanicHookURL string
+	// Where to record every committed write, if anywhere.
+	AuditLog *auditLog
+	// How long a request may take before we log where its time went (never if zero).
+	SlowRequest time.Duration
+	// Where to send metrics instead of serving them on /metrics for Prometheus, if anywhere.
+	Statsd *statsdSink
+	// How often to log a summary of the grid's health (never if zero).
+	SummaryInterval time.Duration
+	// The file from which the vault list and the reloadable settings are reloaded on SIGHUP,
+	// overriding those given here (none if empty).
+	ReloadFile string
+	// The certificate and key to serve HTTPS with, reloaded when they change (plain HTTP if nil).
+	Certs *certReloader
+	// Obtains and renews the certificates to serve HTTPS with instead, if they come from ACME.
+	ACME *autocert.Manager
+}
+
 // A control server which maintains a list of vaults which will store the data.
 type ControlServer struct {
-	mux      *http.ServeMux
-	Vaults   []string
-	minValue int
-	lock     sync.RWMutex
+	mux *http.ServeMux
+	// The client with which we call the vaults over HTTP, and the longest it lets any call take.
+	client        *http.Client
+	clientTimeout time.Duration
+	// The settings which can be reloaded while we run (see reload.go), and those we were started
+	// with, on top of which a reload applies the reload file.
+	current    atomic.Pointer[reloadableSettings]
+	base       ControlConfig
+	reloadLock sync.Mutex
+	// Holds a token for each outstanding call to a vault, if their number is limited.
+	calls chan struct{}
+	// Up to how long to delay each call of a fan-out, at random.
+	fanoutStagger time.Duration
+	// Holds a token for each client write in flight, if their number is limited.
+	writes chan struct{}
+	// How long to wait for a vault to answer a read before sending it a duplicate, if at all.
+	hedgeDelay time.Duration
+	// The mux wrapped in any middleware; this is what we serve.
+	handler http.Handler
+	// The metrics and admin endpoints, wrapped likewise, for the admin listener.
+	adminMux     *http.ServeMux
+	adminHandler http.Handler
+	metrics      *controlMetrics
+	// The certificate and key we serve HTTPS with, or where we get them from ACME, if we do.
+	certs *certReloader
+	acme  *autocert.Manager
+	// Whether we trace client requests and our calls to the vaults.
+	tracing bool
+	// The vaults may be changed at runtime through the admin API, so take a snapshot with
+	// vaultList() rather than reading this directly. The slice is replaced, never modified.
+	Vaults     []string
+	vaultsLock sync.RWMutex
+	// Bearer token required by the admin API, which is disabled if empty.
+	adminToken string
+	// Shared secret presented to the vaults when writing, if any.
+	vaultToken string
+	minValue   int
+	// How we identify ourselves to the vaults as the writer of a value.
+	name string
+	// How we retry calls to the vaults which may have failed transiently.
+	retry retryPolicy
+	// When we stop calling a vault which keeps failing, and each vault's circuit breaker, keyed by
+	// vault address.
+	breakerPolicy breakerPolicy
+	breakers      map[string]*circuitBreaker
+	breakerLock   sync.Mutex
+	// How we resend committed writes to the vaults which missed them, and the sequence number of
+	// the write being resent to each vault, keyed by vault address.
+	repair     repairPolicy
+	repairs    map[string]int64
+	repairLock sync.Mutex
+	// Repairs which have yet to finish, and a channel closed when we shut down, at which point
+	// they stop.
+	repairing sync.WaitGroup
+	stopping  chan struct{}
+	// Whether we store integers or opaque blobs.
+	valueType valueType
+	// The most recently committed value, in either mode, and when the vaults expire it, if it was
+	// written with a TTL (zero otherwise).
+	committed        string
+	committedExpires time.Time
+	// Incremented every time a write is committed to a majority of the vaults.
+	// Used to build the ETag returned to clients.
+	version int
+	// Distinguishes our ETags from those of earlier runs, whose versions counted from zero too.
+	epoch string
+	// The most recent committed writes, oldest first.
+	history []commitRecord
+	lock    sync.RWMutex
+	// What we last learned about each vault, keyed by vault address.
+	vaultStatus map[string]*vaultStatus
+	statusLock  sync.Mutex
+	// The outcomes of recent writes, keyed by the client's idempotency key.
+	idempotent      map[string]*idempotentResponse
+	idempotencyLock sync.Mutex
+	// Held exclusively by conditional writes, and shared by all other writes, so that nothing
+	// else can commit between a conditional write checking the version and committing.
+	writeLock sync.RWMutex
+	// The sequence number of the most recent write sent to the vaults.
+	sequence     int64
+	sequenceLock sync.Mutex
+	// Connections to the vaults we speak to over gRPC, keyed by address.
+	grpcConns map[string]*grpc.ClientConn
+	grpcLock  sync.Mutex
+	// The addresses each vault's hostname last resolved to, keyed by vault address, and a signal
+	// to re-resolve them now.
+	resolved    map[string]string
+	resolveLock sync.Mutex
+	resolveNow  chan struct{}
+	// How often we check the health of the vaults, if at all, and the most recent check of each
+	// vault, keyed by vault address.
+	healthInterval time.Duration
+	health         map[string]*vaultHealth
+	healthLock     sync.Mutex
+	// What we know about each vault's quarantine strikes, keyed by vault address.
+	quarantine     map[string]*quarantineState
+	quarantineLock sync.Mutex
+	// The primary we stand by for, if any, and the lease which decides when a standby takes over.
+	// A primary records when its standby last polled it, and whether the standby has told it
+	// that it has taken over; a standby, whether it has taken over.
+	primary       string
+	leaseDuration time.Duration
+	lastPolled    time.Time
+	deposed       bool
+	promoted      bool
+	haLock        sync.Mutex
+	// The webhook told when consensus is lost or restored, if any, the events waiting to be sent
+	// to it, and whether the latest quorum read was without consensus.
+	webhookURL    string
+	webhooks      chan webhookEvent
+	consensusLost bool
+	consensusLock sync.Mutex
+	// The hook told when a handler panics, if any, and the reports waiting to be sent to it.
+	panicHookURL string
+	panicReports chan panicReport
+	// Where we record every committed write, if anywhere.
+	audit *auditLog
+	// The most recent membership events, oldest first.
+	events     []clusterEvent
+	eventsLock sync.Mutex
+	// The most recent reads on which a vault disagreed with the quorum, oldest first.
+	glitches     []glitchEvent
+	glitchesLock sync.Mutex
 }
 
 //go:generate antithesis-go-generator -v antithesis.com/go/glitch-grid
+//go:generate protoc --proto_path=../proto --go_out=. --go_opt=paths=source_relative --go_opt=Mglitchgrid.proto=antithesis.com/glitch-grid/control;control glitchgrid.proto
 
 // Create and return a new Control server instance.
-// Provide a comma-separated list of vaults with which we will communicate.
-func NewControlServer(vaults string) *ControlServer {
+// Provide the configuration, including the comma-separated list of vaults with which we will communicate.
+func NewControlServer(config ControlConfig) *ControlServer {
 	assert.Always(true, "Instantiates a Control Server", nil)
 	s := new(ControlServer)
+	s.base = config
+	if config.ReloadFile != "" {
+		// The reload file overrides the command line from the start. main has checked it.
+		if merged, err := loadReloadFile(config); err == nil {
+			config = merged
+		}
+	}
+	vaults := config.Vaults
 	s.mux = http.NewServeMux()
 	s.Vaults = strings.Split(vaults, ",")
 	s.minValue = 0
+	s.valueType = config.ValueType
+	s.committed = config.ValueType.initial()
+	s.adminToken = config.AdminToken
+	s.vaultToken = config.VaultToken
+	s.name = config.Name
+	s.retry = config.Retry
+	s.breakerPolicy = config.Breaker
+	s.breakers = make(map[string]*circuitBreaker)
+	s.repair = config.Repair
+	s.repairs = make(map[string]int64)
+	s.stopping = make(chan struct{})
+	s.epoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+	s.certs = config.Certs
+	s.acme = config.ACME
+	s.fanoutStagger = config.FanoutStagger
+	if config.MaxVaultCalls > 0 {
+		s.calls = make(chan struct{}, config.MaxVaultCalls)
+	}
+	if config.MaxWrites > 0 {
+		s.writes = make(chan struct{}, config.MaxWrites)
+	}
+	if s.retry.Attempts < 1 {
+		s.retry.Attempts = 1
+	}
+	s.version = 0
 	s.lock = sync.RWMutex{}
+	s.vaultStatus = make(map[string]*vaultStatus)
+	s.idempotent = make(map[string]*idempotentResponse)
+	s.grpcConns = make(map[string]*grpc.ClientConn)
+	s.resolved = make(map[string]string)
+	s.resolveNow = make(chan struct{}, 1)
+	s.healthInterval = config.HealthInterval
+	s.health = make(map[string]*vaultHealth)
+	s.quarantine = make(map[string]*quarantineState)
+	s.primary = config.Primary
+	s.leaseDuration = config.LeaseDuration
+	s.current.Store(settingsFrom(config))
+	for _, vault := range s.Vaults {
+		s.vaultStatus[vault] = &vaultStatus{Address: vault}
+		s.recordEvent(eventVaultAdded, vault, "configured at startup")
+	}
+	// Operations are versioned under /v1/, so that breaking changes to the response formats can
+	// ship under /v2/. The unversioned paths are kept as aliases for existing clients.
 	s.mux.HandleFunc("/", s.handle)
-	// Set the default timeout for all HTTP operations to be one second.
-	http.DefaultClient.Timeout = time.Second
+	s.mux.HandleFunc("/v1/value", s.handle)
+	s.mux.HandleFunc("/history", s.handleHistory)
+	s.mux.HandleFunc("/v1/history", s.handleHistory)
+	s.mux.HandleFunc("/status", s.handleStatus)
+	s.mux.HandleFunc("/v1/status", s.handleStatus)
+	s.mux.HandleFunc("/dashboard", s.handleDashboard)
+	s.mux.HandleFunc("/healthz", s.handleHealthz)
+	s.mux.HandleFunc("/version", s.handleVersion)
+	s.mux.HandleFunc("/readyz", s.handleReadyz)
+	s.mux.HandleFunc("/events", s.handleEvents)
+	s.mux.HandleFunc("/v1/events", s.handleEvents)
+	s.mux.HandleFunc("/selftest", s.handleSelftest)
+	s.mux.HandleFunc("/vaults", s.handleVaults)
+	s.mux.HandleFunc("/v1/vaults", s.handleVaults)
+	s.mux.HandleFunc("/glitches", s.handleGlitches)
+	s.mux.HandleFunc("/v1/glitches", s.handleGlitches)
+	// The metrics and admin endpoints are also served on the admin listener, if there is one, and
+	// may be kept to it, away from clients.
+	s.adminMux = http.NewServeMux()
+	handleAdmin := func(pattern string, handler http.Handler) {
+		s.adminMux.Handle(pattern, handler)
+		if !config.AdminExclusive {
+			s.mux.Handle(pattern, handler)
+		}
+	}
+	handleAdmin("/admin/vaults", http.HandlerFunc(s.handleAdminVaults))
+	handleAdmin("/admin/vaults/", http.HandlerFunc(s.handleAdminVaults))
+	handleAdmin("/admin/lease", http.HandlerFunc(s.handleLease))
+	handleAdmin("/admin/loglevel", http.HandlerFunc(s.handleLogLevel))
+	handleAdmin("/admin/reload", http.HandlerFunc(s.handleReload))
+	s.metrics = newControlMetrics(config.Statsd)
+	if config.Statsd == nil {
+		handleAdmin("/metrics", s.metrics.handler())
+	}
+	s.handler = s.metrics.wrap(s.mux, withRequestID(config.AccessLog.Wrap(withSlowLog(config.SlowRequest, withDeadline(config.RequestDeadline, config.CORS.wrap(s.withRecovery(s.mux)))), requestIDOf)))
+	s.adminHandler = s.metrics.wrap(s.adminMux, withRequestID(config.AccessLog.Wrap(s.withRecovery(s.adminMux), requestIDOf)))
+	s.hedgeDelay = config.HedgeDelay
+	s.client = config.HTTPClient
+	if s.client == nil {
+		// Each call has its own timeout, so the client only needs to outlast the longest. If the
+		// timeouts can be reloaded, we cannot know the longest, and rely on each call's alone.
+		timeout := s.settings().longestTimeout()
+		if config.ReloadFile != "" {
+			timeout = 0
+		}
+		s.client = newVaultClient(config.VaultCAs, timeout, config.DialTimeout, config.H2C, config.Proxy)
+	}
+	s.clientTimeout = s.client.Timeout
+	s.tracing = config.Tracing
+	if s.tracing {
+		s.handler = s.traceRequests(s.handler)
+		s.client = tracedClient(s.client)
+	}
+	s.audit = config.AuditLog
+	if config.WebhookURL != "" {
+		s.webhookURL = config.WebhookURL
+		s.webhooks = make(chan webhookEvent, webhookQueueSize)
+		go s.sendWebhooks()
+	}
+	if config.PanicHookURL != "" {
+		s.panicHookURL = config.PanicHookURL
+		s.panicReports = make(chan panicReport, webhookQueueSize)
+		go s.sendPanicReports()
+	}
+	if config.WarmUp {
+		s.warmUp()
+	}
+	if config.ResolveInterval > 0 {
+		go s.resolveEvery(config.ResolveInterval)
+	}
+	if config.Discovery != nil && config.DiscoveryInterval > 0 {
+		go s.discoverEvery(config.Discovery, config.DiscoveryInterval)
+	}
+	if s.healthInterval > 0 {
+		go s.healthCheckEvery(s.healthInterval)
+	}
+	if s.primary != "" && s.leaseDuration > 0 {
+		go s.followPrimary()
+	}
+	if config.SummaryInterval > 0 {
+		go s.summarizeEvery(config.SummaryInterval)
+	}
 	glog.Infof("Defined %d vaults", len(s.Vaults))
 	if len(s.Vaults) == 23456789 {
 		assert.Unreachable("We have 23456789 vaults should be unreachable", Details{"numVaults": len(s.Vaults)})
@@ -53,21 +411,28 @@ func NewControlServer(vaults string) *ControlServer {
 	return s
 }
 
-// Handle GET and POST requests to the root path.
+// Handle GET and POST requests to the value path (or its alias, the root path).
 func (s *ControlServer) handle(w http.ResponseWriter, r *http.Request) {
 
 	lifecycle.SendEvent("handle_event", Details{"message":"Handle is called.", "method": r.Method})
 
-	if r.URL.Path != "/" {
+	if r.URL.Path != "/" && r.URL.Path != "/v1/value" {
 		assert.AlwaysOrUnreachable(true, "Control service: received a non-root request paths & handled that correctly.", Details{"path": r.URL.Path})
-		// We only support operations on the root path.
+		// We only support operations on the value path.
 		http.NotFound(w, r)
 		return
 	}
 	if r.Method == http.MethodGet {
 		s.get(w, r)
+	} else if r.Method == http.MethodHead {
+		s.head(w, r)
 	} else if r.Method == http.MethodPost {
-		s.post(w, r)
+		if !s.allowWrite(w) {
+			return
+		}
+		s.withWriteLimit(w, r, func(w http.ResponseWriter, r *http.Request) {
+			s.withIdempotency(w, r, s.post)
+		})
 	} else {
 		assert.AlwaysOrUnreachable(true, "Control service: received a http method that is not a GET or a POST & handled that correctly.", Details{"method": r.Method})
 		// Do not support PATCH, DELETE, etc, operations.
@@ -77,52 +442,164 @@ func (s *ControlServer) handle(w http.ResponseWriter, r *http.Request) {
 
 // Get the current value of the counter.
 // Poll all our backend servers and see if we have majority consensus.
-// Sends a 200 and the value to the client if we have a consensus, 500 otherwise.
+// Sends a 200 and the value to the client if we have a consensus, 500 otherwise (or 404 if the
+// consensus is that the value has expired). The client may override the default consistency level
+// with the `consistency` query parameter, and ask for each vault's response with `verbose=true`.
+// If the client sends an If-None-Match header matching the ETag of the most recently committed
+// value, respond with a 304 without contacting the vaults at all, unless its TTL has elapsed.
 func (s *ControlServer) get(w http.ResponseWriter, r *http.Request) {
 	assert.Always(true, "Control service: received a request to retrieve the counter's value", nil)
-	result := s.getValueFromVaults()
+	s.lock.RLock()
+	committed := s.committed
+	expires := s.committedExpires
+	version := s.version
+	etag := s.versionETag(version)
+	s.lock.RUnlock()
+	// Once the value has expired, only the vaults can say what there is in its place.
+	live := expires.IsZero() || time.Now().Before(expires)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && live && etagMatches(inm, etag) {
+		assert.Sometimes(true, "Control service: served a conditional GET without contacting the vaults", Details{"etag": etag})
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	level := s.settings().consistency
+	if c := r.URL.Query().Get("consistency"); c != "" {
+		var err error
+		if level, err = parseConsistency(c); err != nil {
+			writeProblem(w, http.StatusBadRequest, codeBadParameter, err.Error(), nil)
+			return
+		}
+	}
+	result := s.getValueFromVaults(r.Context(), valueKey, level)
 	var statusCode int
 	var body string
-	if result >= 0 {
+	if result.ok && !result.expired {
 		assert.AlwaysOrUnreachable(true, "Counter's value retrieved", Details{"counter": body, "status": statusCode})
 		statusCode = http.StatusOK
-		body = fmt.Sprintf("%d", result)
+		body = result.value
+		// Only tag the response if the vaults agree with what we last committed; otherwise the
+		// ETag would describe a value other than the one in the body.
+		if result.value == committed {
+			w.Header().Set("ETag", etag)
+		}
+	} else if result.ok {
+		// The vaults agree that the value's TTL has elapsed.
+		statusCode = http.StatusNotFound
 	} else {
-		assert.Unreachable("Counter should never be unavailable", Details{"result": result})
+		assert.Unreachable("Counter should never be unavailable", Details{"agreeing": result.agreeing})
 		statusCode = http.StatusInternalServerError
-		body = "-1"
 	}
 
-	expected_status := (statusCode == http.StatusOK) || (statusCode == http.StatusInternalServerError)
+	expected_status := (statusCode == http.StatusOK) || (statusCode == http.StatusInternalServerError) || (statusCode == http.StatusNotFound)
 	assert.AlwaysOrUnreachable(expected_status, "HTTP return status is expected", Details{"status": statusCode})
 	assert.Always(statusCode != http.StatusInternalServerError, "The server never return a 500 HTTP response code", Details{"status": statusCode})
-	w.WriteHeader(statusCode)
-	w.Write([]byte(body))
+	if verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose")); verbose {
+		s.writeVerbose(w, statusCode, result, version)
+		return
+	}
+	switch statusCode {
+	case http.StatusNotFound:
+		writeProblem(w, statusCode, codeValueExpired, "The value's TTL has elapsed", nil)
+	case http.StatusInternalServerError:
+		writeProblem(w, statusCode, codeNoQuorum,
+			fmt.Sprintf("Only %d/%d vaults agree on a value", result.agreeing, len(s.vaultList())), Details{"agreeing": result.agreeing})
+	default:
+		writeValue(w, r, statusCode, s.valueType, body, version)
+	}
+}
+
+// Report the current consensus value, committed version and number of agreeing vaults in the
+// response headers, without a body. This is intended for lightweight health probes.
+// Sends a 200 if we have a consensus, 500 otherwise (or 404 if the value has expired).
+func (s *ControlServer) head(w http.ResponseWriter, r *http.Request) {
+	result := s.getValueFromVaults(r.Context(), valueKey, s.settings().consistency)
+	s.lock.RLock()
+	version := s.version
+	s.lock.RUnlock()
+	if s.valueType == valueTypeInt {
+		// Blobs may not be representable in a header, so we only report integers.
+		value := result.value
+		if !result.ok || result.expired {
+			value = s.valueType.missing()
+		}
+		w.Header().Set("X-Counter-Value", value)
+	}
+	w.Header().Set("X-Counter-Version", fmt.Sprintf("%d", version))
+	w.Header().Set("X-Vaults-Agreeing", fmt.Sprintf("%d/%d", result.agreeing, len(s.vaultList())))
+	if result.ok && !result.expired {
+		w.WriteHeader(http.StatusOK)
+	} else if result.ok {
+		w.Header().Set(errorCodeHeader, string(codeValueExpired))
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		w.Header().Set(errorCodeHeader, string(codeNoQuorum))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
 }
 
-// Get the consensus value stored across our vaults.
+// What a single vault reported when we read from it: either a value, or that its value expired.
+type vote struct {
+	value   string
+	expired bool
+}
+
+// The outcome of reading from all of the vaults.
+type readResult struct {
+	// The value agreed on by a majority of the vaults.
+	value string
+	// Whether what the majority agreed on is that the value has expired.
+	expired bool
+	// Whether we have consensus at all.
+	ok bool
+	// How many vaults agreed on the most common value.
+	agreeing int
+	// What each vault we heard from told us.
+	reads []vaultRead
+}
+
+// What a single vault told us when we read from it, and how long it took.
+type vaultRead struct {
+	vault   string
+	value   string
+	err     error
+	latency time.Duration
+}
+
+// Get the consensus value stored under a key across our vaults; valueKey for the grid's value.
 // Talk to each vault and get the value stored in said vault. If a majority of the vaults have the same
-// value, then we have consensus and can return that value. If there is no consensus, return -1.
-func (s *ControlServer) getValueFromVaults() int {
+// value (or agree that the value has expired) then we have consensus and can return that value.
+// Also returns the number of vaults which agreed on the most common value.
+// The consistency level may relax this to the first vault to answer, or tighten it to all vaults.
+// If the context is cancelled (e.g. the client disconnects), the outstanding vault calls are too.
+func (s *ControlServer) getValueFromVaults(ctx context.Context, key string, level consistency) readResult {
+	if level == consistencyOne {
+		return s.getValueFromAnyVault(ctx, key)
+	}
+	all, vaults := s.quorumVaults()
 	var wg sync.WaitGroup
 	m := sync.RWMutex{}
 	// Map from a value to the number of vaults which currently have that value.
-	counts := map[int]int{}
+	counts := map[vote]int{}
+	// The individual responses, for clients who want the gory details.
+	reads := []vaultRead{}
 	// Loop over all the vault addresses, and execute each one in a separate goroutine.
 	// Use a WaitGroup to keep track of the pending functions, and a ReadWrite lock to
 	// protect access to the counts tracker.
-	for _, vault := range s.Vaults {
+	for _, vault := range vaults {
 		wg.Add(1)
-		go func(m *sync.RWMutex, vault string, counts map[int]int) {
+		go func(m *sync.RWMutex, vault string, counts map[vote]int) {
 			defer wg.Done()
-			getValueFromVault(m, vault, counts)
+			s.stagger(ctx)
+			s.getValueFromVault(ctx, key, m, vault, counts, &reads)
 		}(&m, vault, counts)
 	}
 	wg.Wait()
-	glog.Infof("Counts data: %v", counts)
+	logf(ctx, logInfo, "Counts data: %v", counts)
 	if len(counts) == 0 {
-		glog.Error("Could not reach any vaults to get counts data")
-		return -1
+		logEvent(ctx, logError, "Could not reach any vaults to get counts data", logFields{"error_code": codeNoQuorum})
+		s.recordQuorumRead(ctx, key, 0, len(all), false)
+		return readResult{reads: reads}
 	}
 	// Iterate over the map of values to the count of vaults with that value.
 	// If any count represents a majority, then by default it will have the maximum
@@ -139,46 +616,58 @@ func (s *ControlServer) getValueFromVaults() int {
 		if c > maxVal {
 			maxVal = c
 		}
-		if s.hasMajority(c) {
+		if level == consistencyAll {
+			if c == len(vaults) && s.hasMajority(c, len(all)) {
+				// Every vault we asked agrees. Quarantined vaults are not asked, so they cannot
+				// hold this up, but they still count towards the majority it needs.
+				s.recordQuorumRead(ctx, key, c, len(all), true)
+				return readResult{value: v.value, expired: v.expired, ok: true, agreeing: c, reads: reads}
+			}
+			continue
+		}
+		if s.hasMajority(c, len(all)) {
 			// We have consensus. Return the value.
-			return v
+			s.recordQuorumRead(ctx, key, c, len(all), true)
+			if key == valueKey {
+				s.detectGlitches(ctx, v, reads)
+			}
+			return readResult{value: v.value, expired: v.expired, ok: true, agreeing: c, reads: reads}
 		}
 	}
 	// We do not have consensus, but we do know how popular the most common value(s) is/are.
-	glog.Warningf("No majority; only have %d/%d with a consensus value", maxVal, len(s.Vaults))
-	return -1
+	logEvent(ctx, logWarning, fmt.Sprintf("No majority; only have %d/%d with a consensus value", maxVal, len(all)),
+		logFields{"error_code": codeNoQuorum})
+	s.recordQuorumRead(ctx, key, maxVal, len(all), false)
+	return readResult{agreeing: maxVal, reads: reads}
 }
 
-// Get the value stored in a single vault.
-// If we are able to fetch a valid integer from the vault, update the counts map with that
+// Get the value stored under a key in a single vault.
+// If we are able to fetch a valid value from the vault, update the counts map with that
 // information in a thread-safe way. Otherwise, return without updating (but log the issue).
-func getValueFromVault(m *sync.RWMutex, vault string, counts map[int]int) {
-	url := fmt.Sprintf("http://%s/", vault)
-	var resp *http.Response
-	var err error
-	if resp, err = http.Get(url); err != nil {
-		// This could include a timeout.
-		glog.Warningf("Error getting value from vault %s: %v\n", url, err)
-		return
-	}
-	if resp.StatusCode != http.StatusOK {
-		// Vault was not happy.
-		glog.Warningf("Error getting value from vault %s: invalid status code %v\n", url, resp.StatusCode)
-		return
-	}
-	body, readError := io.ReadAll(resp.Body)
-	if readError != nil {
-		// Vault was supposedly-happy but did not return a value.
-		glog.Warningf("Error getting value from vault %s: error reading from body: %v\n", url, readError)
+// Either way, add the outcome to the list of individual reads and, if it was of the grid's value,
+// remember it so it can be reported by the status endpoint.
+// A vault whose value has expired counts as a vote for the value being absent; a vault whose value
+// has been corrupted does not vote at all.
+func (s *ControlServer) getValueFromVault(ctx context.Context, key string, m *sync.RWMutex, vault string, counts map[vote]int, reads *[]vaultRead) {
+	read := s.readVault(ctx, key, vault)
+	value, err, latency := read.value, read.err, read.latency
+	m.Lock()
+	*reads = append(*reads, read)
+	m.Unlock()
+	v := vote{value: value}
+	if errors.Is(err, errValueExpired) {
+		v.expired = true
+	} else if errors.Is(err, errValueCorrupted) {
+		// Unlike a vault which disagrees with the others, this vault knows its value is wrong, so
+		// it does not get a vote.
+		assert.Sometimes(true, "Control service: a vault reported a corrupted value", Details{"vault": vault})
+		logEvent(ctx, logError, "Vault reports that its value is corrupted", logFields{"vault": vault, "error_code": codeVaultCorrupt, "latency_ms": latency})
 		return
-	}
-	v, e := strconv.Atoi(string(body))
-	if e != nil {
-		// Vault returned a value, but it was not a valid integer.
-		glog.Warningf("Error getting value from vault %s: invalid body response: %v (%v)\n", url, body, e)
+	} else if err != nil {
+		logEvent(ctx, logWarning, "Error getting value from vault", logFields{"vault": vault, "error": err.Error(), "error_code": vaultErrorCode(err), "latency_ms": latency})
 		return
 	}
-	// If we've gotten here, then we received a valid integer back from the vault.
+	// If we've gotten here, then we received a valid value back from the vault.
 	// Start the map manipulation operation critical section.
 	m.Lock()
 	count, ok := counts[v]
@@ -189,7 +678,97 @@ func getValueFromVault(m *sync.RWMutex, vault string, counts map[int]int) {
 	counts[v] = count + 1
 	m.Unlock()
 	// End of the map manipulation critical section.
-	glog.V(1).Infof("Get vault %s Value %d", url, v)
+	if glog.V(1) {
+		logEvent(ctx, logInfo, "Got value from vault", logFields{"vault": vault, "value": v.value, "expired": v.expired, "latency_ms": latency})
+	}
+}
+
+// Read a key from a single vault, in a span of its own, and record the outcome in the vault's
+// metrics and, if it was of the grid's value, its status.
+func (s *ControlServer) readVault(ctx context.Context, key string, vault string) vaultRead {
+	start := time.Now()
+	ctx, endSpan := startVaultSpan(ctx, opRead, vault)
+	value, err := s.fetchValueFromVault(ctx, vault, key)
+	latency := time.Since(start)
+	if errors.Is(err, errValueExpired) {
+		// An expired value is an answer, not a failure.
+		endSpan(nil)
+	} else {
+		endSpan(err)
+	}
+	if key == valueKey {
+		s.recordVaultRead(vault, value, err)
+	}
+	if result, ok := readResultOf(err); ok {
+		s.recordVaultCall(ctx, vault, opRead, result, err, latency)
+	}
+	return vaultRead{vault: vault, value: value, err: err, latency: latency}
+}
+
+// Returned when a vault reports that the value it was holding has expired.
+var errValueExpired = errors.New("value expired")
+
+// Returned when a vault reports that the value it was holding no longer matches its checksum.
+var errValueCorrupted = errors.New("value corrupted")
+
+// The status with which a vault reports that its value no longer matches its checksum.
+const corruptedStatus = http.StatusUnprocessableEntity
+
+// The header with which a client may ask for a written value to expire after a duration (e.g.
+// "30s"). It is forwarded as-is to the vaults, which are responsible for expiring the value.
+const ttlHeader = "X-Value-TTL"
+
+// The header with which we tell the vaults who wrote a value, so that they can report it on reads.
+const writerHeader = "X-Value-Writer"
+
+// Fetch the value stored under a key in a single vault, returning an error if the vault could not be reached
+// or did not return a valid value. Vaults whose address starts with grpc:// are asked over gRPC, and
+// those whose address starts with https:// over HTTPS. Vaults whose circuit is open are not asked.
+func (s *ControlServer) fetchValueFromVault(ctx context.Context, vault string, key string) (string, error) {
+	if err := s.healthAllow(vault); err != nil {
+		return "", err
+	}
+	if err := s.breakerAllow(vault); err != nil {
+		return "", err
+	}
+	if addr, ok := grpcAddress(vault); ok {
+		value, err := s.fetchValueOverGRPC(ctx, addr, key)
+		s.breakerSettle(ctx, vault, grpcFailed(err))
+		return value, err
+	}
+	url := vaultKeyURL(vault, key)
+	resp, err := s.withRetries(ctx, vault, func(ctx context.Context) (*http.Response, error) {
+		return s.hedgedGet(ctx, url)
+	})
+	s.breakerSettle(ctx, vault, retryable(resp, err))
+	if err != nil {
+		// This could include a timeout.
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		// Vault had a value, but its TTL elapsed.
+		return "", errValueExpired
+	}
+	if resp.StatusCode == corruptedStatus {
+		// Vault had a value, but it has rotted.
+		return "", errValueCorrupted
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Vault was not happy.
+		return "", fmt.Errorf("invalid status code %v", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		// Vault was supposedly-happy but did not return a value.
+		return "", fmt.Errorf("error reading from body: %v", err)
+	}
+	v, err := s.valueType.parse(body)
+	if err != nil {
+		// Vault returned a value, but it was not valid (e.g., not an integer in integer mode).
+		return "", fmt.Errorf("invalid body response: %q (%v)", body, err)
+	}
+	return v, nil
 }
 
 // TODO: Call this when we detect that a vault is in a bad state.
@@ -201,78 +780,205 @@ func healFailingVault(vault string) {
 
 // Update the value in storage to what is provided in the body.
 // Contact each vault and store that value in the vault.
+// If the client sends an If-Match header, the write is only made if it matches the ETag of the
+// currently committed version; otherwise we respond with a 412.
+// With `?dry_run=true`, the write is validated and the vaults probed, but nothing is committed.
 func (s *ControlServer) post(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		// We did not get a valid body from the client. Tell them so.
-		glog.Warningf("Could not read body: %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid or missing POST body"))
+		logf(r.Context(), logWarning, "Could not read body: %v", err)
+		writeProblem(w, http.StatusBadRequest, codeBadBody, "Invalid or missing POST body", nil)
 		return
 	}
-	n, e := strconv.Atoi(string(body))
-	if n < 0 || e != nil {
-		// We got a body, but it is not a valid integer (or not valid for us).
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid or missing POST body"))
+	raw, e := decodeValue(s.valueType, r.Header.Get("Content-Type"), body)
+	var value string
+	if e == nil {
+		value, e = s.valueType.parse(raw)
+	}
+	if e != nil {
+		// We got a body, but it is not a valid value (or not valid for us).
+		writeProblem(w, http.StatusBadRequest, codeBadBody, "Invalid or missing POST body", nil)
 		return
 	}
-	// Check to make sure that this value is larger than the one we've previously committed
-	s.lock.RLock()
-	if n < s.minValue {
-		msg := fmt.Sprintf("Client would make value decrease from %d to %d", s.minValue, n)
+	// The vaults always receive the value in its canonical plain form, however the client sent it.
+	body = []byte(value)
+	var ttl time.Duration
+	if h := r.Header.Get(ttlHeader); h != "" {
+		if ttl, err = time.ParseDuration(h); err != nil || ttl <= 0 {
+			writeProblem(w, http.StatusBadRequest, codeBadParameter, "Invalid TTL", nil)
+			return
+		}
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		s.writeLock.Lock()
+		defer s.writeLock.Unlock()
+		s.lock.RLock()
+		etag := s.versionETag(s.version)
 		s.lock.RUnlock()
-		glog.Warning(msg)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
+		if !etagMatchesStrongly(ifMatch, etag) {
+			assert.Sometimes(true, "Control service: rejected a conditional write for a stale version", Details{"ifMatch": ifMatch, "etag": etag})
+			w.Header().Set("ETag", etag)
+			writeProblem(w, http.StatusPreconditionFailed, codeVersionMismatch,
+				fmt.Sprintf("Committed version is %s", etag), Details{"committedVersion": etag})
+			return
+		}
+	} else {
+		s.writeLock.RLock()
+		defer s.writeLock.RUnlock()
+	}
+	n := 0
+	if s.valueType == valueTypeInt {
+		// Check to make sure that this value is larger than the one we've previously committed
+		n, _ = strconv.Atoi(value)
+		s.lock.RLock()
+		if minValue := s.minValue; n < minValue {
+			s.lock.RUnlock()
+			msg := fmt.Sprintf("Client would make value decrease from %d to %d", minValue, n)
+			logEvent(r.Context(), logWarning, msg, logFields{"error_code": codeValueDecrease})
+			writeProblem(w, http.StatusBadRequest, codeValueDecrease, msg, Details{"minValue": minValue, "requestedValue": n})
+			return
+		}
+		s.lock.RUnlock()
+	}
+	if isDryRun(r) {
+		s.dryRunWrite(w, r)
+		return
+	}
+	if deadline, ok := writeDeadline(r.Context()); ok && time.Until(deadline) < s.settings().writeTimeout {
+		// The vaults might not all answer in time, and once the write is sent, it must be seen
+		// through, so refuse it while it is still certain that nothing was applied.
+		writeProblem(w, http.StatusServiceUnavailable, codeDeadlineExceeded,
+			"There is not enough time left before the deadline to send the write to the vaults", nil)
 		return
 	}
-	s.lock.RUnlock()
 	// Send the update to the vaults, keeping track of how many vaults actually responded to us.
 	// Technically this is a set(), but because Go doesn't have sets, this is a map of vaults to
 	// booleans, where the value stored in the map doesn't really matter. The presence of ANY
 	// value is enough to show that we got a successful response from the vault.
 	resp := make(map[string]bool)
+	// Quarantined vaults are not sent the write, but still count towards the majority it needs.
+	all, vaults := s.quorumVaults()
+	numVaults := len(all)
 	assert.AlwaysOrUnreachable(
-		len(s.Vaults) > 0,
+		numVaults > 0,
 		"Control service: there are vaults to update",
-		Details{"numVaults": len(s.Vaults)},
+		Details{"numVaults": numVaults},
 	)
-	s.postValueToVaults(body, resp)
+	sequence := s.nextSequence()
+	// The vaults count the TTL from when they receive the write, which is no earlier than this.
+	sent := time.Now()
+	s.postValueToVaults(r.Context(), vaults, body, ttl, sequence, resp)
 	// If the number of responses represents a majority of the vaults, then we can claim success
 	// in storing this value in our system. Otherwise it represents a server failure.
-	if s.hasMajority(len(resp)) {
-		w.WriteHeader(http.StatusOK)
+	statusCode := http.StatusInternalServerError
+	version := 0
+	if s.hasMajority(len(resp), numVaults) {
 		// Set the min value here to prevent us from going backwards.
 		s.lock.Lock()
-		assert.AlwaysOrUnreachable(
-			n > s.minValue,
-			"Control service: unnecessary update attempted",
-			Details{"minValue": s.minValue, "requestedValue": n},
-		)
-		s.minValue = n
+		if s.valueType == valueTypeInt {
+			assert.AlwaysOrUnreachable(
+				n > s.minValue,
+				"Control service: unnecessary update attempted",
+				Details{"minValue": s.minValue, "requestedValue": n},
+			)
+			s.minValue = n
+		}
+		s.committed = value
+		s.committedExpires = time.Time{}
+		if ttl > 0 {
+			s.committedExpires = sent.Add(ttl)
+		}
+		s.version++
+		s.recordCommit(commitRecord{
+			Value:     s.valueType.toJSON(value),
+			Version:   s.version,
+			Timestamp: time.Now(),
+			Acks:      len(resp),
+			NumVaults: numVaults,
+		})
+		version = s.version
+		w.Header().Set("ETag", s.versionETag(version))
 		s.lock.Unlock()
-	} else {
-		w.WriteHeader(http.StatusInternalServerError)
+		statusCode = http.StatusOK
+		s.auditWrite(r, value, version, sequence, resp, numVaults)
+		s.repairStragglers(body, ttl, sequence, resp)
+	}
+	if statusCode != http.StatusOK {
+		if r.Context().Err() == nil {
+			s.metrics.consensusFailure(opWrite)
+			markFailed(r.Context(), string(codeNoQuorum))
+			logEvent(r.Context(), logWarning, fmt.Sprintf("No majority; only %d/%d vaults acknowledged the write", len(resp), numVaults),
+				logFields{"error_code": codeNoQuorum})
+		}
+		writeProblem(w, statusCode, codeNoQuorum, fmt.Sprintf("Sent updates to %d/%d vaults", len(resp), numVaults),
+			Details{"acks": len(resp), "numVaults": numVaults})
+		return
 	}
-	// In addition to the status code, unconditionally return a message of how many vaults we updated.
-	w.Write([]byte(fmt.Sprintf("Sent updates to %d/%d vaults", len(resp), len(s.Vaults))))
+	// In addition to the status code, return a message of how many vaults we updated.
+	writeWriteResult(w, r, statusCode, len(resp), numVaults, version)
 }
 
 // Actually send the POST commands to the vaults.
-func (s *ControlServer) postValueToVaults(body []byte, resp map[string]bool) {
+// If the TTL is positive, the vaults will expire the value once it elapses.
+// Every vault receives the same sequence number, which must be newer than any previous write's.
+// If the context is cancelled (e.g. the client disconnects), the outstanding writes are too.
+func (s *ControlServer) postValueToVaults(ctx context.Context, vaults []string, body []byte, ttl time.Duration, sequence int64, resp map[string]bool) {
 	// Use a WaitGroup so we can run the requests in parallel goroutine threads.
 	var wg sync.WaitGroup
 	// We will need to synchronize access to the response map.
 	m := sync.RWMutex{}
 	// For each vault, send a POST message containing the same body we received from the client.
-	for _, vault := range s.Vaults {
+	for _, vault := range vaults {
 		wg.Add(1)
 		go func(m *sync.RWMutex, vault string, body []byte, resp map[string]bool) {
 			defer wg.Done()
-			glog.V(1).Infof("Setting vault %s value to %s", vault, string(body))
-			url := fmt.Sprintf("http://%s/", vault)
-			r, err := http.Post(url, "text/plain", bytes.NewBuffer(body))
+			s.stagger(ctx)
+			result := resultFailure
+			var failure error
+			var start time.Time
+			ctx, endSpan := startVaultSpan(ctx, opWrite, vault)
+			defer func() {
+				endSpan(failure)
+				if result == resultSuccess || ctx.Err() == nil {
+					// A write we cancelled says nothing about the vault.
+					s.recordVaultCall(ctx, vault, opWrite, result, failure, time.Since(start))
+				}
+			}()
+			if glog.V(1) {
+				logEvent(ctx, logInfo, "Setting vault value", logFields{"vault": vault, "value": string(body)})
+			}
+			if err := s.healthAllow(vault); err != nil {
+				logEvent(ctx, logWarning, "Not setting vault value", logFields{"vault": vault, "value": string(body), "error": err.Error(), "error_code": vaultErrorCode(err)})
+				result = resultSkipped
+				failure = err
+				return
+			}
+			if err := s.breakerAllow(vault); err != nil {
+				logEvent(ctx, logWarning, "Not setting vault value", logFields{"vault": vault, "value": string(body), "error": err.Error(), "error_code": vaultErrorCode(err)})
+				result = resultSkipped
+				failure = err
+				return
+			}
+			start = time.Now()
+			if addr, ok := grpcAddress(vault); ok {
+				err := s.setOverGRPC(ctx, addr, valueKey, body, ttl, sequence)
+				s.breakerSettle(ctx, vault, grpcFailed(err))
+				if err != nil {
+					logEvent(ctx, logWarning, "Error setting vault value", logFields{"vault": vault, "value": string(body), "error": err.Error(), "error_code": vaultErrorCode(err), "latency_ms": time.Since(start)})
+					failure = err
+					return
+				}
+				m.Lock()
+				resp[vault] = true
+				m.Unlock()
+				s.recordVaultWrite(vault)
+				result = resultSuccess
+				return
+			}
+			url := vaultURL(vault)
+			r, err := s.postToVault(ctx, url, body, ttl, sequence)
+			s.breakerSettle(ctx, vault, retryable(r, err))
 
 			// No error was provided by http.Post()
 			if err == nil {
@@ -281,14 +987,16 @@ func (s *ControlServer) postValueToVaults(body []byte, resp map[string]bool) {
 						m.Lock()
 						resp[url] = true
 						m.Unlock()
+						s.recordVaultWrite(vault)
+						result = resultSuccess
 					} else {
 						assert.AlwaysOrUnreachable(
 							true,
 							"HTTP Status might not be OK when http.Post() reports no error has occurred",
 							Details{"statusCode": r.StatusCode},
 						)
-						// This could include a failure to connect or a timeout during the update.
-						glog.Warningf("Error setting vault %s value to %s: %v", vault, string(body), err)
+						logEvent(ctx, logWarning, "Error setting vault value", logFields{"vault": vault, "value": string(body), "status": r.StatusCode, "error_code": codeVaultError, "latency_ms": time.Since(start)})
+						failure = fmt.Errorf("invalid status code %v", r.StatusCode)
 					}
 				} else {
 					assert.Unreachable("There is no error reported by http.Post(), and HTTP Status is not available", nil)
@@ -312,7 +1020,8 @@ func (s *ControlServer) postValueToVaults(body []byte, resp map[string]bool) {
 					)
 				}
 				// This could include a failure to connect or a timeout during the update.
-				glog.Warningf("Error setting vault %s value to %s: %v", vault, string(body), err)
+				logEvent(ctx, logWarning, "Error setting vault value", logFields{"vault": vault, "value": string(body), "error": err.Error(), "error_code": vaultErrorCode(err), "latency_ms": time.Since(start)})
+				failure = err
 			}
 		}(&m, vault, body, resp)
 	}
@@ -320,14 +1029,80 @@ func (s *ControlServer) postValueToVaults(body []byte, resp map[string]bool) {
 	wg.Wait()
 }
 
+// Build the (strong) ETag for a given committed version, as of this run of the server.
+func (s *ControlServer) versionETag(version int) string {
+	return fmt.Sprintf("\"%s-v%d\"", s.epoch, version)
+}
+
+// Check whether an If-None-Match header value matches the given ETag.
+// The header may contain a comma-separated list of (possibly weak) ETags. "*" never matches: it
+// would say that a value exists, which only the vaults can tell us.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// The number of vaults needed for a majority, where majority has to be >50%.
+func majorityOf(numVaults int) int {
+	// By default this division will do the equivalent of math.Floor()
+	return (numVaults / 2) + 1
+}
+
+// Send a single POST request to a vault, asking it to expire the value after the TTL if positive.
+// The vault will refuse the write if it has already applied one with a later sequence number.
+// If we have a vault token, we present it so that the vault knows the write comes from us.
+// Transient failures are retried under our retry policy.
+func (s *ControlServer) postToVault(ctx context.Context, url string, body []byte, ttl time.Duration, sequence int64) (*http.Response, error) {
+	r, err := s.withRetries(ctx, url, func(ctx context.Context) (*http.Response, error) {
+		return withTimeout(ctx, s.settings().writeTimeout, func(ctx context.Context) (*http.Response, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(body))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "text/plain")
+			if ttl > 0 {
+				req.Header.Set(ttlHeader, ttl.String())
+			}
+			req.Header.Set(sequenceHeader, strconv.FormatInt(sequence, 10))
+			req.Header.Set(writerHeader, s.name)
+			return s.doVault(req)
+		})
+	})
+	if err == nil {
+		// We only care about the status code.
+		r.Body.Close()
+	}
+	return r, err
+}
+
+// Check whether an If-Match header value matches the given ETag.
+// Unlike If-None-Match, weak ETags never match.
+func etagMatchesStrongly(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
 // Check if this number represents a majority of the vaults, where majority has to be >50%.
-func (s *ControlServer) hasMajority(count int) bool {
+func (s *ControlServer) hasMajority(count int, numVaults int) bool {
 	assert.Always(true, "Control service: determine if there is a majority", nil)
 	assert.Always(count > 0, "Control service: majority is always expected to be positive", Details{"count": count})
-	assert.Always(len(s.Vaults) > 0, "Control service: there are vaults known to the service", nil)
-	numVaults := len(s.Vaults)
-	// By default this division will do the equivalent of math.Floor()
-	numForMajority := (numVaults / 2) + 1
+	// The vault list may change at runtime, in which case the threshold changes with it. The count
+	// must be judged against the vaults the call went out to, which the caller took from the list
+	// once, rather than against the list as it is now: otherwise two acks from five vaults would
+	// make a majority if the list had meanwhile shrunk to three. Quarantined vaults count, as
+	// vaults which did not answer.
+	assert.Always(numVaults > 0, "Control service: there are vaults known to the service", nil)
+	numForMajority := majorityOf(numVaults)
 	haveEnoughVaults := (count >= numForMajority)
 	// We expect both conditions below to be sometimes true
 	assert.Sometimes(haveEnoughVaults, "Control service: there is a majority of vaults", Details{"count": count, "majorityNeeded": numForMajority})
@@ -339,17 +1114,360 @@ func (s *ControlServer) hasMajority(count int) bool {
 	return haveEnoughVaults
 }
 
-func main() {
-	fmt.Print("Control Server booting...\n")
-	assert.Always(true, "Control service: service started", nil)
-	portPtr := flag.Int("port", 8000, "Port on which to listen for requests")
+// Run the control server with the given flags or, if check is set, only check them and the
+// configuration they point to, as far as we can without serving: everything serve would refuse to
+// start with, short of binding its ports. name is how we were run, for the usage message.
+func runServer(name string, args []string, check bool) {
+	if !check {
+		fmt.Print("Control Server booting...\n")
+		assert.Always(true, "Control service: service started", nil)
+	}
+	portPtr := flag.Int("port", 8000, "Deprecated: use -listen=:<port>")
+	listenPtr := flag.String("listen", ":8000", "Address on which to listen, e.g. localhost:8000, [::1]:8000, unix:///tmp/control.sock for a Unix socket, or systemd: for a socket passed by systemd socket activation (systemd:<name> for one named with FileDescriptorName=)")
 	vaultsPtr := flag.String("vaults", "", "Comma-separated list of vaults")
-	flag.Parse()
-	s := NewControlServer(*vaultsPtr)
-	lifecycle.SetupComplete(Details{"port": *portPtr, "vaults": *vaultsPtr})
+	valueTypePtr := flag.String("value-type", string(valueTypeInt), "Type of value stored in the vaults: int or blob")
+	consistencyPtr := flag.String("consistency", string(consistencyQuorum), "Default read consistency: one, quorum or all")
+	corsOriginsPtr := flag.String("cors-origins", "", "Comma-separated list of origins allowed to make cross-origin requests, or * for any (CORS is disabled if empty)")
+	corsMethodsPtr := flag.String("cors-methods", "GET,HEAD,POST", "Comma-separated list of methods allowed in cross-origin requests")
+	corsHeadersPtr := flag.String("cors-headers", "Content-Type,Accept,If-Match,If-None-Match,Idempotency-Key,X-Value-TTL,X-Request-Timeout,X-Request-ID", "Comma-separated list of headers allowed in cross-origin requests")
+	adminTokenPtr := flag.String("admin-token", "", "Bearer token required by the admin API (the admin API is disabled if empty)")
+	vaultTokenPtr := flag.String("vault-token", "", "Shared secret presented to the vaults as a bearer token, which they require of writes, and which exempts our calls from their -rate-limit")
+	tlsCertPtr := flag.String("tls-cert", "", "Certificate file with which to serve HTTPS, reloaded when it changes or on SIGHUP (plain HTTP if empty)")
+	tlsKeyPtr := flag.String("tls-key", "", "Private key file for -tls-cert")
+	acmeHostPtr := flag.String("acme-host", "", "Comma-separated hostnames to serve HTTPS for with certificates obtained automatically from Let's Encrypt, which must reach us on port 443 of each (none if empty)")
+	acmeCachePtr := flag.String("acme-cache", "", "Directory in which to keep the certificates from -acme-host across restarts (glitch-grid/acme in the user's cache directory if empty)")
+	acmeEmailPtr := flag.String("acme-email", "", "Contact address to register with the ACME certificate authority, told of problems with our certificates (none if empty)")
+	acmeDirectoryPtr := flag.String("acme-directory", "", "Directory URL of the ACME certificate authority to use instead of Let's Encrypt, e.g. its staging environment")
+	vaultCAPtr := flag.String("vault-ca", "", "PEM file of extra certificate authorities to trust for https:// vaults")
+	retriesPtr := flag.Int("vault-retries", 3, "How many times to try a call to a vault which fails transiently, in all")
+	retryDelayPtr := flag.Duration("vault-retry-delay", 50*time.Millisecond, "How long to wait before retrying a failed call to a vault, doubling for each further retry")
+	retryMaxDelayPtr := flag.Duration("vault-retry-max-delay", 500*time.Millisecond, "The longest to wait between retries of a call to a vault")
+	retryJitterPtr := flag.Float64("vault-retry-jitter", 0.2, "How far to randomly stretch or shrink each retry delay, as a fraction of it (0 to 1)")
+	fanoutStaggerPtr := flag.Duration("fanout-stagger", 0, "Up to how long to delay each call of a fan-out to the vaults, at random (none if 0)")
+	h2cPtr := flag.Bool("vault-h2c", false, "Call plain HTTP vaults over HTTP/2 without TLS (h2c), multiplexing concurrent calls over one connection per vault")
+	proxyPtr := flag.String("vault-proxy", "", "URL of a proxy through which to call the vaults over HTTP (HTTP_PROXY, HTTPS_PROXY and NO_PROXY apply if empty)")
+	vaultTimeoutPtr := flag.Duration("vault-timeout", time.Second, "How long to wait for a vault to answer a single call")
+	readTimeoutPtr := flag.Duration("vault-read-timeout", 0, "How long to wait for a vault to answer a read (the vault timeout if 0)")
+	writeTimeoutPtr := flag.Duration("vault-write-timeout", 0, "How long to wait for a vault to answer a write (the vault timeout if 0)")
+	dialTimeoutPtr := flag.Duration("vault-dial-timeout", time.Second, "How long to wait to connect to a vault")
+	requestDeadlinePtr := flag.Duration("request-deadline", 0, "How long a client may wait for an answer before we give up with a 503 (no limit if 0)")
+	hedgeDelayPtr := flag.Duration("hedge-delay", 0, "How long to wait for a vault to answer a read before sending it a duplicate, e.g. the p95 read latency (no hedging if 0)")
+	breakerFailuresPtr := flag.Int("breaker-failures", 5, "How many consecutive failed calls to a vault open its circuit, so that we stop calling it (never if 0)")
+	breakerCooldownPtr := flag.Duration("breaker-cooldown", 5*time.Second, "How long a vault's circuit stays open before we probe it again")
+	repairAttemptsPtr := flag.Int("repair-attempts", 5, "How many times to resend a committed write to each vault which missed it (never if 0)")
+	repairDelayPtr := flag.Duration("repair-delay", time.Second, "How long to wait before resending a committed write to a vault which missed it, doubling for each further attempt")
+	repairMaxDelayPtr := flag.Duration("repair-max-delay", 30*time.Second, "The longest to wait between attempts to resend a committed write")
+	maxVaultCallsPtr := flag.Int("max-vault-calls", 256, "How many calls to the vaults may be outstanding at once, across all client requests (no limit if 0)")
+	maxWritesPtr := flag.Int("max-writes", 0, "How many client writes may be in flight at once; any more are answered with a 429 (no limit if 0)")
+	discoveryIntervalPtr := flag.Duration("discovery-interval", 30*time.Second, "With -vaults=srv:<name>, how often to look the SRV record up again, updating the vaults to match; with a Consul service, etcd prefix or Kubernetes service, which are watched, how long to wait after a failed lookup (never look again if 0)")
+	resolveIntervalPtr := flag.Duration("resolve-interval", 30*time.Second, "How often to re-resolve the vaults' hostnames, reconnecting to any which have moved (never if 0)")
+	healthIntervalPtr := flag.Duration("health-interval", 5*time.Second, "How often to check the health of the vaults, skipping any which are down (never if 0)")
+	quarantineStrikesPtr := flag.Int("quarantine-strikes", 3, "How many failed health checks or corrupt reads within the quarantine window take a vault out of quorum (never if 0)")
+	quarantineWindowPtr := flag.Duration("quarantine-window", time.Minute, "The window within which strikes against a vault are counted")
+	quarantineProbationPtr := flag.Duration("quarantine-probation", 30*time.Second, "How long a quarantined vault must pass every health check before it is restored")
+	shutdownTimeoutPtr := flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for in-flight requests to finish when shutting down")
+	standbyOfPtr := flag.String("standby-of", "", "Address of the primary control server to stand by for, taking over its writes when its lease expires (needs -lease-duration and -admin-token)")
+	leaseDurationPtr := flag.Duration("lease-duration", 0, "How long a primary with a standby keeps accepting writes without hearing from it, and how long the standby waits before taking over (no failover if 0)")
+	reloadFilePtr := flag.String("reload-file", "", "File of vaults=, vault-timeout=, vault-read-timeout=, vault-write-timeout=, consistency= and quarantine-* settings, one per line, which override the flags and are reloaded on SIGHUP (none if empty)")
+	summaryIntervalPtr := flag.Duration("summary-interval", 0, "How often to log one line summing up the vaults' health and agreement, e.g. 10s (never if 0)")
+	slowRequestPtr := flag.Duration("slow-request", 0, "Log a breakdown, by vault, of any request which takes longer than this, e.g. 500ms (never if 0)")
+	warmUpPtr := flag.Bool("warm-up", true, "Whether to probe every vault at startup, opening connections to them and reporting any which do not answer")
+	adminListenPtr := flag.String("admin-listen", "", "Address on which to serve profiles under /debug/pprof/, the metrics and the admin API, apart from the data port, e.g. localhost:6060 (none if empty)")
+	adminExclusivePtr := flag.Bool("admin-exclusive", false, "Serve the metrics and the admin API only on -admin-listen, and not on the data port")
+	accessLogPtr := flag.String("access-log", "", "Where to log every request: - for stdout, or a file to append to (no access log if empty)")
+	traceEndpointPtr := flag.String("trace-endpoint", "", "URL of an OpenTelemetry collector to send traces to over OTLP/HTTP, e.g. http://localhost:4318 (no tracing if empty)")
+	traceSampleRatioPtr := flag.Float64("trace-sample-ratio", 1, "Fraction of the traces we start which are sent to the collector, from 0 to 1; traces clients start follow their sampling decision")
+	traceErrorsPtr := flag.Bool("trace-errors", true, "Whether to send the trace of every failed request, such as a read or write without a quorum, even if it was not sampled")
+	auditLogPtr := flag.String("audit-log", "", "File to which every committed write is appended and synced, as a line of JSON (no audit log if empty)")
+	auditLogMaxSizePtr := flag.Int64("audit-log-max-size", 100<<20, "Size in bytes at which the audit log is rotated (never if 0)")
+	auditLogBackupsPtr := flag.Int("audit-log-backups", 5, "How many rotated audit logs to keep")
+	metricsSinkPtr := flag.String("metrics-sink", "prometheus", "Where metrics go: prometheus, served on /metrics, or statsd://host:port or dogstatsd://host:port, sent over UDP")
+	webhookPtr := flag.String("webhook-url", "", "URL to POST a JSON event to when the vaults lose consensus, and when they regain it (none if empty)")
+	panicHookPtr := flag.String("panic-hook-url", "", "URL to POST a JSON report, with the stack, to when a handler panics, e.g. an error tracker's webhook (none if empty)")
+	logFormatPtr := flag.String("log-format", logFormatText, "How to write logs: text, glog's usual format, or json, one object per line on stderr")
+	namePtr := flag.String("name", "", "Name by which the vaults attribute our writes (the hostname and port if empty)")
+	versionPtr := flag.Bool("version", false, "Print what this binary was built from, and exit")
+	configPtr := flag.String("config", "", "YAML or TOML file of flag settings, e.g. vault-timeout: 2s, which flags given on the command line or in GLITCHGRID_* environment variables override (none if empty)")
+	flag.Usage = func() { usage(name) }
+	flag.CommandLine.Parse(args)
+	if *versionPtr {
+		printVersion()
+		os.Exit(0)
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if err := flagconfig.ApplyEnv(flag.CommandLine, set); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if *configPtr != "" {
+		if err := flagconfig.ApplyFile(*configPtr, flag.CommandLine, set); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+	flushLogs := glog.Flush
+	switch *logFormatPtr {
+	case logFormatText:
+	case logFormatJSON:
+		var err error
+		if flushLogs, err = setupJSONLogging(); err != nil {
+			fmt.Printf("could not set up JSON logging: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Printf("invalid log format %q: must be text or json\n", *logFormatPtr)
+		os.Exit(1)
+	}
+	config := ControlConfig{
+		Vaults:     *vaultsPtr,
+		AdminToken: *adminTokenPtr,
+		VaultToken: *vaultTokenPtr,
+		CORS: corsConfig{
+			Origins: splitList(*corsOriginsPtr),
+			Methods: splitList(*corsMethodsPtr),
+			Headers: splitList(*corsHeadersPtr),
+		},
+	}
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	addr := *listenPtr
+	if given["port"] && !given["listen"] {
+		// The deprecated -port listens on every interface, as it always has.
+		addr = fmt.Sprintf(":%d", *portPtr)
+	}
+	port, err := listen.Port(addr)
+	if err != nil {
+		fmt.Printf("invalid listen address %q: %v\n", addr, err)
+		os.Exit(1)
+	}
+	source, discovered, err := parseVaultSource(config.Vaults)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if discovered {
+		if *reloadFilePtr != "" {
+			fmt.Printf("discovered vaults cannot also be given in -reload-file\n")
+			os.Exit(1)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		vaults, err := source.lookup(ctx)
+		cancel()
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		config.Vaults = strings.Join(vaults, ",")
+		config.Discovery, config.DiscoveryInterval = source, *discoveryIntervalPtr
+	}
+	for _, vault := range strings.Split(config.Vaults, ",") {
+		if err := validVaultAddress(vault); err != nil {
+			fmt.Printf("invalid vault address %q: %v\n", vault, err)
+			os.Exit(1)
+		}
+	}
+	if config.ValueType, err = parseValueType(*valueTypePtr); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if config.Consistency, err = parseConsistency(*consistencyPtr); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	config.Name = *namePtr
+	config.VaultTimeout = *vaultTimeoutPtr
+	config.ReadTimeout = *readTimeoutPtr
+	config.WriteTimeout = *writeTimeoutPtr
+	config.DialTimeout = *dialTimeoutPtr
+	config.H2C = *h2cPtr
+	if *proxyPtr != "" {
+		if config.Proxy, err = url.Parse(*proxyPtr); err != nil || config.Proxy.Host == "" {
+			fmt.Printf("invalid proxy URL %q\n", *proxyPtr)
+			os.Exit(1)
+		}
+		if config.H2C {
+			fmt.Printf("-vault-h2c cannot be used with -vault-proxy\n")
+			os.Exit(1)
+		}
+	}
+	config.RequestDeadline = *requestDeadlinePtr
+	config.HedgeDelay = *hedgeDelayPtr
+	config.SlowRequest = *slowRequestPtr
+	config.SummaryInterval = *summaryIntervalPtr
+	config.ReloadFile = *reloadFilePtr
+	config.MaxVaultCalls = *maxVaultCallsPtr
+	config.FanoutStagger = *fanoutStaggerPtr
+	config.MaxWrites = *maxWritesPtr
+	config.ResolveInterval = *resolveIntervalPtr
+	config.HealthInterval = *healthIntervalPtr
+	config.WarmUp = *warmUpPtr
+	if *webhookPtr != "" {
+		if u, err := url.Parse(*webhookPtr); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Printf("invalid webhook URL %q\n", *webhookPtr)
+			os.Exit(1)
+		}
+		config.WebhookURL = *webhookPtr
+	}
+	if *panicHookPtr != "" {
+		if u, err := url.Parse(*panicHookPtr); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Printf("invalid panic hook URL %q\n", *panicHookPtr)
+			os.Exit(1)
+		}
+		config.PanicHookURL = *panicHookPtr
+	}
+	config.Primary = *standbyOfPtr
+	config.LeaseDuration = *leaseDurationPtr
+	if *adminExclusivePtr && *adminListenPtr == "" {
+		fmt.Printf("-admin-exclusive needs an -admin-listen for the admin API to be served on\n")
+		os.Exit(1)
+	}
+	config.AdminExclusive = *adminExclusivePtr
+	if config.LeaseDuration < 0 || (config.Primary != "" && (config.LeaseDuration == 0 || config.AdminToken == "")) {
+		fmt.Printf("invalid failover settings: a standby needs a positive -lease-duration and an -admin-token, shared with its primary\n")
+		os.Exit(1)
+	}
+	config.Quarantine = quarantinePolicy{Strikes: *quarantineStrikesPtr, Window: *quarantineWindowPtr, Probation: *quarantineProbationPtr}
+	if config.Quarantine.Strikes < 0 || config.Quarantine.Window <= 0 || config.Quarantine.Probation < 0 {
+		fmt.Printf("invalid quarantine policy: strikes must not be negative, the window must be positive and the probation not negative\n")
+		os.Exit(1)
+	}
+	if config.MaxVaultCalls < 0 || config.MaxWrites < 0 || config.FanoutStagger < 0 {
+		fmt.Printf("invalid limits: the limits on calls to the vaults and writes in flight, and the fan-out stagger, must not be negative\n")
+		os.Exit(1)
+	}
+	if config.VaultTimeout <= 0 || config.DialTimeout <= 0 || config.ReadTimeout < 0 || config.WriteTimeout < 0 || config.RequestDeadline < 0 || config.HedgeDelay < 0 || config.SlowRequest < 0 || config.SummaryInterval < 0 {
+		fmt.Printf("invalid timeouts: the vault and dial timeouts must be positive, and the read and write timeouts, request deadline, hedge delay, slow request threshold and summary interval not negative\n")
+		os.Exit(1)
+	}
+	config.Breaker = breakerPolicy{Failures: *breakerFailuresPtr, Cooldown: *breakerCooldownPtr}
+	config.Retry = retryPolicy{Attempts: *retriesPtr, BaseDelay: *retryDelayPtr, MaxDelay: *retryMaxDelayPtr, Jitter: *retryJitterPtr}
+	if config.Retry.Attempts < 1 || config.Retry.BaseDelay < 0 || config.Retry.MaxDelay < config.Retry.BaseDelay || config.Retry.Jitter < 0 || config.Retry.Jitter > 1 {
+		fmt.Printf("invalid retry policy: attempts must be positive, delays ordered and non-negative, and jitter between 0 and 1\n")
+		os.Exit(1)
+	}
+	config.Repair = repairPolicy{Attempts: *repairAttemptsPtr, BaseDelay: *repairDelayPtr, MaxDelay: *repairMaxDelayPtr}
+	if config.Repair.Attempts < 0 || config.Repair.BaseDelay < 0 || config.Repair.MaxDelay < config.Repair.BaseDelay {
+		fmt.Printf("invalid repair policy: attempts must not be negative, and delays ordered and non-negative\n")
+		os.Exit(1)
+	}
+	if config.Name == "" {
+		host, _ := os.Hostname()
+		config.Name = net.JoinHostPort(host, strconv.Itoa(port))
+		if port == 0 {
+			config.Name = host + ":" + strings.TrimPrefix(addr, unixScheme)
+		}
+	}
+	if *vaultCAPtr != "" {
+		if config.VaultCAs, err = tlsutil.LoadCAs(*vaultCAPtr); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+	if (*tlsCertPtr == "") != (*tlsKeyPtr == "") {
+		fmt.Printf("-tls-cert and -tls-key must be given together\n")
+		os.Exit(1)
+	}
+	if *tlsCertPtr != "" {
+		if config.Certs, err = newCertReloader(*tlsCertPtr, *tlsKeyPtr); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *acmeHostPtr == "" && (*acmeCachePtr != "" || *acmeEmailPtr != "" || *acmeDirectoryPtr != "") {
+		fmt.Printf("-acme-cache, -acme-email and -acme-directory need an -acme-host\n")
+		os.Exit(1)
+	}
+	if *acmeHostPtr != "" {
+		if *tlsCertPtr != "" {
+			fmt.Printf("-acme-host cannot be used with -tls-cert: the certificates come from one or the other\n")
+			os.Exit(1)
+		}
+		if config.ACME, err = newACMEManager(*acmeHostPtr, *acmeCachePtr, *acmeEmailPtr, *acmeDirectoryPtr); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+	if config.AccessLog, err = logging.OpenAccessLog(*accessLogPtr); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if *metricsSinkPtr != "prometheus" {
+		sink, err := url.Parse(*metricsSinkPtr)
+		if err != nil || (sink.Scheme != "statsd" && sink.Scheme != "dogstatsd") || sink.Host == "" {
+			fmt.Printf("invalid metrics sink %q: must be prometheus, statsd://host:port or dogstatsd://host:port\n", *metricsSinkPtr)
+			os.Exit(1)
+		}
+		if config.Statsd, err = newStatsdSink(sink); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *auditLogPtr != "" {
+		if *auditLogMaxSizePtr < 0 || *auditLogBackupsPtr < 0 {
+			fmt.Printf("invalid audit log settings: the maximum size and number of backups must not be negative\n")
+			os.Exit(1)
+		}
+		if config.AuditLog, err = openAuditLog(*auditLogPtr, *auditLogMaxSizePtr, *auditLogBackupsPtr); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+	flushTraces := func(context.Context) error { return nil }
+	if *traceEndpointPtr != "" {
+		if *traceSampleRatioPtr < 0 || *traceSampleRatioPtr > 1 {
+			fmt.Printf("invalid trace sample ratio %v: must be from 0 to 1\n", *traceSampleRatioPtr)
+			os.Exit(1)
+		}
+		sampling := traceSampling{Ratio: *traceSampleRatioPtr, Errors: *traceErrorsPtr}
+		if flushTraces, err = setupTracing(*traceEndpointPtr, config.Name, sampling); err != nil {
+			fmt.Printf("could not set up tracing: %v\n", err)
+			os.Exit(1)
+		}
+		config.Tracing = true
+	}
+	if config.ReloadFile != "" {
+		if _, err := loadReloadFile(config); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+	if check {
+		fmt.Printf("Configuration OK: %d vaults, listening on %s\n", len(splitVaults(config.Vaults)), addr)
+		return
+	}
+	s := NewControlServer(config)
+	lifecycle.SetupComplete(Details{"listen": addr, "vaults": *vaultsPtr})
 	assert.Always(true, "Control service: setup complete", nil)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", *portPtr), s.mux)
-	if errors.Is(err, http.ErrServerClosed) {
+	if *adminListenPtr != "" {
+		if err := serveAdminPort(*adminListenPtr, s.adminHandler); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+	l, err := listen.On(addr)
+	if err != nil {
+		assert.Unreachable("Control service: did not start", Details{"error": err})
+		fmt.Printf("error starting server: %s\n", err)
+		os.Exit(1)
+	}
+	srv := &http.Server{Handler: s.handler}
+	if s.certs != nil {
+		srv.TLSConfig = &tls.Config{GetCertificate: s.certs.getCertificate}
+		go s.certs.watch(certPollInterval, s.stopping)
+	} else if s.acme != nil {
+		srv.TLSConfig = s.acme.TLSConfig()
+	}
+	err = s.serveUntilSignalled(srv, l, *shutdownTimeoutPtr)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutPtr)
+	if err := flushTraces(ctx); err != nil {
+		glog.Warningf("Could not send the last traces: %v", err)
+	}
+	cancel()
+	flushLogs()
+	if err == nil {
+		fmt.Printf("server shut down\n")
+	} else if errors.Is(err, http.ErrServerClosed) {
 		assert.Unreachable("Control service: closed unexpectedly", Details{"error": err})
 		fmt.Printf("server closed\n")
 	} else if err != nil {
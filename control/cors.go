@@ -0,0 +1,68 @@
+package control
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Which cross-origin requests browsers should allow against the control server.
+// CORS is disabled unless at least one origin is allowed.
+type corsConfig struct {
+	// Allowed origins, or "*" for any origin.
+	Origins []string
+	Methods []string
+	Headers []string
+}
+
+// Response headers which browser clients may read, beyond the CORS-safelisted ones.
+var corsExposedHeaders = []string{"ETag", "X-Counter-Value", "X-Counter-Version", "X-Vaults-Agreeing", "X-Request-ID", "X-Error-Code"}
+
+// Split a comma-separated flag value into its non-empty, trimmed elements.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Whether cross-origin requests from this origin are allowed.
+func (c corsConfig) allows(origin string) bool {
+	for _, allowed := range c.Origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap a handler with CORS support, so that a browser-based dashboard can call the control
+// server directly. Answers preflight requests itself, and decorates all other responses to
+// allowed origins with the appropriate headers.
+func (c corsConfig) wrap(next http.Handler) http.Handler {
+	if len(c.Origins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !c.allows(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			// A preflight request.
+			h.Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ", "))
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.Headers, ", "))
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,104 @@
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How often the dashboard reloads itself, unless ?refresh=N asks otherwise.
+const dashboardRefresh = 2 * time.Second
+
+// The dashboard: a page with the consensus value and a row for each vault, which reloads itself
+// so that glitches can be watched as they happen. It needs no scripts or assets of its own.
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"value": func(v json.RawMessage) string {
+		if v == nil {
+			return "–"
+		}
+		return string(v)
+	},
+	"ago": func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return time.Since(*t).Round(time.Millisecond).String() + " ago"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>glitch-grid</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+.ok { background: #dfd; }
+.bad { background: #fdd; }
+.warn { background: #ffd; }
+</style>
+</head>
+<body>
+<h1>glitch-grid</h1>
+{{with .Status}}
+<p class="{{if ge .QuorumMargin 0}}ok{{else}}bad{{end}}">
+Consensus value: <b>{{value .ConsensusValue}}</b>{{if .Expired}} (expired){{end}},
+version {{.Version}}: {{.Agreeing}} vaults agree, {{.MajorityNeeded}} needed.
+{{if ge .QuorumMargin 0}}Quorum margin {{.QuorumMargin}}.{{else}}No consensus.{{end}}
+Role: {{.Role}}.
+</p>
+<table>
+<tr><th>Vault</th><th>Last value</th><th>Last seen</th><th>Health</th><th>Circuit</th><th>Last error</th></tr>
+{{range .Vaults}}
+<tr class="{{if or (not .Reachable) .Corrupted .QuarantinedSince}}bad{{else if ne .Circuit "closed"}}warn{{else}}ok{{end}}">
+<td>{{.Address}}</td>
+<td>{{value .LastValue}}{{if .Corrupted}} (corrupt){{end}}</td>
+<td>{{ago .LastSeen}}</td>
+<td>{{with .Health}}{{if .Healthy}}healthy{{else}}down{{end}}{{else}}unchecked{{end}}{{if .QuarantinedSince}}, quarantined{{end}}</td>
+<td>{{.Circuit}}</td>
+<td>{{.LastError}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+<p>Updated {{.Now.Format "15:04:05.000"}}; every {{.Refresh}}s.</p>
+</body>
+</html>
+`))
+
+// Serve the dashboard: the same poll of the vaults as the status endpoint, as a page for people
+// rather than JSON. ?refresh=N reloads it every N seconds instead of every two.
+func (s *ControlServer) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	refresh := int(dashboardRefresh / time.Second)
+	if raw := r.URL.Query().Get("refresh"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			writeProblem(w, http.StatusBadRequest, codeBadParameter, "refresh must be a positive number of seconds", Details{"refresh": raw})
+			return
+		}
+		refresh = n
+	}
+	var page bytes.Buffer
+	err := dashboardTemplate.Execute(&page, struct {
+		Status  clusterStatus
+		Refresh int
+		Now     time.Time
+	}{s.currentStatus(r.Context()), refresh, time.Now()})
+	if err != nil {
+		logf(r.Context(), logError, "Could not render the dashboard: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(page.Bytes())
+}
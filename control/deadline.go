@@ -0,0 +1,108 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A response which is held back until the handler finishes, so that it can be discarded if the
+// handler takes too long.
+type bufferedResponse struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(statusCode int) {
+	if b.statusCode == 0 {
+		b.statusCode = statusCode
+	}
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(data)
+}
+
+// The header in which a client may give its own deadline for a request, as a duration (e.g.
+// "250ms"). It may shorten the server's deadline, but not lengthen it.
+const timeoutHeader = "X-Request-Timeout"
+
+// The context key under which a write's deadline is kept.
+type writeDeadlineKey struct{}
+
+// Return the deadline by which a write should have been answered, if it has one.
+func writeDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Value(writeDeadlineKey{}).(time.Time)
+	return deadline, ok
+}
+
+// Wrap a handler so that a client never waits longer than the deadline for an answer to a read:
+// if the handler has not finished by then, the client gets a 503 instead, and the handler's
+// request context is cancelled, which cuts short the calls to the vaults. Writes are not cut
+// short, since cancelling one partway through its fan-out could leave it applied on some vaults
+// and not others; instead the deadline is left for the handler to find with writeDeadline, so that
+// it can refuse to start a fan-out there is no time left for, and the client always gets the
+// write's real outcome. A deadline of zero leaves the handler alone, unless the client sets one of
+// its own.
+func withDeadline(serverDeadline time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline := serverDeadline
+		if h := r.Header.Get(timeoutHeader); h != "" {
+			d, err := time.ParseDuration(h)
+			if err != nil || d <= 0 {
+				writeProblem(w, http.StatusBadRequest, codeBadParameter, "Invalid "+timeoutHeader, nil)
+				return
+			}
+			if deadline <= 0 || d < deadline {
+				deadline = d
+			}
+		}
+		if deadline <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			ctx := context.WithValue(r.Context(), writeDeadlineKey{}, time.Now().Add(deadline))
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), deadline)
+		defer cancel()
+		resp := &bufferedResponse{header: make(http.Header)}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			next.ServeHTTP(resp, r.WithContext(ctx))
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			// The handler may have finished just as the deadline passed, in which case its answer
+			// still stands.
+			select {
+			case <-done:
+			default:
+				logf(r.Context(), logWarning, "%s %s did not finish within the %v deadline", r.Method, r.URL.Path, deadline)
+				writeProblem(w, http.StatusServiceUnavailable, codeDeadlineExceeded,
+					fmt.Sprintf("The request did not finish within %v", deadline), nil)
+				return
+			}
+		}
+		for key, values := range resp.header {
+			w.Header()[key] = values
+		}
+		if resp.statusCode == 0 {
+			resp.statusCode = http.StatusOK
+		}
+		w.WriteHeader(resp.statusCode)
+		w.Write(resp.body.Bytes())
+	})
+}
@@ -0,0 +1,157 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The prefix of a -vaults value which names a DNS SRV record to discover the vaults from, e.g.
+// srv:_vault._tcp.grid.local. A scheme after it, as in srv:grpc://_vault._tcp.grid.local, is
+// given to every vault discovered.
+const srvPrefix = "srv:"
+
+// How long a lookup in a source which watches waits for the vaults registered in it to change.
+const discoveryWait = 5 * time.Minute
+
+// Somewhere the vaults are discovered from, when -vaults names one rather than listing them. Its
+// lookups are only made one at a time.
+type vaultSource interface {
+	// Return the vaults registered now. A source which watches first waits for them to change
+	// since the previous lookup, for up to discoveryWait; the first lookup returns straight away.
+	lookup(ctx context.Context) ([]string, error)
+	// Whether lookup waits for a change, and so may be called again as soon as it returns.
+	watches() bool
+	// The source, for the log and the membership events, e.g. "SRV record _vault._tcp.grid.local".
+	String() string
+}
+
+// Return the source to discover the vaults from, if -vaults names one: a file, an SRV record, a
+// Consul service, an etcd prefix or a Kubernetes service.
+func parseVaultSource(vaults string) (vaultSource, bool, error) {
+	if path, ok := strings.CutPrefix(vaults, vaultFilePrefix); ok {
+		if path == "" {
+			return nil, true, fmt.Errorf("invalid vaults %q: %s must be followed by a file", vaults, vaultFilePrefix)
+		}
+		return &fileSource{path: path}, true, nil
+	}
+	if name, ok := strings.CutPrefix(vaults, srvPrefix); ok {
+		for _, scheme := range []string{grpcScheme, httpsScheme} {
+			if rest, found := strings.CutPrefix(name, scheme); found {
+				return &srvSource{name: rest, scheme: scheme}, true, nil
+			}
+		}
+		return &srvSource{name: name}, true, nil
+	}
+	if strings.HasPrefix(vaults, consulScheme) {
+		source, err := newConsulSource(vaults)
+		return source, true, err
+	}
+	if strings.HasPrefix(vaults, etcdScheme) {
+		source, err := newEtcdSource(vaults)
+		return source, true, err
+	}
+	if strings.HasPrefix(vaults, k8sScheme) {
+		source, err := newK8sSource(vaults)
+		return source, true, err
+	}
+	return nil, false, nil
+}
+
+// An SRV record to discover the vaults from, and the scheme to give them.
+type srvSource struct {
+	name   string
+	scheme string
+}
+
+func (src *srvSource) watches() bool { return false }
+
+func (src *srvSource) String() string { return "SRV record " + src.name }
+
+// Look up the vaults in the SRV record: one per target. Priorities and weights are ignored, since
+// every vault is a member of the quorum.
+func (src *srvSource) lookup(ctx context.Context) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", src.name)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up vaults in %s: %w", src.name, err)
+	}
+	vaults := make([]string, len(records))
+	for i, record := range records {
+		vaults[i] = src.scheme + net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+	}
+	return discoveredVaults(vaults, src.name)
+}
+
+// Check the vaults found in a source, dropping any duplicates and sorting them so that the order
+// does not change from one lookup to the next. Finding none is an error.
+func discoveredVaults(found []string, source string) ([]string, error) {
+	seen := make(map[string]bool, len(found))
+	var vaults []string
+	for _, vault := range found {
+		if seen[vault] {
+			continue
+		}
+		if err := validVaultAddress(vault); err != nil {
+			return nil, fmt.Errorf("invalid vault %q in %s: %v", vault, source, err)
+		}
+		seen[vault] = true
+		vaults = append(vaults, vault)
+	}
+	if len(vaults) == 0 {
+		return nil, fmt.Errorf("no vaults in %s", source)
+	}
+	sort.Strings(vaults)
+	return vaults, nil
+}
+
+// Keep looking the vaults up in the source, and make the vaults it lists the live set. A source
+// which watches is asked again as soon as it answers; any other, every interval. A lookup which
+// fails, or finds no vaults, leaves the set as it was, so that an outage of the source does not
+// empty the grid, and the next waits for the interval.
+func (s *ControlServer) discoverEvery(source vaultSource, interval time.Duration) {
+	wait := !source.watches()
+	for {
+		if wait {
+			select {
+			case <-s.stopping:
+				return
+			case <-time.After(interval):
+			}
+		}
+		timeout := s.settings().vaultTimeout
+		if source.watches() {
+			timeout = discoveryWait + time.Minute
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		go func() {
+			select {
+			case <-s.stopping:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		vaults, err := source.lookup(ctx)
+		cancel()
+		select {
+		case <-s.stopping:
+			return
+		default:
+		}
+		if err != nil {
+			glog.Warningf("Keeping the %d vaults we have: %v", len(s.vaultList()), err)
+			wait = true
+			continue
+		}
+		wait = !source.watches()
+		added, removed := s.replaceVaults(vaults, source.String())
+		if len(added) > 0 || len(removed) > 0 {
+			glog.Infof("Discovered vaults in %s: added %v, removed %v; now have %d", source, added, removed, len(vaults))
+		}
+	}
+}
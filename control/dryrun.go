@@ -0,0 +1,56 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Whether the client asked for a write to be validated but not committed.
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	return dryRun
+}
+
+// Count how many vaults we can currently read from, contacting them all in parallel.
+func (s *ControlServer) probeVaults(ctx context.Context) int {
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	reachable := 0
+	_, vaults := s.quorumVaults()
+	for _, vault := range vaults {
+		wg.Add(1)
+		go func(vault string) {
+			defer wg.Done()
+			value, err := s.fetchValueFromVault(ctx, vault, valueKey)
+			s.recordVaultRead(vault, value, err)
+			if err == nil || errors.Is(err, errValueExpired) {
+				m.Lock()
+				reachable++
+				m.Unlock()
+			}
+		}(vault)
+	}
+	wg.Wait()
+	return reachable
+}
+
+// Tell the client what would happen if they made this write for real: a 200 if enough vaults
+// are reachable for it to commit, 500 otherwise. The write has already been validated.
+func (s *ControlServer) dryRunWrite(w http.ResponseWriter, r *http.Request) {
+	reachable := s.probeVaults(r.Context())
+	numVaults := len(s.vaultList())
+	statusCode := http.StatusInternalServerError
+	if reachable >= majorityOf(numVaults) {
+		statusCode = http.StatusOK
+	}
+	s.lock.RLock()
+	version := s.version + 1
+	s.lock.RUnlock()
+	writeNegotiated(w, r, statusCode,
+		&WriteResult{Acks: int32(reachable), NumVaults: int32(numVaults), Version: int64(version)},
+		fmt.Sprintf("Dry run: would send updates to %d/%d reachable vaults", reachable, numVaults))
+}
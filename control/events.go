@@ -0,0 +1,83 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The maximum number of membership events we remember.
+const maxEvents = 1000
+
+// The kinds of membership event.
+const (
+	eventVaultAdded       = "vault_added"
+	eventVaultRemoved     = "vault_removed"
+	eventVaultDown        = "vault_down"
+	eventVaultHealthy     = "vault_healthy"
+	eventVaultQuarantined = "vault_quarantined"
+	eventVaultRestored    = "vault_restored"
+)
+
+// A change to the set of vaults, or to whether one of them is in service.
+type clusterEvent struct {
+	Time  time.Time `json:"time"`
+	Kind  string    `json:"kind"`
+	Vault string    `json:"vault"`
+	// Why it happened, e.g. the health check which failed.
+	Detail string `json:"detail,omitempty"`
+}
+
+// Remember a membership event, discarding the oldest if we are at capacity.
+func (s *ControlServer) recordEvent(kind string, vault string, detail string) {
+	s.eventsLock.Lock()
+	defer s.eventsLock.Unlock()
+	s.events = append(s.events, clusterEvent{Time: time.Now().UTC(), Kind: kind, Vault: vault, Detail: detail})
+	if len(s.events) > maxEvents {
+		s.events = s.events[len(s.events)-maxEvents:]
+	}
+}
+
+// Return the most recent membership events (newest last) as a JSON array, so that how the grid's
+// topology changed during an experiment can be looked at afterwards. Accepts optional `since` (an
+// RFC 3339 time) and `limit` query parameters.
+func (s *ControlServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	limit := maxEvents
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			writeProblem(w, http.StatusBadRequest, codeBadParameter, "Invalid limit", nil)
+			return
+		}
+		limit = n
+	}
+	var since time.Time
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, raw); err != nil {
+			writeProblem(w, http.StatusBadRequest, codeBadParameter, "Invalid since", nil)
+			return
+		}
+	}
+	s.eventsLock.Lock()
+	events := []clusterEvent{}
+	for _, event := range s.events {
+		if event.Time.After(since) {
+			events = append(events, event)
+		}
+	}
+	s.eventsLock.Unlock()
+	if len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		logf(r.Context(), logWarning, "Could not write events response: %v", err)
+	}
+}
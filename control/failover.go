@@ -0,0 +1,192 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+	"github.com/golang/glog"
+)
+
+// The roles a control server may play in a primary/standby pair.
+const (
+	// Accepts writes; this is the only role of a server without a standby.
+	rolePrimary = "primary"
+	// A primary which has not heard from its standby within the lease (or at all, since it
+	// started), or has heard that the standby has taken over, and so refuses writes.
+	roleFenced = "fenced"
+	// Mirrors the primary and refuses writes until the primary's lease expires.
+	roleStandby = "standby"
+	// A standby which has taken over from its primary.
+	rolePromoted = "promoted"
+)
+
+// What a primary tells its standby each time it is polled, so that the standby can carry on
+// where it left off.
+type leaseGrant struct {
+	Holder    string `json:"holder"`
+	MinValue  int    `json:"minValue"`
+	Committed string `json:"committed"`
+	Version   int    `json:"version"`
+	Sequence  int64  `json:"sequence"`
+	// When the committed value expires, if it was written with a TTL.
+	Expires time.Time `json:"expires,omitempty"`
+	// How long the primary keeps accepting writes without hearing from the standby again.
+	LeaseMillis int64 `json:"leaseMillis"`
+}
+
+// The header with which a standby which has taken over tells its old primary so, when it polls.
+const promotedHeader = "X-Standby-Promoted"
+
+// Grant the standby a renewal of our lease, and tell it our state. A primary which has a standby
+// only accepts writes while the standby keeps polling, so the two never both accept writes. A
+// standby which has taken over keeps polling to say so, and from then on we refuse writes, and
+// its lease, until we are restarted (and polled by a standby again).
+func (s *ControlServer) handleLease(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet || s.primary != "" || s.leaseDuration <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	s.haLock.Lock()
+	if holder := r.Header.Get(promotedHeader); holder != "" || s.deposed {
+		if !s.deposed {
+			glog.Warningf("Standby %s has taken over writes; refusing them until we are restarted", holder)
+		}
+		s.deposed = true
+		s.haLock.Unlock()
+		writeProblem(w, http.StatusConflict, codeNotPrimary, "A standby has taken over from this control server", Details{"role": roleFenced})
+		return
+	}
+	if s.lastPolled.IsZero() {
+		glog.Infof("Standby has polled for the first time; accepting writes")
+	} else if time.Since(s.lastPolled) >= s.leaseDuration {
+		glog.Infof("Standby is back after %v; accepting writes again", time.Since(s.lastPolled))
+	}
+	s.lastPolled = time.Now()
+	s.haLock.Unlock()
+	s.lock.RLock()
+	grant := leaseGrant{Holder: s.name, MinValue: s.minValue, Committed: s.committed, Expires: s.committedExpires, Version: s.version, LeaseMillis: s.leaseDuration.Milliseconds()}
+	s.lock.RUnlock()
+	s.sequenceLock.Lock()
+	grant.Sequence = s.sequence
+	s.sequenceLock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(grant)
+}
+
+// Return the role we are playing now.
+func (s *ControlServer) role() string {
+	if s.leaseDuration <= 0 {
+		return rolePrimary
+	}
+	s.haLock.Lock()
+	defer s.haLock.Unlock()
+	switch {
+	case s.primary != "" && s.promoted:
+		return rolePromoted
+	case s.primary != "":
+		return roleStandby
+	case s.deposed || s.lastPolled.IsZero() || time.Since(s.lastPolled) >= s.leaseDuration:
+		// Until our standby first polls, we cannot tell whether it took over before we (re)started.
+		return roleFenced
+	}
+	return rolePrimary
+}
+
+// Refuse a write with a 503 unless we are the control server which accepts writes.
+func (s *ControlServer) allowWrite(w http.ResponseWriter) bool {
+	switch role := s.role(); role {
+	case roleStandby:
+		writeProblem(w, http.StatusServiceUnavailable, codeNotPrimary,
+			fmt.Sprintf("This control server is a standby for %s", s.primary), Details{"role": role, "primary": s.primary})
+		return false
+	case roleFenced:
+		writeProblem(w, http.StatusServiceUnavailable, codeNotPrimary,
+			"This control server's standby has not renewed its lease, or has taken over", Details{"role": role})
+		return false
+	}
+	return true
+}
+
+// Poll the primary for its lease until it lets the lease expire, mirroring its state as we go,
+// then take over from it. We wait a little longer than the lease, which the primary counts from
+// before we hear its answer, so that it has always stopped accepting writes by the time we start.
+// Having taken over, we keep telling the primary so, so that it stays fenced if it comes back.
+func (s *ControlServer) followPrimary() {
+	ticker := time.NewTicker(s.leaseDuration / 3)
+	defer ticker.Stop()
+	lastGrant := time.Now()
+	for range ticker.C {
+		grant, err := s.pollPrimary(false)
+		if err == nil {
+			s.mirror(grant)
+			lastGrant = time.Now()
+			continue
+		}
+		if since := time.Since(lastGrant); since < s.leaseDuration+s.leaseDuration/10 {
+			glog.Warningf("Could not renew the lease of primary %s (%v ago): %v", s.primary, since.Round(time.Millisecond), err)
+			continue
+		}
+		s.haLock.Lock()
+		s.promoted = true
+		s.haLock.Unlock()
+		assert.Sometimes(true, "Control service: standby took over from its primary", Details{"primary": s.primary})
+		glog.Warningf("The lease of primary %s has expired; taking over writes", s.primary)
+		break
+	}
+	for range ticker.C {
+		// The primary refuses us, which keeps it fenced; there is nothing to learn from its answer.
+		s.pollPrimary(true)
+	}
+}
+
+// Ask the primary for a renewal of its lease, or, once we have taken over, tell it that we have.
+func (s *ControlServer) pollPrimary(promoted bool) (leaseGrant, error) {
+	var grant leaseGrant
+	ctx, cancel := context.WithTimeout(context.Background(), s.leaseDuration/3)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, vaultURL(s.primary)+"admin/lease", nil)
+	if err != nil {
+		return grant, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.adminToken)
+	if promoted {
+		req.Header.Set(promotedHeader, s.name)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return grant, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return grant, fmt.Errorf("primary responded with %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&grant)
+	return grant, err
+}
+
+// Catch up with the state of the primary, so that we never go backwards if we take over.
+func (s *ControlServer) mirror(grant leaseGrant) {
+	s.lock.Lock()
+	if grant.MinValue > s.minValue {
+		s.minValue = grant.MinValue
+	}
+	if grant.Version > s.version {
+		s.version = grant.Version
+		s.committed = grant.Committed
+		s.committedExpires = grant.Expires
+	}
+	s.lock.Unlock()
+	s.sequenceLock.Lock()
+	if grant.Sequence > s.sequence {
+		s.sequence = grant.Sequence
+	}
+	s.sequenceLock.Unlock()
+}
@@ -0,0 +1,74 @@
+package control
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Wait for a slot to call a vault, so that a burst of client requests against a long vault list
+// cannot open an unbounded number of connections at once. Returns a function which gives the slot
+// back, or the context's error if it is cancelled first.
+func (s *ControlServer) acquireCall(ctx context.Context) (func(), error) {
+	if s.calls == nil {
+		return func() {}, nil
+	}
+	select {
+	case s.calls <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-s.calls }) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// A response body which gives back its call's slot once it is closed, since the connection is in
+// use until then.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// Send an HTTP request to a vault once there is a slot for it, with the ID of the client request
+// it was made for, if any, and our token.
+func (s *ControlServer) doVault(req *http.Request) (*http.Response, error) {
+	if id := requestIDFrom(req.Context()); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	// Reads carry the token as well as writes, so that a vault does not rate limit us.
+	if s.vaultToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.vaultToken)
+	}
+	release, err := s.acquireCall(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = releasingBody{resp.Body, release}
+	return resp, nil
+}
+
+// Wait a random fraction of the fan-out stagger before calling a vault, so that the calls of a
+// fan-out, and the retries which follow them, are spread out rather than arriving at once.
+func (s *ControlServer) stagger(ctx context.Context) {
+	if s.fanoutStagger <= 0 {
+		return
+	}
+	select {
+	case <-time.After(time.Duration(rand.Int63n(int64(s.fanoutStagger)))):
+	case <-ctx.Done():
+	}
+}
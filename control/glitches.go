@@ -0,0 +1,111 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The maximum number of glitches we remember.
+const maxGlitches = 1000
+
+// A read on which a vault disagreed with the quorum: the glitch the grid exists to tolerate.
+type glitchEvent struct {
+	Time  time.Time `json:"time"`
+	Vault string    `json:"vault"`
+	// What the vault told us, and what the quorum agreed on. Either is null if it was that the
+	// value has expired.
+	Observed  json.RawMessage `json:"observed"`
+	Expected  json.RawMessage `json:"expected"`
+	RequestID string          `json:"requestId,omitempty"`
+}
+
+// Record a glitch for each vault whose answer to a quorum read differs from the consensus.
+// Vaults which did not answer, or which reported a corrupted value, are failures rather than
+// glitches, and are left to the error metrics.
+func (s *ControlServer) detectGlitches(ctx context.Context, consensus vote, reads []vaultRead) {
+	for _, read := range reads {
+		observed := vote{value: read.value}
+		if errors.Is(read.err, errValueExpired) {
+			observed.expired = true
+		} else if read.err != nil {
+			continue
+		}
+		if observed == consensus {
+			continue
+		}
+		glitch := glitchEvent{
+			Time:      time.Now().UTC(),
+			Vault:     read.vault,
+			Observed:  s.voteJSON(observed),
+			Expected:  s.voteJSON(consensus),
+			RequestID: requestIDFrom(ctx),
+		}
+		logEvent(ctx, logWarning, "Glitch detected", logFields{
+			"vault":    read.vault,
+			"observed": string(glitch.Observed),
+			"expected": string(glitch.Expected),
+		})
+		s.metrics.glitch(read.vault)
+		s.glitchesLock.Lock()
+		s.glitches = append(s.glitches, glitch)
+		if len(s.glitches) > maxGlitches {
+			s.glitches = s.glitches[len(s.glitches)-maxGlitches:]
+		}
+		s.glitchesLock.Unlock()
+	}
+}
+
+// Render what a vault voted for as JSON, with null for an expired value.
+func (s *ControlServer) voteJSON(v vote) json.RawMessage {
+	if v.expired {
+		return json.RawMessage("null")
+	}
+	return s.valueType.toJSON(v.value)
+}
+
+// Return the most recent glitches (newest last) as a JSON array. Accepts optional `since` (an
+// RFC 3339 time), `vault` and `limit` query parameters.
+func (s *ControlServer) handleGlitches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	limit := maxGlitches
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			writeProblem(w, http.StatusBadRequest, codeBadParameter, "Invalid limit", nil)
+			return
+		}
+		limit = n
+	}
+	var since time.Time
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, raw); err != nil {
+			writeProblem(w, http.StatusBadRequest, codeBadParameter, "Invalid since", nil)
+			return
+		}
+	}
+	vault := r.URL.Query().Get("vault")
+	s.glitchesLock.Lock()
+	glitches := []glitchEvent{}
+	for _, glitch := range s.glitches {
+		if glitch.Time.After(since) && (vault == "" || glitch.Vault == vault) {
+			glitches = append(glitches, glitch)
+		}
+	}
+	s.glitchesLock.Unlock()
+	if len(glitches) > limit {
+		glitches = glitches[len(glitches)-limit:]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(glitches); err != nil {
+		logf(r.Context(), logWarning, "Could not write glitches response: %v", err)
+	}
+}
@@ -1,7 +0,0 @@
-module antithesis.com/glitch-grid-control
-
-go 1.20
-
-require github.com/golang/glog v1.2.0
-
-require github.com/antithesishq/antithesis-sdk-go v0.3.6
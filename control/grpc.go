@@ -0,0 +1,118 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"antithesis.com/glitch-grid/internal/vaultpb"
+)
+
+// The prefix of a vault address (e.g. "grpc://vault1:9001") which says to talk to the vault over
+// gRPC instead of HTTP.
+const grpcScheme = "grpc://"
+
+// Return the gRPC address of a vault, if it is to be spoken to over gRPC.
+func grpcAddress(vault string) (string, bool) {
+	return strings.CutPrefix(vault, grpcScheme)
+}
+
+// The key under which the vaults hold the grid's value, at their root path; others, such as the
+// self-test's, are kept apart from it.
+const valueKey = ""
+
+// Return a client for the vault at a gRPC address, connecting lazily the first time it is used.
+// Connections are kept for the lifetime of the server, and reconnect by themselves.
+func (s *ControlServer) grpcClient(addr string) (vaultpb.VaultServiceClient, error) {
+	s.grpcLock.Lock()
+	defer s.grpcLock.Unlock()
+	if conn, ok := s.grpcConns[addr]; ok {
+		return vaultpb.NewVaultServiceClient(conn), nil
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if s.tracing {
+		opts = append(opts, grpcTraceOption())
+	}
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.grpcConns[addr] = conn
+	return vaultpb.NewVaultServiceClient(conn), nil
+}
+
+// Fetch the value stored under a key in a single vault over gRPC, with the same errors as over
+// HTTP.
+func (s *ControlServer) fetchValueOverGRPC(ctx context.Context, addr string, key string) (string, error) {
+	client, err := s.grpcClient(addr)
+	if err != nil {
+		return "", err
+	}
+	release, err := s.acquireCall(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(withOutgoingRequestID(ctx), s.settings().readTimeout)
+	defer cancel()
+	if s.vaultToken != "" {
+		// Not needed to read, but it keeps the vault from rate limiting us.
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+s.vaultToken)
+	}
+	resp, err := client.Get(ctx, &vaultpb.GetRequest{Key: key})
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.NotFound:
+		// Vault had a value, but its TTL elapsed.
+		return "", errValueExpired
+	case codes.DataLoss:
+		// Vault had a value, but it has rotted.
+		return "", errValueCorrupted
+	default:
+		// This could include a timeout.
+		return "", err
+	}
+	v, err := s.valueType.parse(resp.Value)
+	if err != nil {
+		// Vault returned a value, but it was not valid (e.g., not an integer in integer mode).
+		return "", fmt.Errorf("invalid response: %q (%v)", resp.Value, err)
+	}
+	return v, nil
+}
+
+// Whether a gRPC call failed because of the vault, rather than the vault refusing it.
+func grpcFailed(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
+
+// Send a single write of a key to a vault over gRPC, as postToVault does over HTTP. Returns nil
+// only if the vault applied the write.
+func (s *ControlServer) setOverGRPC(ctx context.Context, addr string, key string, body []byte, ttl time.Duration, sequence int64) error {
+	client, err := s.grpcClient(addr)
+	if err != nil {
+		return err
+	}
+	release, err := s.acquireCall(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(withOutgoingRequestID(ctx), s.settings().writeTimeout)
+	defer cancel()
+	if s.vaultToken != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+s.vaultToken)
+	}
+	_, err = client.Set(ctx, &vaultpb.SetRequest{Key: key, Value: body, TtlMillis: ttl.Milliseconds(), Sequence: sequence, Writer: s.name})
+	return err
+}
@@ -0,0 +1,145 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Returned instead of calling a vault which the health checker has found to be down.
+var errVaultDown = errors.New("vault is down")
+
+// How many health-check intervals a result stays fresh for. A vault whose last check is older
+// than this is called as if it were healthy, so that a stalled checker cannot take vaults out of
+// service.
+const healthFreshIntervals = 3
+
+// The outcome of the most recent health check of a vault.
+type vaultHealth struct {
+	Healthy bool      `json:"healthy"`
+	Checked time.Time `json:"checkedAt"`
+	// Why the vault was found to be down, if it was.
+	Error     string    `json:"error,omitempty"`
+	ErrorCode errorCode `json:"errorCode,omitempty"`
+	// The most recent check which found the vault healthy, if any has.
+	LastHealthy *time.Time `json:"lastHealthyAt,omitempty"`
+}
+
+// Check the health of every vault every interval, so that the data path can skip vaults which are
+// down rather than waiting for each one to time out.
+func (s *ControlServer) healthCheckEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// The first check waits an interval, so that vaults starting alongside us are not
+		// marked down before they are listening.
+		<-ticker.C
+		var wg sync.WaitGroup
+		for _, vault := range s.vaultList() {
+			wg.Add(1)
+			go func(vault string) {
+				defer wg.Done()
+				s.recordHealth(vault, s.checkHealth(vault))
+			}(vault)
+		}
+		wg.Wait()
+	}
+}
+
+// Check the health of a single vault: over HTTP, its /healthz must answer 200, and over gRPC, a
+// read must reach it. Returns nil if the vault is healthy.
+func (s *ControlServer) checkHealth(vault string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.settings().vaultTimeout)
+	defer cancel()
+	if addr, ok := grpcAddress(vault); ok {
+		_, err := s.fetchValueOverGRPC(ctx, addr, valueKey)
+		if err == nil || errors.Is(err, errValueExpired) || errors.Is(err, errValueCorrupted) {
+			// The vault answered; whether its value is any good is for the reads to judge.
+			return nil
+		}
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, vaultURL(vault)+"healthz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.doVault(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var report struct {
+		Status string `json:"status"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&report) == nil && report.Status != "" {
+		// E.g. draining, or failing to persist writes.
+		return fmt.Errorf("vault is %s", report.Status)
+	}
+	return fmt.Errorf("invalid status code %v", resp.StatusCode)
+}
+
+// Remember the outcome of a health check, logging any change.
+func (s *ControlServer) recordHealth(vault string, err error) {
+	h := &vaultHealth{Healthy: err == nil, Checked: time.Now()}
+	if err != nil {
+		h.Error = err.Error()
+		h.ErrorCode = vaultErrorCode(err)
+	} else {
+		h.LastHealthy = &h.Checked
+	}
+	s.healthLock.Lock()
+	previous := s.health[vault]
+	if err != nil && previous != nil {
+		h.LastHealthy = previous.LastHealthy
+	}
+	s.health[vault] = h
+	s.healthLock.Unlock()
+	if err != nil {
+		s.quarantineStrike(vault, "failed health check: "+err.Error())
+	} else {
+		s.quarantineHealthy(vault)
+	}
+	switch {
+	case !h.Healthy && (previous == nil || previous.Healthy):
+		glog.Warningf("Vault %s is down: %v", vault, err)
+		s.recordEvent(eventVaultDown, vault, err.Error())
+	case h.Healthy && previous != nil && !previous.Healthy:
+		glog.Infof("Vault %s is healthy again", vault)
+		s.recordEvent(eventVaultHealthy, vault, "")
+	}
+}
+
+// Return nil if we may call a vault, or errVaultDown if its most recent health check, which is
+// still fresh, found it down.
+func (s *ControlServer) healthAllow(vault string) error {
+	if s.healthInterval <= 0 {
+		return nil
+	}
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	h := s.health[vault]
+	if h == nil || h.Healthy || time.Since(h.Checked) > healthFreshIntervals*s.healthInterval {
+		return nil
+	}
+	return errVaultDown
+}
+
+// Return the most recent health check of a vault, if there has been one.
+func (s *ControlServer) healthState(vault string) *vaultHealth {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	if h := s.health[vault]; h != nil {
+		report := *h
+		return &report
+	}
+	return nil
+}
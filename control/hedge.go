@@ -0,0 +1,75 @@
+package control
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The outcome of one of the GETs sent by hedgedGet.
+type hedgedResult struct {
+	resp *http.Response
+	err  error
+}
+
+// GET a vault's value, and if it has not answered within the hedge delay, send a duplicate GET
+// and take whichever answer arrives first, so that one sluggish response does not hold up a
+// consensus read. If the first answer is an error, we wait for the other in case it succeeds.
+func (s *ControlServer) hedgedGet(ctx context.Context, url string) (*http.Response, error) {
+	if s.hedgeDelay <= 0 {
+		return s.getFromVault(ctx, url)
+	}
+	// Buffered so that the loser never blocks.
+	results := make(chan hedgedResult, 2)
+	get := func() {
+		resp, err := s.getFromVault(ctx, url)
+		results <- hedgedResult{resp, err}
+	}
+	go get()
+	timer := time.NewTimer(s.hedgeDelay)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.resp, r.err
+	case <-ctx.Done():
+		go func() {
+			// The GET may still have succeeded, and its body holds a call slot until closed.
+			if r := <-results; r.err == nil {
+				r.resp.Body.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case <-timer.C:
+		if glog.V(1) {
+			logf(ctx, logInfo, "No answer from %s within %v; hedging", url, s.hedgeDelay)
+		}
+		go get()
+	}
+	first := <-results
+	if first.err != nil {
+		if second := <-results; second.err == nil {
+			return second.resp, nil
+		}
+		return first.resp, first.err
+	}
+	go func() {
+		// Nobody wants the slower answer.
+		if r := <-results; r.err == nil {
+			r.resp.Body.Close()
+		}
+	}()
+	return first.resp, nil
+}
+
+// GET a URL from a vault, giving up after the read timeout or if the context is cancelled.
+func (s *ControlServer) getFromVault(ctx context.Context, url string) (*http.Response, error) {
+	return withTimeout(ctx, s.settings().readTimeout, func(ctx context.Context) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		return s.doVault(req)
+	})
+}
@@ -0,0 +1,61 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The maximum number of committed writes we remember.
+const maxHistory = 1000
+
+// A record of a single write which was successfully committed to a majority of the vaults.
+type commitRecord struct {
+	Value     json.RawMessage `json:"value"`
+	Version   int             `json:"version"`
+	Timestamp time.Time       `json:"timestamp"`
+	// How many vaults acknowledged the write, out of how many we sent it to.
+	Acks      int `json:"acks"`
+	NumVaults int `json:"numVaults"`
+}
+
+// Remember a committed write, discarding the oldest record if we are at capacity.
+// The caller must hold the write lock.
+func (s *ControlServer) recordCommit(rec commitRecord) {
+	s.history = append(s.history, rec)
+	if len(s.history) > maxHistory {
+		s.history = s.history[len(s.history)-maxHistory:]
+	}
+}
+
+// Return the most recent committed writes (newest last) as a JSON array.
+// Accepts an optional `limit` query parameter to cap the number of records returned.
+func (s *ControlServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	limit := maxHistory
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			writeProblem(w, http.StatusBadRequest, codeBadParameter, "Invalid limit", nil)
+			return
+		}
+		limit = n
+	}
+	s.lock.RLock()
+	start := len(s.history) - limit
+	if start < 0 {
+		start = 0
+	}
+	records := make([]commitRecord, len(s.history)-start)
+	copy(records, s.history[start:])
+	s.lock.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		logf(r.Context(), logWarning, "Could not write history response: %v", err)
+	}
+}
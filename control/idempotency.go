@@ -0,0 +1,160 @@
+package control
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+)
+
+// The header with which a client identifies retries of the same write.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// How long we remember the outcome of a write made with an idempotency key, and how many such
+// outcomes we remember at most.
+const (
+	idempotencyTTL        = 10 * time.Minute
+	maxIdempotencyEntries = 10000
+)
+
+// The outcome of a write made with an idempotency key.
+type idempotentResponse struct {
+	// Closed once the first request with this key has finished.
+	done chan struct{}
+	// A hash of the request body, so we detect a key being reused for a different write.
+	fingerprint [sha256.Size]byte
+	// What we told the client the first time around.
+	statusCode int
+	header     http.Header
+	body       []byte
+	// Whether the response is worth replaying at all.
+	keep    bool
+	expires time.Time
+}
+
+// Captures the response written by a handler, while passing it through to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	rec.statusCode = statusCode
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.statusCode == 0 {
+		rec.statusCode = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Run a write handler, honoring the Idempotency-Key header if the client sent one.
+// The first request with a given key is handled normally and its response remembered; retries
+// with the same key and body receive the same response without touching the vaults again, so a
+// client retrying a timed-out POST neither double-applies the write nor sees a confusing "value
+// would decrease" error. Server errors are not remembered, so that the client may retry them.
+func (s *ControlServer) withIdempotency(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" || isDryRun(r) {
+		// Dry runs never change anything, so there is nothing to protect.
+		handler(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logf(r.Context(), logWarning, "Could not read body: %v", err)
+		writeProblem(w, http.StatusBadRequest, codeBadBody, "Invalid or missing POST body", nil)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	fingerprint := sha256.Sum256(body)
+
+	s.idempotencyLock.Lock()
+	s.expireIdempotentResponses()
+	// Another retry may get in while we wait for the one before, so look again each time.
+	for {
+		prev, ok := s.idempotent[key]
+		if !ok {
+			break
+		}
+		s.idempotencyLock.Unlock()
+		// Wait for the original request to finish if it is still in flight.
+		<-prev.done
+		if prev.fingerprint != fingerprint {
+			writeProblem(w, http.StatusUnprocessableEntity, codeIdempotencyKeyReused,
+				"Idempotency-Key was already used for a different request", nil)
+			return
+		}
+		if prev.keep {
+			assert.Sometimes(true, "Control service: replayed the response to a retried write", Details{"key": key})
+			for name, values := range prev.header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(prev.statusCode)
+			w.Write(prev.body)
+			return
+		}
+		s.idempotencyLock.Lock()
+		if s.idempotent[key] == prev {
+			// The original request failed, and no other retry has taken its place, so let this one
+			// have a go.
+			break
+		}
+	}
+	entry := &idempotentResponse{done: make(chan struct{}), fingerprint: fingerprint, expires: time.Now().Add(idempotencyTTL)}
+	s.idempotent[key] = entry
+	s.idempotencyLock.Unlock()
+
+	// Headers already set, such as the request ID, belong to this request rather than the write.
+	before := w.Header().Clone()
+	rec := &responseRecorder{ResponseWriter: w}
+	defer func() {
+		entry.statusCode = rec.statusCode
+		entry.header = headersSetSince(before, w.Header())
+		entry.body = rec.body.Bytes()
+		entry.keep = rec.statusCode != 0 && rec.statusCode < http.StatusInternalServerError
+		close(entry.done)
+	}()
+	handler(rec, r)
+}
+
+// Return the headers in after which were not in before, or had other values there.
+func headersSetSince(before http.Header, after http.Header) http.Header {
+	set := http.Header{}
+	for name, values := range after {
+		old := before[name]
+		same := len(old) == len(values)
+		for i := 0; same && i < len(values); i++ {
+			same = old[i] == values[i]
+		}
+		if !same {
+			set[name] = append([]string(nil), values...)
+		}
+	}
+	return set
+}
+
+// Forget outcomes which have outlived their TTL, and the oldest ones if we are at capacity.
+// The caller must hold the idempotency lock.
+func (s *ControlServer) expireIdempotentResponses() {
+	now := time.Now()
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range s.idempotent {
+		if now.After(entry.expires) {
+			delete(s.idempotent, key)
+		} else if oldestKey == "" || entry.expires.Before(oldest) {
+			oldestKey, oldest = key, entry.expires
+		}
+	}
+	if len(s.idempotent) >= maxIdempotencyEntries {
+		delete(s.idempotent, oldestKey)
+	}
+}
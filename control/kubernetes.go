@@ -0,0 +1,209 @@
+package control
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The prefix of a -vaults value which names a Kubernetes Service whose ready pods are the vaults,
+// as in k8s://grid/vaults. A port after the service, as in k8s://grid/vaults:http, picks one of
+// several by name or number.
+const k8sScheme = "k8s://"
+
+// Where a pod finds its service account's credentials for the Kubernetes API.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// A Kubernetes Service whose EndpointSlices we watch, through the API server of the cluster we run
+// in, and the resource version of the last list, which the next lookup watches for changes from.
+type k8sSource struct {
+	api       string
+	client    *http.Client
+	namespace string
+	service   string
+	port      string
+	version   string
+}
+
+// Set up a source from a k8s:// URL, with the credentials of the pod we run in.
+func newK8sSource(raw string) (*k8sSource, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("invalid vault registry %q: it must be %s<namespace>/<service>", raw, k8sScheme)
+	}
+	src := &k8sSource{namespace: u.Host}
+	src.service, src.port, _ = strings.Cut(strings.Trim(u.Path, "/"), ":")
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("%s discovers vaults from inside a Kubernetes cluster, but we are not running in one", raw)
+	}
+	src.api = "https://" + net.JoinHostPort(host, port)
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("could not read the cluster's certificate authority: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s/ca.crt", serviceAccountDir)
+	}
+	src.client = &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}
+	return src, nil
+}
+
+func (src *k8sSource) watches() bool { return true }
+
+func (src *k8sSource) String() string {
+	return "Kubernetes service " + src.namespace + "/" + src.service
+}
+
+// Call the API server, as our service account. The token is read afresh each time, since the
+// kubelet rotates it.
+func (src *k8sSource) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	query.Set("labelSelector", "kubernetes.io/service-name="+src.service)
+	u := src.api + "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(src.namespace) + "/endpointslices?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("could not read our service account token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := src.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("status %v: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// An EndpointSlice, with only what we need of it.
+type endpointSlice struct {
+	Ports []struct {
+		Name        string
+		Port        int
+		AppProtocol string
+	}
+	Endpoints []struct {
+		Addresses  []string
+		Conditions struct {
+			Ready *bool
+		}
+	}
+}
+
+// Pick the port the vaults are called on from a slice's ports: the one named, if we were given
+// one, or else the only one. Returns the scheme its application protocol calls for too.
+func (src *k8sSource) pickPort(slice endpointSlice) (port int, scheme string, err error) {
+	for _, p := range slice.Ports {
+		if src.port == "" && len(slice.Ports) > 1 {
+			return 0, "", fmt.Errorf("%s has several ports, so one must be named, as in %s%s/%s:<port>", src, k8sScheme, src.namespace, src.service)
+		}
+		if src.port != "" && src.port != p.Name && src.port != strconv.Itoa(p.Port) {
+			continue
+		}
+		switch p.AppProtocol {
+		case "https":
+			scheme = httpsScheme
+		case "grpc":
+			scheme = grpcScheme
+		}
+		return p.Port, scheme, nil
+	}
+	return 0, "", fmt.Errorf("%s has no port %q", src, src.port)
+}
+
+// List the ready pods behind the service, after the first lookup watching for a change to its
+// EndpointSlices. Each ready address is a vault; a pod which is starting up or shutting down is
+// not ready, so only running pods are in the grid.
+func (src *k8sSource) lookup(ctx context.Context) ([]string, error) {
+	if src.version != "" {
+		if err := src.watch(ctx); err != nil {
+			return nil, fmt.Errorf("could not watch vaults in %s: %w", src, err)
+		}
+	}
+	resp, err := src.get(ctx, url.Values{})
+	if err != nil {
+		return nil, fmt.Errorf("could not look up vaults in %s: %w", src, err)
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Metadata struct {
+			ResourceVersion string
+		}
+		Items []endpointSlice
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("could not look up vaults in %s: %v", src, err)
+	}
+	src.version = list.Metadata.ResourceVersion
+	var vaults []string
+	for _, slice := range list.Items {
+		if len(slice.Endpoints) == 0 {
+			continue
+		}
+		port, scheme, err := src.pickPort(slice)
+		if err != nil {
+			return nil, err
+		}
+		for _, endpoint := range slice.Endpoints {
+			if ready := endpoint.Conditions.Ready; ready != nil && !*ready {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				vaults = append(vaults, scheme+net.JoinHostPort(address, strconv.Itoa(port)))
+			}
+		}
+	}
+	return discoveredVaults(vaults, src.String())
+}
+
+// Watch the service's EndpointSlices from the last list, until one changes or discoveryWait
+// passes, whichever is first.
+func (src *k8sSource) watch(ctx context.Context) error {
+	resp, err := src.get(ctx, url.Values{
+		"watch":           {"1"},
+		"resourceVersion": {src.version},
+		"timeoutSeconds":  {strconv.Itoa(int(discoveryWait.Seconds()))},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type string
+		}
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				// The API server ended the watch; nothing changed while we waited.
+				return nil
+			}
+			return err
+		}
+		// Anything else, including an error saying the version we watched from is too old, means
+		// the slices should be listed again.
+		if event.Type != "BOOKMARK" {
+			return nil
+		}
+	}
+}
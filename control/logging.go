@@ -0,0 +1,174 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The formats in which we may write our logs: glog's usual text, or one JSON object per line.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// How severe a log entry is, as the "level" of a JSON entry.
+type logSeverity string
+
+const (
+	logInfo    logSeverity = "info"
+	logWarning logSeverity = "warning"
+	logError   logSeverity = "error"
+	logFatal   logSeverity = "fatal"
+)
+
+// Fields attached to a log entry about a request to the vaults, such as which vault it concerns
+// and how long the call took, so that JSON logs can be searched and correlated by them.
+type logFields map[string]any
+
+// Where JSON log entries go, once JSON logging is set up. The lock keeps entries whole when
+// several are written at once.
+var jsonLog struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+// The header glog writes at the start of every line, e.g.
+// "W1014 09:19:53.705786   10612 warmup.go:38] ".
+var glogHeader = regexp.MustCompile(`^([IWEF])\d{4} \d{2}:\d{2}:\d{2}\.\d{6}\s+\d+ ([^\]]+)\] ?(.*)$`)
+
+// The severity of each of glog's header letters.
+var glogSeverities = map[string]logSeverity{"I": logInfo, "W": logWarning, "E": logError, "F": logFatal}
+
+// Switch our logs to JSON, one object per line on stderr. glog has no way to plug in another
+// format, so it is told to log to stderr, and stderr is swapped for a pipe, from which each of
+// its lines is translated into JSON. Entries written with logEvent skip the pipe and keep their
+// fields. Returns a function which flushes any entries still in the pipe, for use on exit.
+func setupJSONLogging() (func(), error) {
+	if err := flag.Set("logtostderr", "true"); err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	jsonLog.w = os.Stderr
+	os.Stderr = w
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			m := glogHeader.FindStringSubmatch(line)
+			if m == nil {
+				// A continuation of a multi-line entry, or something not written by glog.
+				writeJSONEntry(logInfo, "", line, nil)
+				continue
+			}
+			writeJSONEntry(glogSeverities[m[1]], m[2], m[3], nil)
+		}
+	}()
+	return func() {
+		glog.Flush()
+		w.Close()
+		<-done
+	}, nil
+}
+
+// Write a single JSON log entry. Fields may not override the entry's own members.
+func writeJSONEntry(severity logSeverity, caller string, msg string, fields logFields) {
+	entry := make(map[string]any, len(fields)+4)
+	for k, v := range fields {
+		if d, ok := v.(time.Duration); ok {
+			// Durations are logged in (fractional) milliseconds, so that they can be compared.
+			v = float64(d) / float64(time.Millisecond)
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = severity
+	entry["msg"] = msg
+	if caller != "" {
+		entry["caller"] = caller
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]any{"time": entry["time"], "level": severity, "msg": msg, "caller": caller})
+	}
+	jsonLog.lock.Lock()
+	defer jsonLog.lock.Unlock()
+	jsonLog.w.Write(append(b, '\n'))
+}
+
+// Log a message with structured fields, and the ID of the client request it concerns, if any. In
+// JSON, the fields become members of the entry; in text, they follow the message as key=value
+// pairs. Durations are logged in milliseconds, so their keys should say so (e.g. "latency_ms").
+func logEvent(ctx context.Context, severity logSeverity, msg string, fields logFields) {
+	logEventDepth(1, ctx, severity, msg, fields)
+}
+
+// Log a formatted message, with the ID of the client request it concerns, if any.
+func logf(ctx context.Context, severity logSeverity, format string, args ...any) {
+	logEventDepth(1, ctx, severity, fmt.Sprintf(format, args...), nil)
+}
+
+// Log a message as logEvent does, attributing it to the caller depth frames up.
+func logEventDepth(depth int, ctx context.Context, severity logSeverity, msg string, fields logFields) {
+	if id := requestIDFrom(ctx); id != "" {
+		withID := make(logFields, len(fields)+1)
+		for k, v := range fields {
+			withID[k] = v
+		}
+		withID["request_id"] = id
+		fields = withID
+	}
+	if jsonLog.w != nil {
+		caller := ""
+		if _, file, line, ok := runtime.Caller(depth + 1); ok {
+			caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+		}
+		writeJSONEntry(severity, caller, msg, fields)
+		return
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, k := range keys {
+		v := fields[k]
+		if d, ok := v.(time.Duration); ok {
+			v = fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+		}
+		text := fmt.Sprint(v)
+		if text == "" || strings.ContainsAny(text, " \"=\n") {
+			text = fmt.Sprintf("%q", text)
+		}
+		fmt.Fprintf(&b, " %s=%s", k, text)
+	}
+	switch severity {
+	case logWarning:
+		glog.WarningDepth(depth+1, b.String())
+	case logError:
+		glog.ErrorDepth(depth+1, b.String())
+	default:
+		glog.InfoDepth(depth+1, b.String())
+	}
+}
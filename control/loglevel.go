@@ -0,0 +1,41 @@
+package control
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"antithesis.com/glitch-grid/internal/logging"
+)
+
+// Report or change how verbosely we log, without restarting, so that the V(1) lines about each
+// vault can be turned on during an incident and off again afterwards:
+// - GET /admin/loglevel reports the level (glog's -v) as JSON; and
+// - PUT /admin/loglevel sets it to the level in the body, e.g. 1.
+func (s *ControlServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		level, e := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err != nil || e != nil || level < 0 || level > logging.MaxLevel {
+			writeProblem(w, http.StatusBadRequest, codeBadBody, "Invalid or missing log level", Details{"max": logging.MaxLevel})
+			return
+		}
+		previous := logging.SetLevel(level)
+		glog.Infof("Log level changed from %d to %d by %s", previous, level, r.RemoteAddr)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int{"level": logging.Level()})
+}
@@ -0,0 +1,243 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"antithesis.com/glitch-grid/internal/metrics"
+)
+
+// What we were doing with a vault, as the "op" label of the vault calls and consensus failures
+// counters.
+const (
+	opRead  = "read"
+	opWrite = "write"
+)
+
+// How a call to a vault went, as the "result" label of the vault calls counter.
+const (
+	// The vault answered: with a value, an acknowledgement, or that its value has expired.
+	resultSuccess = "success"
+	// The vault could not be reached, or answered with an error or a corrupt value.
+	resultFailure = "failure"
+	// We did not call the vault, because its circuit is open or it failed its health check.
+	resultSkipped = "skipped"
+)
+
+// The Prometheus metrics exported by the control server on /metrics, so that the grid's behavior
+// during glitches can be watched on dashboards. With a StatsD sink, each one is also sent there as
+// it changes.
+type controlMetrics struct {
+	registry          *prometheus.Registry
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	vaultCalls        *prometheus.CounterVec
+	vaultCallDuration *prometheus.HistogramVec
+	vaultErrors       *prometheus.CounterVec
+	errors            *prometheus.CounterVec
+	consensusFailures *prometheus.CounterVec
+	glitches          *prometheus.CounterVec
+	panics            *prometheus.CounterVec
+	quorumMargin      prometheus.Gauge
+	lastQuorumRead    prometheus.Gauge
+	statsd            *statsdSink
+}
+
+// Create the metrics for a control server, sending them to StatsD too if statsd is not nil.
+func newControlMetrics(statsd *statsdSink) *controlMetrics {
+	m := &controlMetrics{
+		statsd:   statsd,
+		registry: metrics.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "glitchgrid_control_requests_total",
+			Help: "Client requests answered by the control server, by path, method and status code.",
+		}, []string{"path", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "glitchgrid_control_request_duration_seconds",
+			Help:    "How long the control server took to answer client requests, by path and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"path", "method"}),
+		vaultCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "glitchgrid_control_vault_calls_total",
+			Help: "Reads and writes the control server made to each vault, by outcome.",
+		}, []string{"vault", "op", "result"}),
+		vaultCallDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "glitchgrid_control_vault_call_duration_seconds",
+			Help:    "How long each vault took to answer the control server's reads and writes, including failed ones.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"vault", "op"}),
+		vaultErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "glitchgrid_control_vault_errors_total",
+			Help: "Reads and writes to each vault which failed or were skipped, by error code.",
+		}, []string{"vault", "op", "error_code"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "glitchgrid_control_errors_total",
+			Help: "Client requests which failed, by path and the error code they were answered with.",
+		}, []string{"path", "error_code"}),
+		consensusFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "glitchgrid_control_consensus_failures_total",
+			Help: "Reads on which the vaults did not agree, and writes which a majority of them did not acknowledge.",
+		}, []string{"op"}),
+		glitches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "glitchgrid_control_glitches_total",
+			Help: "Quorum reads on which a vault answered with something other than the consensus value, by vault.",
+		}, []string{"vault"}),
+		panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "glitchgrid_control_panics_total",
+			Help: "Client requests whose handler panicked, by path.",
+		}, []string{"path"}),
+		quorumMargin: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "glitchgrid_control_quorum_margin",
+			Help: "How many vaults the most recent quorum read could have lost before losing consensus; negative if it had none. NaN until the first read.",
+		}),
+		lastQuorumRead: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "glitchgrid_control_last_quorum_read_timestamp_seconds",
+			Help: "When the most recent quorum read, which set glitchgrid_control_quorum_margin, finished, in seconds since the Unix epoch.",
+		}),
+	}
+	// A margin of zero would say we are one vault away from losing consensus before we know.
+	m.quorumMargin.Set(math.NaN())
+	for _, op := range []string{opRead, opWrite} {
+		// Export both operations from the start, so that rates work before the first failure.
+		m.consensusFailures.WithLabelValues(op)
+	}
+	m.registry.MustRegister(m.requests, m.requestDuration, m.vaultCalls, m.vaultCallDuration, m.vaultErrors, m.errors, m.consensusFailures, m.glitches, m.panics, m.quorumMargin, m.lastQuorumRead)
+	return m
+}
+
+// The handler for /metrics.
+func (m *controlMetrics) handler() http.Handler {
+	return metrics.Handler(m.registry)
+}
+
+// Count a call to a vault, and time it unless we skipped it. code is why it failed or was
+// skipped, or "" if it succeeded.
+func (m *controlMetrics) vaultCall(vault string, op string, result string, code errorCode, latency time.Duration) {
+	m.vaultCalls.WithLabelValues(vault, op, result).Inc()
+	if result != resultSkipped {
+		m.vaultCallDuration.WithLabelValues(vault, op).Observe(latency.Seconds())
+	}
+	if code != "" {
+		m.vaultErrors.WithLabelValues(vault, op, string(code)).Inc()
+	}
+	if m.statsd != nil {
+		m.statsd.count("vault_calls", "vault", vault, "op", op, "result", result)
+		if result != resultSkipped {
+			m.statsd.timing("vault_call_duration", latency, "vault", vault, "op", op)
+		}
+		if code != "" {
+			m.statsd.count("vault_errors", "vault", vault, "op", op, "error_code", string(code))
+		}
+	}
+}
+
+// Count a read on which the vaults did not agree, or a write which a majority did not acknowledge.
+func (m *controlMetrics) consensusFailure(op string) {
+	m.consensusFailures.WithLabelValues(op).Inc()
+	if m.statsd != nil {
+		m.statsd.count("consensus_failures", "op", op)
+	}
+}
+
+// Count a vault disagreeing with the quorum.
+func (m *controlMetrics) glitch(vault string) {
+	m.glitches.WithLabelValues(vault).Inc()
+	if m.statsd != nil {
+		m.statsd.count("glitches", "vault", vault)
+	}
+}
+
+// Count a handler panicking.
+func (m *controlMetrics) panic(path string) {
+	m.panics.WithLabelValues(path).Inc()
+	if m.statsd != nil {
+		m.statsd.count("panics", "path", path)
+	}
+}
+
+// Return how a read from a vault went, and whether it is worth counting at all.
+func readResultOf(err error) (string, bool) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "", false
+	case err == nil || errors.Is(err, errValueExpired):
+		return resultSuccess, true
+	case errors.Is(err, errCircuitOpen) || errors.Is(err, errVaultDown):
+		return resultSkipped, true
+	}
+	return resultFailure, true
+}
+
+// Record the outcome of a read from a quorum of the vaults: how many of them agreed out of how
+// many we asked, and whether that was enough. A read we cancelled is not counted, and nor is a
+// read of any key but the grid's value, such as the self-test's, beyond failing its trace.
+func (s *ControlServer) recordQuorumRead(ctx context.Context, key string, agreeing int, numVaults int, ok bool) {
+	if ctx.Err() != nil {
+		return
+	}
+	if key != valueKey {
+		if !ok {
+			markFailed(ctx, string(codeNoQuorum))
+		}
+		return
+	}
+	margin := float64(agreeing - majorityOf(numVaults))
+	s.metrics.quorumMargin.Set(margin)
+	s.metrics.lastQuorumRead.SetToCurrentTime()
+	if s.metrics.statsd != nil {
+		s.metrics.statsd.gauge("quorum_margin", margin)
+	}
+	s.observeConsensus(agreeing, numVaults, ok)
+	if !ok {
+		if numVaults == 0 || agreeing < majorityOf(numVaults) {
+			// A read at consistency "all" fails with only a majority agreeing, but consensus holds.
+			s.metrics.consensusFailure(opRead)
+		}
+		markFailed(ctx, string(codeNoQuorum))
+	}
+}
+
+// Wrap a handler so that every request it answers is counted and timed. Requests are labelled by
+// the mux pattern which matched them rather than by their path, and unusual methods are lumped
+// together, so that clients cannot create new series at will.
+func (m *controlMetrics) wrap(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &metrics.StatusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.StatusCode == 0 {
+			rec.StatusCode = http.StatusOK
+		}
+		_, path := mux.Handler(r)
+		if path == "" {
+			path = "unmatched"
+		}
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		default:
+			method = "other"
+		}
+		elapsed := time.Since(start)
+		m.requests.WithLabelValues(path, method, strconv.Itoa(rec.StatusCode)).Inc()
+		m.requestDuration.WithLabelValues(path, method).Observe(elapsed.Seconds())
+		// Failed requests carry their error code in a header, as well as any problem document.
+		code := rec.Header().Get(errorCodeHeader)
+		if code != "" {
+			m.errors.WithLabelValues(path, code).Inc()
+		}
+		if m.statsd != nil {
+			m.statsd.count("requests", "path", path, "method", method, "code", strconv.Itoa(rec.StatusCode))
+			m.statsd.timing("request_duration", elapsed, "path", path, "method", method)
+			if code != "" {
+				m.statsd.count("errors", "path", path, "error_code", code)
+			}
+		}
+	})
+}
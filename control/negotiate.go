@@ -0,0 +1,101 @@
+package control
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// The body formats supported by the value endpoint.
+const (
+	contentTypeText     = "text/plain"
+	contentTypeJSON     = "application/json"
+	contentTypeProtobuf = "application/x-protobuf"
+)
+
+// Pick the format of the response body from the request's Accept header.
+// The first supported type listed by the client wins, and we default to plain text.
+func negotiateContentType(r *http.Request) string {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case contentTypeText, contentTypeJSON, contentTypeProtobuf:
+			return mediaType
+		}
+	}
+	return contentTypeText
+}
+
+// Decode a value sent by a client, according to the Content-Type of the request, returning it in
+// plain form. Anything which is not JSON or protobuf is treated as plain text.
+func decodeValue(t valueType, contentType string, body []byte) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case contentTypeProtobuf, contentTypeJSON:
+		v := &Value{}
+		var err error
+		if mediaType == contentTypeProtobuf {
+			err = proto.Unmarshal(body, v)
+		} else {
+			err = protojson.Unmarshal(body, v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if t == valueTypeBlob {
+			return v.Blob, nil
+		}
+		return []byte(strconv.FormatInt(v.Value, 10)), nil
+	default:
+		return body, nil
+	}
+}
+
+// Encode a message in the negotiated format, falling back to the given text for plain text.
+func writeNegotiated(w http.ResponseWriter, r *http.Request, statusCode int, msg proto.Message, text string) {
+	contentType := negotiateContentType(r)
+	var body []byte
+	var err error
+	switch contentType {
+	case contentTypeProtobuf:
+		body, err = proto.Marshal(msg)
+	case contentTypeJSON:
+		body, err = protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(msg)
+	default:
+		body = []byte(text)
+	}
+	if err != nil {
+		logf(r.Context(), logError, "Could not encode %s response: %v", contentType, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+// Send a value (and the committed version it corresponds to) to the client.
+func writeValue(w http.ResponseWriter, r *http.Request, statusCode int, t valueType, value string, version int) {
+	msg := &Value{Version: int64(version)}
+	if t == valueTypeBlob {
+		msg.Blob = []byte(value)
+	} else {
+		msg.Value, _ = strconv.ParseInt(value, 10, 64)
+	}
+	writeNegotiated(w, r, statusCode, msg, value)
+}
+
+// Tell the client how many vaults acknowledged their write.
+func writeWriteResult(w http.ResponseWriter, r *http.Request, statusCode int, acks int, numVaults int, version int) {
+	writeNegotiated(w, r, statusCode,
+		&WriteResult{Acks: int32(acks), NumVaults: int32(numVaults), Version: int64(version)},
+		fmt.Sprintf("Sent updates to %d/%d vaults", acks, numVaults))
+}
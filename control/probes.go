@@ -0,0 +1,79 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// What /healthz and /readyz answer.
+type probeReport struct {
+	Status string `json:"status"`
+	// For /readyz: how many vaults answered, and how many must for a quorum.
+	Reachable      *int `json:"reachable,omitempty"`
+	MajorityNeeded *int `json:"majorityNeeded,omitempty"`
+}
+
+// Answer a liveness probe: if we can answer at all, we are up. This never calls the vaults, so
+// that losing them does not get us restarted.
+func (s *ControlServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.NotFound(w, r)
+		return
+	}
+	writeProbe(w, http.StatusOK, probeReport{Status: "ok"})
+}
+
+// Answer a readiness probe: 200 if a quorum of the vaults can be reached, and 503 if not, so that
+// load balancers stop sending us requests we could only fail. A vault counts as reachable if the
+// health checker's latest round found it healthy; any other vault is probed, in parallel, within
+// the vault timeout.
+func (s *ControlServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.NotFound(w, r)
+		return
+	}
+	all, vaults := s.quorumVaults()
+	needed := majorityOf(len(all))
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	reachable := 0
+	for _, vault := range vaults {
+		wg.Add(1)
+		go func(vault string) {
+			defer wg.Done()
+			if !s.recentlyHealthy(vault) && s.checkHealth(vault) != nil {
+				return
+			}
+			lock.Lock()
+			reachable++
+			lock.Unlock()
+		}(vault)
+	}
+	wg.Wait()
+	report := probeReport{Status: "ready", Reachable: &reachable, MajorityNeeded: &needed}
+	statusCode := http.StatusOK
+	if len(vaults) == 0 || reachable < needed {
+		report.Status = "no quorum"
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeProbe(w, statusCode, report)
+}
+
+// Whether a vault was found healthy by the latest round of health checks. This is stricter than
+// the data path's idea of fresh, so that readiness follows a vault going down within an interval.
+func (s *ControlServer) recentlyHealthy(vault string) bool {
+	if s.healthInterval <= 0 {
+		return false
+	}
+	h := s.healthState(vault)
+	return h != nil && h.Healthy && time.Since(h.Checked) <= s.healthInterval+s.settings().vaultTimeout
+}
+
+func writeProbe(w http.ResponseWriter, statusCode int, report probeReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,117 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A machine-readable error code, so that clients can branch on what went wrong. The same codes
+// appear in the problem documents we answer with (and their X-Error-Code header), in the log
+// entries about the failures, and in the error metrics, so that automation can react to a
+// specific failure mode wherever it sees it.
+type errorCode string
+
+const (
+	// The request body was missing or not a valid value.
+	codeBadBody errorCode = "BAD_BODY"
+	// A query parameter or header had an invalid value.
+	codeBadParameter errorCode = "BAD_PARAMETER"
+	// The write would make the counter decrease.
+	codeValueDecrease errorCode = "VALUE_DECREASE"
+	// The version in If-Match is not the committed version.
+	codeVersionMismatch errorCode = "VERSION_MISMATCH"
+	// A majority of the vaults could not be reached or did not agree.
+	codeNoQuorum errorCode = "NO_QUORUM"
+	// The vaults agree that the value's TTL has elapsed.
+	codeValueExpired errorCode = "VALUE_EXPIRED"
+	// The Idempotency-Key was already used for a different request.
+	codeIdempotencyKeyReused errorCode = "IDEMPOTENCY_KEY_REUSED"
+	// The admin API was called without a valid token.
+	codeUnauthorized errorCode = "UNAUTHORIZED"
+	// A vault could not be added because it is already a member, or removed because it is the last one.
+	codeMembershipConflict errorCode = "MEMBERSHIP_CONFLICT"
+	// A vault could not be removed because it is not a member.
+	codeUnknownVault errorCode = "UNKNOWN_VAULT"
+	// The request did not finish within the server's deadline.
+	codeDeadlineExceeded errorCode = "DEADLINE_EXCEEDED"
+	// Too many writes were already in flight.
+	codeTooManyWrites errorCode = "TOO_MANY_WRITES"
+	// This control server does not accept writes, as it is a standby or has lost its lease.
+	codeNotPrimary errorCode = "NOT_PRIMARY"
+	// The reload file could not be read, or asked for settings we cannot apply.
+	codeReloadFailed errorCode = "RELOAD_FAILED"
+	// A bug: the handler panicked. The detail gives the request's ID, to quote when reporting it.
+	codeInternal errorCode = "INTERNAL_ERROR"
+)
+
+// Why a call to a single vault failed. These are reported per vault, in logs, metrics, verbose
+// reads and the status endpoint, rather than as the code of a whole response.
+const (
+	// The vault reported that its value fails its checksum.
+	codeVaultCorrupt errorCode = "VAULT_CORRUPT"
+	// The vault did not answer in time.
+	codeTimeout errorCode = "TIMEOUT"
+	// The vault could not be called: it could not be reached, was found down by its health check,
+	// or its circuit is open.
+	codeVaultUnavailable errorCode = "VAULT_UNAVAILABLE"
+	// The vault answered with an error of its own.
+	codeVaultError errorCode = "VAULT_ERROR"
+)
+
+// The header in which we repeat a problem document's code, for clients (and our own metrics)
+// which do not read the body.
+const errorCodeHeader = "X-Error-Code"
+
+// Return why a call to a vault failed, or "" if it did not. An expired value is an answer, not a
+// failure.
+func vaultErrorCode(err error) errorCode {
+	var netErr net.Error
+	switch {
+	case err == nil || errors.Is(err, errValueExpired):
+		return ""
+	case errors.Is(err, errValueCorrupted):
+		return codeVaultCorrupt
+	case errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.DeadlineExceeded ||
+		(errors.As(err, &netErr) && netErr.Timeout()):
+		return codeTimeout
+	case errors.Is(err, errCircuitOpen) || errors.Is(err, errVaultDown) || status.Code(err) == codes.Unavailable:
+		return codeVaultUnavailable
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return codeVaultUnavailable
+	}
+	return codeVaultError
+}
+
+// The media type of RFC 7807 problem details documents.
+const contentTypeProblem = "application/problem+json"
+
+// Send an RFC 7807 problem details document describing an error. Any extra details are included
+// as extension members alongside the standard ones.
+func writeProblem(w http.ResponseWriter, statusCode int, code errorCode, detail string, extra Details) {
+	doc := Details{}
+	for k, v := range extra {
+		doc[k] = v
+	}
+	doc["type"] = "urn:glitch-grid:error:" + string(code)
+	doc["title"] = http.StatusText(statusCode)
+	doc["status"] = statusCode
+	doc["code"] = code
+	if detail != "" {
+		doc["detail"] = detail
+	}
+	w.Header().Set("Content-Type", contentTypeProblem)
+	w.Header().Set(errorCodeHeader, string(code))
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(doc); err != nil {
+		glog.Warningf("Could not write problem response: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package control
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// When to take a flapping vault out of service, so that a vault which keeps failing its health
+// checks or returning corrupt data does not keep dragging down reads and writes. Quarantined
+// vaults are not called, but still count towards the majority, as vaults which did not answer,
+// so that a quorum always overlaps every other; they are still health-checked, which is how they
+// earn their way back in.
+type quarantinePolicy struct {
+	// How many strikes (failed health checks or corrupt reads) within the window quarantine a
+	// vault; zero disables quarantine.
+	Strikes int
+	Window  time.Duration
+	// How long a quarantined vault must pass every health check before it is restored.
+	Probation time.Duration
+}
+
+// What we know about a single vault's strikes, guarded by the server's quarantineLock.
+type quarantineState struct {
+	// When the vault's recent strikes happened, oldest first.
+	strikes []time.Time
+	// When the vault was quarantined, or zero if it is in service.
+	since time.Time
+	// When the vault's current run of healthy checks began, or zero if its last check failed.
+	healthySince time.Time
+}
+
+// Count a strike against a vault, quarantining it if it has had too many within the window.
+func (s *ControlServer) quarantineStrike(vault string, reason string) {
+	policy := s.settings().quarantine
+	if policy.Strikes <= 0 {
+		return
+	}
+	now := time.Now()
+	s.quarantineLock.Lock()
+	defer s.quarantineLock.Unlock()
+	q := s.quarantineStateOf(vault)
+	q.healthySince = time.Time{}
+	if !q.since.IsZero() {
+		return
+	}
+	recent := q.strikes[:0]
+	for _, t := range q.strikes {
+		if now.Sub(t) < policy.Window {
+			recent = append(recent, t)
+		}
+	}
+	q.strikes = append(recent, now)
+	if len(q.strikes) < policy.Strikes {
+		return
+	}
+	// Never leave fewer vaults in service than a majority of all of them, or no read or write
+	// could reach a quorum.
+	all := s.vaultList()
+	if len(all)-s.quarantinedCount()-1 < majorityOf(len(all)) {
+		glog.Warningf("Not quarantining vault %s after %d strikes (last: %s): too few vaults would be left", vault, len(q.strikes), reason)
+		return
+	}
+	glog.Warningf("Quarantining vault %s after %d strikes within %v (last: %s)", vault, len(q.strikes), policy.Window, reason)
+	q.since = now
+	q.strikes = nil
+	s.recordEvent(eventVaultQuarantined, vault, "last strike: "+reason)
+}
+
+// Count a passed health check for a vault, restoring it once it has been healthy for the whole
+// probation.
+func (s *ControlServer) quarantineHealthy(vault string) {
+	policy := s.settings().quarantine
+	if policy.Strikes <= 0 {
+		return
+	}
+	now := time.Now()
+	s.quarantineLock.Lock()
+	defer s.quarantineLock.Unlock()
+	q := s.quarantineStateOf(vault)
+	if q.healthySince.IsZero() {
+		q.healthySince = now
+	}
+	if !q.since.IsZero() && now.Sub(q.healthySince) >= policy.Probation {
+		glog.Infof("Restoring vault %s, healthy for %v after being quarantined for %v", vault, now.Sub(q.healthySince), now.Sub(q.since))
+		q.since = time.Time{}
+		s.recordEvent(eventVaultRestored, vault, "")
+	}
+}
+
+// Return the quarantine state of a vault, creating it if need be. The caller holds quarantineLock.
+func (s *ControlServer) quarantineStateOf(vault string) *quarantineState {
+	q := s.quarantine[vault]
+	if q == nil {
+		q = &quarantineState{}
+		s.quarantine[vault] = q
+	}
+	return q
+}
+
+// Return how many of our vaults are quarantined. The caller holds quarantineLock.
+func (s *ControlServer) quarantinedCount() int {
+	n := 0
+	for _, vault := range s.vaultList() {
+		if q := s.quarantine[vault]; q != nil && !q.since.IsZero() {
+			n++
+		}
+	}
+	return n
+}
+
+// Return when a vault was quarantined, or nil if it is in service.
+func (s *ControlServer) quarantinedSince(vault string) *time.Time {
+	s.quarantineLock.Lock()
+	defer s.quarantineLock.Unlock()
+	if q := s.quarantine[vault]; q != nil && !q.since.IsZero() {
+		since := q.since
+		return &since
+	}
+	return nil
+}
+
+// Return the vaults a majority is counted over, which is all of them, and those of them to call,
+// which leaves out any in quarantine. A quarantined vault counts as one which did not answer.
+// Like vaultList, these are a snapshot.
+func (s *ControlServer) quorumVaults() (all []string, serving []string) {
+	all = s.vaultList()
+	if s.settings().quarantine.Strikes <= 0 {
+		return all, all
+	}
+	s.quarantineLock.Lock()
+	defer s.quarantineLock.Unlock()
+	serving = make([]string, 0, len(all))
+	for _, vault := range all {
+		if q := s.quarantine[vault]; q == nil || q.since.IsZero() {
+			serving = append(serving, vault)
+		}
+	}
+	return all, serving
+}
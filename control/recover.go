@@ -0,0 +1,104 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+	"github.com/golang/glog"
+
+	"antithesis.com/glitch-grid/internal/metrics"
+)
+
+// What we POST to the panic hook when a handler panics.
+type panicReport struct {
+	Time time.Time `json:"time"`
+	// The control server which panicked, as given by -name.
+	Controller string `json:"controller"`
+	RequestID  string `json:"requestId"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Panic      string `json:"panic"`
+	Stack      string `json:"stack"`
+}
+
+// Wrap a handler so that a panic while serving a request fails only that request: the client gets
+// a 500 with the request's ID, to quote when reporting it, and the panic is logged with its stack,
+// counted, and sent to the panic hook if there is one. If the response was already under way, the
+// connection is aborted instead, so that the client cannot mistake it for a complete one.
+func (s *ControlServer) withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &metrics.StatusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// The handler meant to abort the response; let the server do so.
+				panic(v)
+			}
+			id := requestIDFrom(r.Context())
+			stack := string(debug.Stack())
+			_, path := s.mux.Handler(r)
+			if path == "" {
+				path = "unmatched"
+			}
+			assert.Unreachable("Control service: a handler panicked", Details{"path": path, "panic": fmt.Sprint(v)})
+			logEvent(r.Context(), logError, "Panic serving request", logFields{
+				"method":     r.Method,
+				"path":       r.URL.Path,
+				"panic":      fmt.Sprint(v),
+				"stack":      stack,
+				"error_code": codeInternal,
+			})
+			s.metrics.panic(path)
+			s.reportPanic(panicReport{
+				Time:       time.Now().UTC(),
+				Controller: s.name,
+				RequestID:  id,
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Panic:      fmt.Sprint(v),
+				Stack:      stack,
+			})
+			if rec.StatusCode != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeProblem(w, http.StatusInternalServerError, codeInternal,
+				fmt.Sprintf("Internal error serving request %s", id), Details{"requestId": id})
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// Queue a report of a panic for the panic hook, if there is one.
+func (s *ControlServer) reportPanic(report panicReport) {
+	if s.panicReports == nil {
+		return
+	}
+	select {
+	case s.panicReports <- report:
+	default:
+		glog.Warningf("Dropped panic report for request %s; %d are already waiting to be sent", report.RequestID, webhookQueueSize)
+	}
+}
+
+// Send queued panic reports to the panic hook, one attempt each, until we shut down.
+func (s *ControlServer) sendPanicReports() {
+	client := &http.Client{Timeout: webhookTimeout}
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case report := <-s.panicReports:
+			body, _ := json.Marshal(report)
+			if err := postWebhook(client, s.panicHookURL, body); err != nil {
+				glog.Errorf("Could not send panic report for request %s: %v", report.RequestID, err)
+			}
+		}
+	}
+}
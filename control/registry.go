@@ -0,0 +1,261 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The prefixes of a -vaults value which names a Consul service, as in
+// consul://localhost:8500/vault, or an etcd key prefix, as in
+// etcd://localhost:2379/glitchgrid/vaults/, for the vaults to register themselves in (see the
+// vault's -register). Both are reached over plain HTTP, as a local agent usually is.
+const (
+	consulScheme = "consul://"
+	etcdScheme   = "etcd://"
+)
+
+// Split a registry URL into the base URL of its HTTP API and the path after the host, which names
+// the service or key prefix.
+func registryURL(raw string, scheme string) (base string, path string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid vault registry %q: %v", raw, err)
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return "", "", fmt.Errorf("invalid vault registry %q: it must be %shost:port/<name>", raw, scheme)
+	}
+	return "http://" + u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// A Consul service which the vaults register in, and the index of the last answer, which the
+// next lookup waits for a change from.
+type consulSource struct {
+	base    string
+	service string
+	index   uint64
+}
+
+func newConsulSource(raw string) (*consulSource, error) {
+	base, service, err := registryURL(raw, consulScheme)
+	if err != nil {
+		return nil, err
+	}
+	return &consulSource{base: base, service: strings.Trim(service, "/")}, nil
+}
+
+func (src *consulSource) watches() bool { return true }
+
+func (src *consulSource) String() string { return "Consul service " + src.service }
+
+// One instance of a service, as Consul's health endpoint lists it.
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Meta    map[string]string
+	}
+}
+
+// Look up the instances of the service which pass their health checks, with a blocking query
+// after the first. Each is a vault at its service address, or its node's if it has none, called
+// over the scheme in its "scheme" metadata (http if it has none).
+func (src *consulSource) lookup(ctx context.Context) ([]string, error) {
+	u := src.base + "/v1/health/service/" + url.PathEscape(src.service) + "?passing=1"
+	if src.index > 0 {
+		u += fmt.Sprintf("&index=%d&wait=%ds", src.index, int(discoveryWait.Seconds()))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up vaults in %s: %w", src, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("could not look up vaults in %s: status %v: %s", src, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("could not look up vaults in %s: %v", src, err)
+	}
+	// As Consul advises, start again from the beginning if the index goes backwards, and never
+	// wait on an index of zero, which would not block.
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if index < src.index {
+		index = 0
+	}
+	if index == 0 {
+		index = 1
+	}
+	src.index = index
+	vaults := make([]string, len(entries))
+	for i, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		vaults[i] = net.JoinHostPort(host, strconv.Itoa(entry.Service.Port))
+		if scheme := entry.Service.Meta["scheme"]; scheme != "" && scheme != "http" {
+			vaults[i] = scheme + "://" + vaults[i]
+		}
+	}
+	return discoveredVaults(vaults, src.String())
+}
+
+// An etcd key prefix which the vaults register under, one key each with the vault's address as
+// its value, and the revision of the last answer, which the next lookup watches for changes from.
+// etcd is reached through its JSON gateway.
+type etcdSource struct {
+	base     string
+	prefix   string
+	revision int64
+}
+
+func newEtcdSource(raw string) (*etcdSource, error) {
+	base, prefix, err := registryURL(raw, etcdScheme)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdSource{base: base, prefix: "/" + strings.Trim(prefix, "/") + "/"}, nil
+}
+
+func (src *etcdSource) watches() bool { return true }
+
+func (src *etcdSource) String() string { return "etcd prefix " + src.prefix }
+
+// The header of an answer from etcd. Its 64-bit numbers are sent as strings.
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+// Post a request to etcd's JSON gateway.
+func etcdPost(ctx context.Context, base string, path string, request interface{}) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("status %v: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// The end of the range of keys which start with prefix, as etcd wants it.
+func etcdRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+// Read the vaults under the prefix, after the first lookup watching for a change to them.
+func (src *etcdSource) lookup(ctx context.Context) ([]string, error) {
+	if src.revision > 0 {
+		if err := src.watch(ctx); err != nil {
+			return nil, fmt.Errorf("could not watch vaults in %s: %w", src, err)
+		}
+	}
+	resp, err := etcdPost(ctx, src.base, "/v3/kv/range", map[string][]byte{
+		"key":       []byte(src.prefix),
+		"range_end": etcdRangeEnd(src.prefix),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not look up vaults in %s: %w", src, err)
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		Header etcdHeader
+		Kvs    []struct {
+			Value []byte
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("could not look up vaults in %s: %v", src, err)
+	}
+	src.revision = answer.Header.Revision
+	vaults := make([]string, len(answer.Kvs))
+	for i, kv := range answer.Kvs {
+		vaults[i] = strings.TrimSpace(string(kv.Value))
+	}
+	return discoveredVaults(vaults, src.String())
+}
+
+// Watch the prefix from just after the last revision read, until a key under it changes or
+// discoveryWait passes, whichever is first.
+func (src *etcdSource) watch(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, discoveryWait)
+	defer cancel()
+	request := map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(src.prefix),
+			"range_end":      etcdRangeEnd(src.prefix),
+			"start_revision": strconv.FormatInt(src.revision+1, 10),
+		},
+	}
+	resp, err := etcdPost(ctx, src.base, "/v3/watch", request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Result struct {
+				Canceled        bool
+				CompactRevision int64 `json:"compact_revision,string"`
+				Events          []json.RawMessage
+			}
+			Error *struct {
+				Message string
+			}
+		}
+		if err := decoder.Decode(&message); err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				// Nothing changed while we waited.
+				return nil
+			}
+			return err
+		}
+		switch {
+		case message.Error != nil:
+			return errors.New(message.Error.Message)
+		case len(message.Result.Events) > 0 || message.Result.Canceled || message.Result.CompactRevision > 0:
+			// Something changed, or the revisions we asked for are gone; read the prefix again.
+			return nil
+		}
+	}
+}
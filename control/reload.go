@@ -0,0 +1,198 @@
+package control
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The settings which can be changed while we run, by editing the reload file and sending us a
+// SIGHUP (or calling POST /admin/reload). Calls already in flight keep the settings they started
+// with.
+type reloadableSettings struct {
+	// How long we wait for a vault to answer a single call, a read and a write.
+	vaultTimeout time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// The default consistency level for reads.
+	consistency consistency
+	// When we take a flapping vault out of service.
+	quarantine quarantinePolicy
+}
+
+// Work out the reloadable settings from a configuration, filling in the defaults.
+func settingsFrom(config ControlConfig) *reloadableSettings {
+	rs := &reloadableSettings{
+		vaultTimeout: config.VaultTimeout,
+		readTimeout:  config.ReadTimeout,
+		writeTimeout: config.WriteTimeout,
+		consistency:  config.Consistency,
+		quarantine:   config.Quarantine,
+	}
+	if rs.vaultTimeout <= 0 {
+		rs.vaultTimeout = time.Second
+	}
+	if rs.readTimeout <= 0 {
+		rs.readTimeout = rs.vaultTimeout
+	}
+	if rs.writeTimeout <= 0 {
+		rs.writeTimeout = rs.vaultTimeout
+	}
+	if rs.consistency == "" {
+		rs.consistency = consistencyQuorum
+	}
+	if config.HealthInterval <= 0 {
+		// Only a health check can let a vault out of quarantine.
+		rs.quarantine.Strikes = 0
+	}
+	return rs
+}
+
+// The longest of the timeouts.
+func (rs *reloadableSettings) longestTimeout() time.Duration {
+	timeout := rs.vaultTimeout
+	if rs.readTimeout > timeout {
+		timeout = rs.readTimeout
+	}
+	if rs.writeTimeout > timeout {
+		timeout = rs.writeTimeout
+	}
+	return timeout
+}
+
+// Return the settings in force now.
+func (s *ControlServer) settings() *reloadableSettings {
+	return s.current.Load()
+}
+
+// Read the reload file: one flag per line, as on the command line but without the leading dash,
+// e.g. "vault-timeout=2s", with blank lines and lines starting with # ignored. Only the vault list
+// and the reloadable settings may be given; any others are an error. Settings the file leaves out
+// keep the values they were given on the command line, in base.
+func loadReloadFile(base ControlConfig) (ControlConfig, error) {
+	config := base
+	f, err := os.Open(base.ReloadFile)
+	if err != nil {
+		return config, fmt.Errorf("could not open reload file: %w", err)
+	}
+	defer f.Close()
+	var args []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args = append(args, "-"+strings.TrimLeft(line, "-"))
+	}
+	if err := scanner.Err(); err != nil {
+		return config, fmt.Errorf("could not read reload file: %w", err)
+	}
+	fs := flag.NewFlagSet(base.ReloadFile, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&config.Vaults, "vaults", config.Vaults, "")
+	fs.DurationVar(&config.VaultTimeout, "vault-timeout", config.VaultTimeout, "")
+	fs.DurationVar(&config.ReadTimeout, "vault-read-timeout", config.ReadTimeout, "")
+	fs.DurationVar(&config.WriteTimeout, "vault-write-timeout", config.WriteTimeout, "")
+	consistencyName := fs.String("consistency", string(config.Consistency), "")
+	fs.IntVar(&config.Quarantine.Strikes, "quarantine-strikes", config.Quarantine.Strikes, "")
+	fs.DurationVar(&config.Quarantine.Window, "quarantine-window", config.Quarantine.Window, "")
+	fs.DurationVar(&config.Quarantine.Probation, "quarantine-probation", config.Quarantine.Probation, "")
+	if err := fs.Parse(args); err != nil {
+		return config, fmt.Errorf("invalid reload file: %w", err)
+	}
+	if fs.NArg() > 0 {
+		return config, fmt.Errorf("invalid reload file: unexpected %q", fs.Arg(0))
+	}
+	if config.Consistency, err = parseConsistency(*consistencyName); err != nil {
+		return config, fmt.Errorf("invalid reload file: %w", err)
+	}
+	switch {
+	case config.VaultTimeout <= 0 || config.ReadTimeout < 0 || config.WriteTimeout < 0:
+		return config, fmt.Errorf("invalid reload file: the vault timeout must be positive, and the read and write timeouts not negative")
+	case config.Quarantine.Strikes < 0 || config.Quarantine.Window <= 0 || config.Quarantine.Probation < 0:
+		return config, fmt.Errorf("invalid reload file: quarantine strikes must not be negative, the window must be positive and the probation not negative")
+	case len(splitVaults(config.Vaults)) == 0:
+		return config, fmt.Errorf("invalid reload file: there must be at least one vault")
+	}
+	return config, nil
+}
+
+// Apply the reload file, if there is one: swap in the new settings, and add and remove vaults to
+// match its vault list. Returns what changed, for the log and the admin API.
+func (s *ControlServer) reload() (string, error) {
+	if s.base.ReloadFile == "" {
+		return "", fmt.Errorf("there is nothing to reload without a -reload-file")
+	}
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	config, err := loadReloadFile(s.base)
+	if err != nil {
+		return "", err
+	}
+	rs := settingsFrom(config)
+	if s.clientTimeout > 0 && rs.longestTimeout() > s.clientTimeout {
+		// The client gives up on any call which takes longer.
+		return "", fmt.Errorf("invalid reload file: timeouts cannot be raised above %v, the longest we started with, without a restart", s.clientTimeout)
+	}
+	previous := s.current.Swap(rs)
+	if previous.quarantine.Strikes > 0 && rs.quarantine.Strikes <= 0 {
+		// Quarantine is now disabled, so nothing is left to restore the vaults in it.
+		s.quarantineLock.Lock()
+		for vault, q := range s.quarantine {
+			if !q.since.IsZero() {
+				s.recordEvent(eventVaultRestored, vault, "quarantine disabled")
+			}
+		}
+		s.quarantine = make(map[string]*quarantineState)
+		s.quarantineLock.Unlock()
+	}
+	added, removed := s.replaceVaults(splitVaults(config.Vaults), "reloaded")
+	summary := fmt.Sprintf("vault timeout %v, read timeout %v, write timeout %v, consistency %s, quarantine after %d strikes in %v with %v probation; %d vaults",
+		rs.vaultTimeout, rs.readTimeout, rs.writeTimeout, rs.consistency, rs.quarantine.Strikes, rs.quarantine.Window, rs.quarantine.Probation, len(s.vaultList()))
+	if len(added) > 0 {
+		summary += ", added " + strings.Join(added, ", ")
+	}
+	if len(removed) > 0 {
+		summary += ", removed " + strings.Join(removed, ", ")
+	}
+	glog.Infof("Reloaded %s: %s", s.base.ReloadFile, summary)
+	return summary, nil
+}
+
+// Split a comma-separated list of vaults, dropping any empty entries.
+func splitVaults(vaults string) []string {
+	var list []string
+	for _, vault := range strings.Split(vaults, ",") {
+		if vault = strings.TrimSpace(vault); vault != "" {
+			list = append(list, vault)
+		}
+	}
+	return list
+}
+
+// Apply the reload file on demand, as a SIGHUP does, and say what is now in force.
+func (s *ControlServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	summary, err := s.reload()
+	if err != nil {
+		logf(r.Context(), logError, "Could not reload: %v", err)
+		writeProblem(w, http.StatusConflict, codeReloadFailed, err.Error(), nil)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Reloaded: " + summary))
+}
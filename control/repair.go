@@ -0,0 +1,134 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// How we repair the vaults which missed a write that was committed to a majority, so that they do
+// not hold a stale value until the next client write comes along.
+type repairPolicy struct {
+	// How many times to try resending the write to each vault; zero disables repair.
+	Attempts int
+	// How long to wait before the first attempt, doubling for each one after, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// Resend a committed write in the background to every vault which did not acknowledge it. resp
+// holds the acknowledgements, as filled in by postValueToVaults.
+func (s *ControlServer) repairStragglers(body []byte, ttl time.Duration, sequence int64, resp map[string]bool) {
+	if s.repair.Attempts <= 0 {
+		return
+	}
+	select {
+	case <-s.stopping:
+		// We are shutting down, and will not be around to finish a repair.
+		return
+	default:
+	}
+	committed := time.Now()
+	_, vaults := s.quorumVaults()
+	for _, vault := range vaults {
+		// HTTP acknowledgements are recorded by URL, and gRPC ones by address.
+		if resp[vault] || resp[vaultURL(vault)] {
+			continue
+		}
+		s.repairLock.Lock()
+		if s.repairs[vault] >= sequence {
+			s.repairLock.Unlock()
+			continue
+		}
+		// Any older repair to this vault gives way to this one.
+		s.repairs[vault] = sequence
+		s.repairLock.Unlock()
+		s.repairing.Add(1)
+		go s.repairVault(vault, body, ttl, sequence, committed)
+	}
+}
+
+// Resend a committed write to a vault until it takes it, we run out of attempts, or a newer write
+// needs repairing instead.
+func (s *ControlServer) repairVault(vault string, body []byte, ttl time.Duration, sequence int64, committed time.Time) {
+	defer s.repairing.Done()
+	defer func() {
+		s.repairLock.Lock()
+		if s.repairs[vault] == sequence {
+			delete(s.repairs, vault)
+		}
+		s.repairLock.Unlock()
+	}()
+	backoff := retryPolicy{Attempts: s.repair.Attempts, BaseDelay: s.repair.BaseDelay, MaxDelay: s.repair.MaxDelay, Jitter: s.retry.Jitter}
+	for attempt := 1; attempt <= s.repair.Attempts; attempt++ {
+		select {
+		case <-time.After(backoff.delay(attempt)):
+		case <-s.stopping:
+			glog.Warningf("Abandoning the repair of vault %s with write %d: shutting down", vault, sequence)
+			return
+		}
+		s.repairLock.Lock()
+		superseded := s.repairs[vault] != sequence
+		s.repairLock.Unlock()
+		if superseded || !s.hasVault(vault) {
+			return
+		}
+		remaining := ttl
+		if ttl > 0 {
+			// The value must expire when it would have, had the vault taken it the first time.
+			if remaining = ttl - time.Since(committed); remaining <= 0 {
+				return
+			}
+		}
+		retry, err := s.resendToVault(vault, body, remaining, sequence)
+		if err == nil {
+			glog.Infof("Repaired vault %s with write %d after %d attempts", vault, sequence, attempt)
+			s.recordVaultWrite(vault)
+			return
+		}
+		if !retry {
+			glog.Warningf("Giving up repairing vault %s with write %d: %v", vault, sequence, err)
+			return
+		}
+		glog.V(1).Infof("Could not repair vault %s with write %d (attempt %d of %d): %v", vault, sequence, attempt, s.repair.Attempts, err)
+	}
+	glog.Warningf("Giving up repairing vault %s with write %d after %d attempts", vault, sequence, s.repair.Attempts)
+}
+
+// Send a single write to a vault on behalf of a repair. Returns nil if the vault took it, and
+// otherwise whether the failure may be transient, and so worth another attempt.
+func (s *ControlServer) resendToVault(vault string, body []byte, ttl time.Duration, sequence int64) (bool, error) {
+	if err := s.healthAllow(vault); err != nil {
+		return true, err
+	}
+	if err := s.breakerAllow(vault); err != nil {
+		return true, err
+	}
+	ctx := context.Background()
+	if addr, ok := grpcAddress(vault); ok {
+		err := s.setOverGRPC(ctx, addr, valueKey, body, ttl, sequence)
+		s.breakerRecord(vault, grpcFailed(err))
+		return grpcFailed(err), err
+	}
+	r, err := s.postToVault(ctx, vaultURL(vault), body, ttl, sequence)
+	failed := retryable(r, err)
+	s.breakerRecord(vault, failed)
+	if err == nil && r.StatusCode != http.StatusOK {
+		// A refusal such as a stale sequence number is final, unless the vault failed outright.
+		err = fmt.Errorf("vault answered %s", r.Status)
+	}
+	return failed, err
+}
+
+// Whether a vault is still one of ours.
+func (s *ControlServer) hasVault(vault string) bool {
+	for _, v := range s.vaultList() {
+		if v == vault {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package control
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// The header in which a client may give an ID for its request, and in which we return it and
+// pass it on to the vaults, so that one write can be followed through every server's logs.
+const requestIDHeader = "X-Request-ID"
+
+// The longest request ID we accept from a client; longer ones are replaced with our own.
+const maxRequestIDLength = 128
+
+// The context key under which a request's ID is kept.
+type requestIDKey struct{}
+
+// Wrap a handler so that every request has an ID: the client's, if it sent a usable one, or a new
+// random one. The ID is returned in the response, and kept in the request's context for logging
+// and for passing on to the vaults.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// Whether a client's request ID is fit to log and forward: not empty, not too long, and only
+// printable ASCII without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Make up a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Return the ID of the request a context belongs to, or "" if it does not belong to one.
+func requestIDFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Return the ID of a request being answered, as the access log wants it.
+func requestIDOf(r *http.Request) string {
+	return requestIDFrom(r.Context())
+}
+
+// Return a context which passes the ID of the request it belongs to, if any, on to a gRPC vault.
+func withOutgoingRequestID(ctx context.Context) context.Context {
+	if id := requestIDFrom(ctx); id != "" {
+		return metadata.AppendToOutgoingContext(ctx, "x-request-id", id)
+	}
+	return ctx
+}
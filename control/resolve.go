@@ -0,0 +1,76 @@
+package control
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Re-resolve the vaults' hostnames every interval, and sooner after a call to a vault fails, so
+// that a vault which moves to a new IP (as it may under Docker or Kubernetes) is not stuck behind
+// connections to its old one. When a vault's addresses change, we drop our connections to it, and
+// the next call connects afresh.
+func (s *ControlServer) resolveEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.resolveNow:
+		}
+		for _, vault := range s.vaultList() {
+			s.resolve(vault)
+		}
+	}
+}
+
+// Ask for the vaults' hostnames to be re-resolved now rather than at the next interval, without
+// waiting for it.
+func (s *ControlServer) resolveSoon() {
+	select {
+	case s.resolveNow <- struct{}{}:
+	default:
+		// A re-resolution is already pending.
+	}
+}
+
+// Look up a vault's hostname, and drop our connections to it if its addresses have changed since
+// we last looked.
+func (s *ControlServer) resolve(vault string) {
+	host, _, err := net.SplitHostPort(vaultHostPort(vault))
+	if err != nil || net.ParseIP(host) != nil {
+		// There is nothing to resolve.
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.settings().vaultTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		glog.Warningf("Could not resolve vault %s: %v", vault, err)
+		return
+	}
+	sort.Strings(addrs)
+	resolved := strings.Join(addrs, ",")
+	s.resolveLock.Lock()
+	previous, known := s.resolved[vault]
+	s.resolved[vault] = resolved
+	s.resolveLock.Unlock()
+	if !known || previous == resolved {
+		return
+	}
+	glog.Infof("Vault %s moved from %s to %s; reconnecting", vault, previous, resolved)
+	// Idle connections to every vault go too, since the client cannot drop just this one's.
+	s.client.CloseIdleConnections()
+	if addr, ok := grpcAddress(vault); ok {
+		s.grpcLock.Lock()
+		if conn, ok := s.grpcConns[addr]; ok {
+			conn.Close()
+			delete(s.grpcConns, addr)
+		}
+		s.grpcLock.Unlock()
+	}
+}
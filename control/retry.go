@@ -0,0 +1,95 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// How we retry a call to a vault which failed in a way that may be transient, so that a single
+// dropped packet does not count a healthy vault as failed. Retrying writes is safe, because a
+// retried write carries the same sequence number and so cannot overwrite a newer one.
+type retryPolicy struct {
+	// How many times to try a call in all; 1 means never retry.
+	Attempts int
+	// How long to wait before the first retry, doubling for each one after, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// How far each delay is randomly stretched or shrunk, as a fraction of it, so that the calls
+	// retried after a vault's blip do not all arrive together as it recovers.
+	Jitter float64
+}
+
+// How long to wait before the given retry (the first being 1).
+func (p retryPolicy) delay(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return d
+}
+
+// Whether a response from a vault means a call may succeed if retried: the vault could not be
+// reached, or failed unexpectedly. Deliberate refusals, including a read-only or draining vault's
+// 503, are final.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Make an HTTP call to a vault, retrying it under the retry policy. The call must build a fresh
+// request each time, with the context it is given. The response of the final attempt is returned,
+// whether or not it succeeded. We stop retrying once the context is cancelled.
+//
+// If the context has a deadline, it is split between the attempts still to come, so that a slow
+// first attempt cannot use up the whole budget and leave none for a retry.
+func (s *ControlServer) withRetries(ctx context.Context, vault string, call func(context.Context) (*http.Response, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := s.attempt(ctx, s.retry.Attempts-attempt+1, call)
+		if attempt >= s.retry.Attempts || !retryable(resp, err) || ctx.Err() != nil {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		delay := s.retry.delay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			// There would be no time left for the retry.
+			return nil, fmt.Errorf("no time left to retry after attempt %d: %w", attempt, context.DeadlineExceeded)
+		}
+		if glog.V(1) {
+			logf(ctx, logInfo, "Retrying call to vault %s in %v (attempt %d of %d failed)", vault, delay, attempt, s.retry.Attempts)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Make a single attempt at a call, giving it its share of the time left before the context's
+// deadline, if there is one, when the given number of attempts remain.
+func (s *ControlServer) attempt(ctx context.Context, remaining int, call func(context.Context) (*http.Response, error)) (*http.Response, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok || remaining <= 1 {
+		return call(ctx)
+	}
+	return withTimeout(ctx, time.Until(deadline)/time.Duration(remaining), call)
+}
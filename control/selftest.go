@@ -0,0 +1,182 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The key the self-test writes its sentinels to, apart from the grid's value.
+const selftestKey = "glitchgrid-selftest"
+
+// What one vault did during a self-test.
+type selftestVault struct {
+	Address string `json:"address"`
+	// Whether it took the sentinel, returned it when read back, and, if it did not, took it when
+	// it was written again.
+	Wrote    bool `json:"wrote"`
+	ReadBack bool `json:"readBack"`
+	Repaired bool `json:"repaired,omitempty"`
+	// Why it did not, if it did not.
+	Error     string    `json:"error,omitempty"`
+	ErrorCode errorCode `json:"errorCode,omitempty"`
+}
+
+// The outcome of a self-test, and how long each step took.
+type selftestReport struct {
+	Pass     bool   `json:"pass"`
+	Sentinel string `json:"sentinel"`
+	// How many vaults took the sentinel, returned it, and were repaired, of how many were asked,
+	// and how many were needed.
+	Acks           int `json:"acks"`
+	Agreeing       int `json:"agreeing"`
+	Repaired       int `json:"repaired"`
+	NumVaults      int `json:"numVaults"`
+	MajorityNeeded int `json:"majorityNeeded"`
+	// The time taken to write the sentinel, read it back, repair the vaults which did not return
+	// it, and in all.
+	WriteMs  float64         `json:"writeMs"`
+	ReadMs   float64         `json:"readMs"`
+	RepairMs float64         `json:"repairMs"`
+	TotalMs  float64         `json:"totalMs"`
+	Vaults   []selftestVault `json:"vaults"`
+}
+
+// Run a synthetic round trip through the vaults, for monitoring: write a new sentinel to the
+// self-test key on every vault in quorum, read it back with a quorum read, and write it again to
+// any which did not return it. The test passes if a majority took the sentinel and a majority
+// returned it, with a 200, and fails with a 503; either way, the report says what each vault did.
+// The grid's value is not touched.
+func (s *ControlServer) handleSelftest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	start := time.Now()
+	all, vaults := s.quorumVaults()
+	sentinel := strconv.FormatInt(start.UnixNano(), 10)
+	sequence := s.nextSequence()
+	report := selftestReport{
+		Sentinel:       sentinel,
+		NumVaults:      len(all),
+		MajorityNeeded: majorityOf(len(all)),
+		Vaults:         make([]selftestVault, len(vaults)),
+	}
+	for i, vault := range vaults {
+		report.Vaults[i].Address = vault
+	}
+	// Each step runs on every vault in parallel; each vault's entry is only touched by its own
+	// goroutine.
+	forEach := func(step func(v *selftestVault)) float64 {
+		stepStart := time.Now()
+		var wg sync.WaitGroup
+		for i := range report.Vaults {
+			wg.Add(1)
+			go func(v *selftestVault) {
+				defer wg.Done()
+				step(v)
+			}(&report.Vaults[i])
+		}
+		wg.Wait()
+		return float64(time.Since(stepStart).Microseconds()) / 1000
+	}
+	fail := func(v *selftestVault, err error) {
+		v.Error, v.ErrorCode = err.Error(), vaultErrorCode(err)
+	}
+	report.WriteMs = forEach(func(v *selftestVault) {
+		if err := s.selftestWrite(ctx, v.Address, sentinel, sequence); err != nil {
+			fail(v, err)
+			return
+		}
+		v.Wrote = true
+	})
+	// The read goes through the quorum path, as a read of the value would, and each vault's part
+	// in it is picked out of the individual reads.
+	readStart := time.Now()
+	result := s.getValueFromVaults(ctx, selftestKey, consistencyQuorum)
+	report.ReadMs = float64(time.Since(readStart).Microseconds()) / 1000
+	reads := make(map[string]vaultRead, len(result.reads))
+	for _, read := range result.reads {
+		reads[read.vault] = read
+	}
+	for i := range report.Vaults {
+		v := &report.Vaults[i]
+		read, ok := reads[v.Address]
+		switch {
+		case !ok:
+			fail(v, errors.New("not read"))
+		case read.err != nil:
+			fail(v, read.err)
+		case read.value != sentinel:
+			fail(v, fmt.Errorf("read back %q", read.value))
+		default:
+			v.ReadBack = true
+		}
+	}
+	report.RepairMs = forEach(func(v *selftestVault) {
+		if v.ReadBack {
+			return
+		}
+		if err := s.selftestWrite(ctx, v.Address, sentinel, sequence); err != nil {
+			fail(v, err)
+			return
+		}
+		v.Repaired = true
+	})
+	for _, v := range report.Vaults {
+		if v.Wrote {
+			report.Acks++
+		}
+		if v.ReadBack {
+			report.Agreeing++
+		}
+		if v.Repaired {
+			report.Repaired++
+		}
+	}
+	report.Pass = len(vaults) > 0 && report.Acks >= report.MajorityNeeded && report.Agreeing >= report.MajorityNeeded
+	report.TotalMs = float64(time.Since(start).Microseconds()) / 1000
+	statusCode := http.StatusOK
+	if !report.Pass {
+		statusCode = http.StatusServiceUnavailable
+		w.Header().Set(errorCodeHeader, string(codeNoQuorum))
+		logEvent(ctx, logWarning, fmt.Sprintf("Self-test failed: %d/%d vaults took the sentinel and %d returned it", report.Acks, len(all), report.Agreeing),
+			logFields{"error_code": codeNoQuorum})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logf(ctx, logWarning, "Could not write self-test response: %v", err)
+	}
+}
+
+// Write the sentinel to the self-test key on a vault, as a write of the value would be, skipping
+// vaults which are down or whose circuit is open, and counting towards the vault's circuit.
+func (s *ControlServer) selftestWrite(ctx context.Context, vault string, sentinel string, sequence int64) error {
+	if err := s.healthAllow(vault); err != nil {
+		return err
+	}
+	if err := s.breakerAllow(vault); err != nil {
+		return err
+	}
+	if addr, ok := grpcAddress(vault); ok {
+		err := s.setOverGRPC(ctx, addr, selftestKey, []byte(sentinel), 0, sequence)
+		s.breakerSettle(ctx, vault, grpcFailed(err))
+		return err
+	}
+	r, err := s.postToVault(ctx, vaultKeyURL(vault, selftestKey), []byte(sentinel), 0, sequence)
+	s.breakerSettle(ctx, vault, retryable(r, err))
+	if err != nil {
+		return err
+	}
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid status code %v", r.StatusCode)
+	}
+	return nil
+}
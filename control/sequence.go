@@ -0,0 +1,20 @@
+package control
+
+import "time"
+
+// The header with which we stamp every write to the vaults, so that they can reject a delayed or
+// retried write which arrives after a newer one.
+const sequenceHeader = "X-Write-Sequence"
+
+// Return the sequence number for a new write. Sequence numbers are strictly increasing, and are
+// seeded from the clock so that they keep increasing across restarts of the control server.
+func (s *ControlServer) nextSequence() int64 {
+	s.sequenceLock.Lock()
+	defer s.sequenceLock.Unlock()
+	if now := time.Now().UnixNano(); now > s.sequence {
+		s.sequence = now
+	} else {
+		s.sequence++
+	}
+	return s.sequence
+}
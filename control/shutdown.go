@@ -0,0 +1,80 @@
+package control
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Serve until we receive SIGTERM or SIGINT, reloading the reload file and the TLS certificate on
+// each SIGHUP, then shut down gracefully: stop accepting requests,
+// wait up to the timeout for in-flight requests (and the writes they are sending to the vaults) to
+// finish, and let any repair already sending a write finish it too, instead of being killed
+// mid-write. Returns nil once we have shut down.
+func (s *ControlServer) serveUntilSignalled(srv *http.Server, l net.Listener, timeout time.Duration) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	errs := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate, not from files named here.
+			errs <- srv.ServeTLS(l, "", "")
+		} else {
+			errs <- srv.Serve(l)
+		}
+	}()
+	for shuttingDown := false; !shuttingDown; {
+		select {
+		case err := <-errs:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if s.certs != nil {
+					if _, err := s.certs.reload(true); err != nil {
+						glog.Errorf("Received %v, but could not reload the TLS certificate: %v", sig, err)
+					}
+				}
+				// Without a reload file there is nothing else to reload, which is only worth
+				// complaining about if there was no certificate to reload either.
+				if s.base.ReloadFile != "" || s.certs == nil {
+					if _, err := s.reload(); err != nil {
+						glog.Errorf("Received %v, but could not reload: %v", sig, err)
+					}
+				}
+				continue
+			}
+			glog.Infof("Received %v; shutting down the control server", sig)
+			shuttingDown = true
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		glog.Warningf("In-flight requests did not finish in %v: %v", timeout, err)
+	}
+	// Repairs waiting for their next attempt give up now.
+	close(s.stopping)
+	repaired := make(chan struct{})
+	go func() {
+		s.repairing.Wait()
+		close(repaired)
+	}()
+	select {
+	case <-repaired:
+	case <-ctx.Done():
+		glog.Warningf("Repairs did not finish in %v", timeout)
+	}
+	s.grpcLock.Lock()
+	for _, conn := range s.grpcConns {
+		conn.Close()
+	}
+	s.grpcLock.Unlock()
+	glog.Flush()
+	return nil
+}
@@ -0,0 +1,89 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"antithesis.com/glitch-grid/internal/metrics"
+)
+
+// One call to a vault made for a client request, as broken down in the slow request log.
+type timedCall struct {
+	vault   string
+	op      string
+	result  string
+	started time.Duration // after the request arrived
+	latency time.Duration
+}
+
+// The calls to the vaults made for a single client request.
+type requestTimings struct {
+	start time.Time
+	calls []timedCall
+	lock  sync.Mutex
+}
+
+// The context key under which a request's timings are kept.
+type requestTimingsKey struct{}
+
+// Wrap a handler so that any request which takes longer than threshold to answer is logged as a
+// warning, with how long each vault took over its part, so that a slow request can be pinned on
+// a slow vault (or on us) without waiting for a timeout. A threshold of zero leaves the handler
+// alone.
+func withSlowLog(threshold time.Duration, next http.Handler) http.Handler {
+	if threshold <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timings := &requestTimings{start: time.Now()}
+		rec := &metrics.StatusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestTimingsKey{}, timings)))
+		elapsed := time.Since(timings.start)
+		if elapsed < threshold {
+			return
+		}
+		if rec.StatusCode == 0 {
+			rec.StatusCode = http.StatusOK
+		}
+		timings.lock.Lock()
+		calls := timings.calls
+		timings.lock.Unlock()
+		sort.Slice(calls, func(i, j int) bool { return calls[i].started < calls[j].started })
+		var slowest time.Duration
+		breakdown := make([]string, len(calls))
+		for i, call := range calls {
+			if call.latency > slowest {
+				slowest = call.latency
+			}
+			breakdown[i] = fmt.Sprintf("%s %s %s +%.3fms %.3fms", call.vault, call.op, call.result,
+				float64(call.started)/float64(time.Millisecond), float64(call.latency)/float64(time.Millisecond))
+		}
+		logEvent(r.Context(), logWarning, "Slow request", logFields{
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"status":     rec.StatusCode,
+			"latency_ms": elapsed,
+			// The vault calls, each with its outcome, when it started and how long it took.
+			"vault_calls":      strings.Join(breakdown, ", "),
+			"slowest_vault_ms": slowest,
+		})
+	})
+}
+
+// Note a call to a vault made for the client request a context belongs to, if it is being timed.
+func noteVaultCall(ctx context.Context, vault string, op string, result string, latency time.Duration) {
+	timings, _ := ctx.Value(requestTimingsKey{}).(*requestTimings)
+	if timings == nil {
+		return
+	}
+	call := timedCall{vault: vault, op: op, result: result, latency: latency}
+	call.started = time.Since(timings.start) - latency
+	timings.lock.Lock()
+	timings.calls = append(timings.calls, call)
+	timings.lock.Unlock()
+}
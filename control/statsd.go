@@ -0,0 +1,79 @@
+package control
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Sends our metrics to a StatsD server over UDP, for those who do not run Prometheus. Plain
+// StatsD has no labels, so they are folded into the metric's name, e.g.
+// glitchgrid.control.vault_calls.localhost_8001.read.success; DogStatsD sends them as tags.
+// Packets which cannot be sent are dropped, as StatsD expects.
+type statsdSink struct {
+	conn net.Conn
+	// Whether to send labels as DogStatsD tags rather than in the name.
+	tags bool
+}
+
+// Connect to the StatsD server named by a -metrics-sink URL: statsd://host:port, or
+// dogstatsd://host:port for DogStatsD's tags.
+func newStatsdSink(sink *url.URL) (*statsdSink, error) {
+	conn, err := net.Dial("udp", sink.Host)
+	if err != nil {
+		return nil, fmt.Errorf("could not set up StatsD: %w", err)
+	}
+	return &statsdSink{conn: conn, tags: sink.Scheme == "dogstatsd"}, nil
+}
+
+// Send one metric of the given StatsD type (c, ms or g), labelled by pairs of names and values.
+func (s *statsdSink) send(name string, value string, kind string, labels ...string) {
+	var b strings.Builder
+	b.WriteString("glitchgrid.control.")
+	b.WriteString(name)
+	if !s.tags {
+		for i := 1; i < len(labels); i += 2 {
+			b.WriteByte('.')
+			b.WriteString(statsdSafe(labels[i]))
+		}
+	}
+	metric := b.String()
+	line := metric + ":" + value + "|" + kind
+	if s.tags && len(labels) > 0 {
+		tags := make([]string, 0, len(labels)/2)
+		for i := 1; i < len(labels); i += 2 {
+			tags = append(tags, labels[i-1]+":"+strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_").Replace(labels[i]))
+		}
+		line += "|#" + strings.Join(tags, ",")
+	}
+	s.conn.Write([]byte(line))
+}
+
+func (s *statsdSink) count(name string, labels ...string) {
+	s.send(name, "1", "c", labels...)
+}
+
+func (s *statsdSink) timing(name string, d time.Duration, labels ...string) {
+	s.send(name, fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond)), "ms", labels...)
+}
+
+func (s *statsdSink) gauge(name string, value float64, labels ...string) {
+	if value < 0 {
+		// A signed gauge value is taken as a change to the gauge, so reset it first.
+		s.send(name, "0", "g", labels...)
+	}
+	s.send(name, fmt.Sprint(value), "g", labels...)
+}
+
+// Replace the characters StatsD gives a meaning to, and any others which would make an awkward
+// name, with underscores. Tags may hold more, and only lose the separators.
+func statsdSafe(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, value)
+}
@@ -0,0 +1,154 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// What the control server last observed about a single vault.
+type vaultStatus struct {
+	Address string `json:"address"`
+	// Whether the most recent read from this vault succeeded.
+	Reachable bool            `json:"reachable"`
+	LastValue json.RawMessage `json:"lastValue,omitempty"`
+	LastSeen  *time.Time      `json:"lastSeen,omitempty"`
+	LastWrite *time.Time      `json:"lastSuccessfulWrite,omitempty"`
+	LastError string          `json:"lastError,omitempty"`
+	// The error code of LastError: VAULT_CORRUPT, TIMEOUT, VAULT_UNAVAILABLE or VAULT_ERROR.
+	LastErrorCode errorCode `json:"lastErrorCode,omitempty"`
+	// Whether the vault reported, on the most recent read, that its value fails its checksum.
+	Corrupted bool `json:"corrupted,omitempty"`
+	// The state of the vault's circuit breaker: closed, open or half-open.
+	Circuit string `json:"circuit"`
+	// The most recent health check of the vault, if the health checker is running.
+	Health *vaultHealth `json:"health,omitempty"`
+	// When the vault was quarantined, if it is out of quorum.
+	QuarantinedSince *time.Time `json:"quarantinedSince,omitempty"`
+	// How long the vault's recent reads and writes took, and how many failed.
+	Latency *vaultLatency `json:"latency,omitempty"`
+	// The calls Latency summarizes.
+	reads, writes latencyWindow
+}
+
+// The body returned by the status endpoint.
+type clusterStatus struct {
+	ConsensusValue json.RawMessage `json:"consensusValue"`
+	// Whether the vaults agree that the value's TTL has elapsed.
+	Expired        bool `json:"expired,omitempty"`
+	Version        int  `json:"version"`
+	Agreeing       int  `json:"agreeing"`
+	MajorityNeeded int  `json:"majorityNeeded"`
+	// How many vaults we could lose before losing consensus. Negative if we have no consensus.
+	QuorumMargin int `json:"quorumMargin"`
+	// Our role in a primary/standby pair: primary, fenced, standby or promoted.
+	Role   string        `json:"role"`
+	Vaults []vaultStatus `json:"vaults"`
+}
+
+// Remember the outcome of reading from a vault.
+func (s *ControlServer) recordVaultRead(vault string, value string, err error) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	vs, ok := s.vaultStatus[vault]
+	if !ok || errors.Is(err, context.Canceled) {
+		// A read we cancelled says nothing about the vault.
+		return
+	}
+	now := time.Now()
+	vs.Corrupted = errors.Is(err, errValueCorrupted)
+	if vs.Corrupted {
+		s.quarantineStrike(vault, "corrupt value")
+	}
+	if errors.Is(err, errValueExpired) || vs.Corrupted {
+		// The vault is reachable; it just no longer has a (trustworthy) value.
+		vs.Reachable = true
+		vs.LastValue = nil
+		vs.LastSeen = &now
+		vs.LastError = err.Error()
+		vs.LastErrorCode = vaultErrorCode(err)
+		return
+	}
+	if err != nil {
+		vs.Reachable = false
+		vs.LastError = err.Error()
+		vs.LastErrorCode = vaultErrorCode(err)
+		return
+	}
+	vs.Reachable = true
+	vs.LastValue = s.valueType.toJSON(value)
+	vs.LastSeen = &now
+	vs.LastError = ""
+	vs.LastErrorCode = ""
+}
+
+// Remember that a vault acknowledged a write.
+func (s *ControlServer) recordVaultWrite(vault string) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	if vs, ok := s.vaultStatus[vault]; ok {
+		now := time.Now()
+		vs.LastWrite = &now
+	}
+}
+
+// Poll all the vaults and report what we know about each of them, along with the current
+// consensus value and how close we are to losing consensus, as JSON.
+func (s *ControlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	status := s.currentStatus(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logf(r.Context(), logWarning, "Could not write status response: %v", err)
+	}
+}
+
+// Poll all the vaults and gather what we know about each of them, for the status endpoint and the
+// dashboard.
+func (s *ControlServer) currentStatus(ctx context.Context) clusterStatus {
+	result := s.getValueFromVaults(ctx, valueKey, s.settings().consistency)
+	value := result.value
+	if !result.ok || result.expired {
+		value = s.valueType.missing()
+	}
+	s.lock.RLock()
+	version := s.version
+	s.lock.RUnlock()
+	status := clusterStatus{
+		ConsensusValue: s.valueType.toJSON(value),
+		Version:        version,
+		Expired:        result.ok && result.expired,
+		Agreeing:       result.agreeing,
+		MajorityNeeded: majorityOf(len(s.vaultList())),
+	}
+	status.QuorumMargin = result.agreeing - status.MajorityNeeded
+	status.Role = s.role()
+	status.Vaults = s.vaultReports()
+	return status
+}
+
+// Report what we know about each vault, in the order they were given.
+func (s *ControlServer) vaultReports() []vaultStatus {
+	var reports []vaultStatus
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	for _, vault := range s.vaultList() {
+		if vs, ok := s.vaultStatus[vault]; ok {
+			report := *vs
+			report.Circuit = s.breakerState(vault)
+			report.Health = s.healthState(vault)
+			report.QuarantinedSince = s.quarantinedSince(vault)
+			if reads, writes := vs.reads.summary(), vs.writes.summary(); reads != nil || writes != nil {
+				report.Latency = &vaultLatency{Read: reads, Write: writes}
+			}
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
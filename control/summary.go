@@ -0,0 +1,58 @@
+package control
+
+import (
+	"context"
+	"time"
+)
+
+// Every interval, poll the vaults as the status endpoint does and log one line summing up the
+// grid's health, so that grepping the log for "Cluster summary" gives its timeline without a
+// metrics backend, e.g.
+//
+//	Cluster summary agreeing=2 consensus=true majority_needed=2 quorum_margin=0 reachable=2 vaults=3 value=17 ...
+//
+// The line is a warning whenever the vaults have no consensus.
+func (s *ControlServer) summarizeEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		status := s.currentStatus(ctx)
+		cancel()
+		reachable, healthy, quarantined := 0, 0, 0
+		for _, vault := range status.Vaults {
+			if vault.Reachable {
+				reachable++
+			}
+			if vault.Health == nil || vault.Health.Healthy {
+				healthy++
+			}
+			if vault.QuarantinedSince != nil {
+				quarantined++
+			}
+		}
+		consensus := status.QuorumMargin >= 0
+		severity := logInfo
+		if !consensus {
+			severity = logWarning
+		}
+		logEvent(context.Background(), severity, "Cluster summary", logFields{
+			"vaults":          len(status.Vaults),
+			"reachable":       reachable,
+			"healthy":         healthy,
+			"quarantined":     quarantined,
+			"agreeing":        status.Agreeing,
+			"majority_needed": status.MajorityNeeded,
+			"quorum_margin":   status.QuorumMargin,
+			"consensus":       consensus,
+			"value":           string(status.ConsensusValue),
+			"version":         status.Version,
+			"role":            status.Role,
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package control
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// The prefix of a vault address (e.g. "https://vault1:8001") which says to talk to the vault over
+// HTTPS instead of plain HTTP.
+const httpsScheme = "https://"
+
+// Return the URL of a vault's root path, which is spoken to over plain HTTP unless its address
+// says otherwise.
+func vaultURL(vault string) string {
+	if strings.HasPrefix(vault, httpsScheme) {
+		return vault + "/"
+	}
+	if path, ok := unixSocket(vault); ok {
+		return fmt.Sprintf("http://%s/", unixHost(path))
+	}
+	return fmt.Sprintf("http://%s/", vault)
+}
+
+// Return the URL under which a vault holds a key: its root path for the grid's value, and under
+// keys/ for any other.
+func vaultKeyURL(vault string, key string) string {
+	if key == valueKey {
+		return vaultURL(vault)
+	}
+	return vaultURL(vault) + "keys/" + url.PathEscape(key)
+}
+
+// Return a vault's address without any scheme prefix.
+func vaultHostPort(vault string) string {
+	for _, scheme := range []string{grpcScheme, httpsScheme} {
+		if hostPort, ok := strings.CutPrefix(vault, scheme); ok {
+			return hostPort
+		}
+	}
+	return vault
+}
+
+// Return an error if a vault's address is not one we can call: a host and port, with an optional
+// scheme prefix, or the absolute path of a Unix socket.
+func validVaultAddress(vault string) error {
+	if path, ok := unixSocket(vault); ok {
+		if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, ", ") {
+			return fmt.Errorf("not an absolute path to a Unix socket")
+		}
+		return nil
+	}
+	hostPort := vaultHostPort(vault)
+	if strings.ContainsAny(hostPort, ",/ ") {
+		return fmt.Errorf("not a host and port")
+	}
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		return fmt.Errorf("%v (IPv6 literals must be bracketed, e.g. [::1]:8001)", err)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package control
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// The tracer for the spans we start ourselves, beyond those of the HTTP and gRPC instrumentation.
+// Until tracing is set up, it starts spans which go nowhere.
+var tracer = otel.Tracer("antithesis.com/glitch-grid/control")
+
+// Which traces we send to the collector.
+type traceSampling struct {
+	// The fraction of the traces we start which are sent. A trace the client started is sent if
+	// the client sampled it.
+	Ratio float64
+	// Whether to send every trace whose request failed as well, however it was sampled.
+	Errors bool
+}
+
+// Send our traces to the OTLP/HTTP collector at endpoint (e.g. Jaeger's, at
+// http://localhost:4318), identifying us by name, and propagate trace context in the W3C
+// traceparent header. Returns a function which flushes any spans not yet sent, for use on exit.
+func setupTracing(endpoint string, name string, sampling traceSampling) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "glitch-grid-control"),
+		attribute.String("service.instance.id", name),
+	))
+	if err != nil {
+		return nil, err
+	}
+	sampler := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampling.Ratio))
+	processor := sdktrace.NewBatchSpanProcessor(exporter)
+	if sampling.Errors && sampling.Ratio < 1 {
+		sampler = recordingSampler{sampler}
+		processor = &errorKeeper{next: processor, pending: make(map[trace.TraceID]*pendingTrace)}
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSampler(sampler), sdktrace.WithSpanProcessor(processor), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Wrap our handler so that every client request gets a span, named for its method and the mux
+// pattern which matched it, continuing any trace the client started.
+func (s *ControlServer) traceRequests(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "control", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		_, pattern := s.mux.Handler(r)
+		return r.Method + " " + pattern
+	}))
+}
+
+// A transport which traces each call to a vault over HTTP, passing the trace context on to the
+// vault, while still letting the client drop its idle connections.
+type tracedTransport struct {
+	*otelhttp.Transport
+	base http.RoundTripper
+}
+
+// Called by http.Client.CloseIdleConnections.
+func (t tracedTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// Return a copy of a client which traces its calls.
+func tracedClient(client *http.Client) *http.Client {
+	traced := *client
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	traced.Transport = tracedTransport{otelhttp.NewTransport(base), base}
+	return &traced
+}
+
+// The dial option which traces calls to gRPC vaults, passing the trace context on to them.
+func grpcTraceOption() grpc.DialOption {
+	return grpc.WithStatsHandler(otelgrpc.NewClientHandler())
+}
+
+// Start a span for a read from or write to a single vault, so that a slow request can be broken
+// down by vault; it covers retries and hedges, each of which has a span of its own beneath it.
+// Returns the context for the vault's calls, and a function which ends the span with the
+// outcome.
+func startVaultSpan(ctx context.Context, op string, vault string) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, "vault "+op, trace.WithAttributes(attribute.String("glitchgrid.vault", vault)))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// Note on the span in a context that the request it belongs to failed, so that its trace is kept
+// even if it was not sampled.
+func markFailed(ctx context.Context, description string) {
+	trace.SpanFromContext(ctx).SetStatus(codes.Error, description)
+}
+
+// A sampler which records the spans of the traces its sampler drops, rather than dropping them,
+// so that an errorKeeper can still send them if the request fails.
+type recordingSampler struct {
+	sdktrace.Sampler
+}
+
+func (rs recordingSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	result := rs.Sampler.ShouldSample(p)
+	if result.Decision == sdktrace.Drop {
+		result.Decision = sdktrace.RecordOnly
+	}
+	return result
+}
+
+func (rs recordingSampler) Description() string {
+	return "RecordingSampler{" + rs.Sampler.Description() + "}"
+}
+
+// Limits on the spans an errorKeeper holds on to: how many traces, how many spans of each, and for
+// how long a trace whose local root never ends (e.g. a repair which outlived its request) is kept.
+const (
+	maxPendingTraces = 10000
+	maxPendingSpans  = 1000
+	pendingTraceTTL  = time.Minute
+)
+
+// The spans of an unsampled trace, held until its local root span ends.
+type pendingTrace struct {
+	spans   []sdktrace.ReadOnlySpan
+	started time.Time
+}
+
+// A span processor which passes sampled spans on, and holds on to the spans of unsampled traces
+// until the span at their root in this process ends: if the request failed, as markFailed notes on
+// that span, the whole trace is passed on after all, and otherwise it is dropped. Spans beneath
+// it which failed, such as a read from a vault which is down, do not count: the grid exists to
+// ride them out, and keeping every trace they turn up in would send them all once one vault dies.
+type errorKeeper struct {
+	next    sdktrace.SpanProcessor
+	pending map[trace.TraceID]*pendingTrace
+	lock    sync.Mutex
+}
+
+func (k *errorKeeper) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	k.next.OnStart(parent, s)
+}
+
+func (k *errorKeeper) OnEnd(s sdktrace.ReadOnlySpan) {
+	if s.SpanContext().IsSampled() {
+		k.next.OnEnd(s)
+		return
+	}
+	id := s.SpanContext().TraceID()
+	k.lock.Lock()
+	pt, ok := k.pending[id]
+	if !ok {
+		if len(k.pending) >= maxPendingTraces {
+			k.evict()
+		}
+		if len(k.pending) >= maxPendingTraces {
+			k.lock.Unlock()
+			return
+		}
+		pt = &pendingTrace{started: time.Now()}
+		k.pending[id] = pt
+	}
+	if len(pt.spans) < maxPendingSpans {
+		pt.spans = append(pt.spans, s)
+	}
+	if s.Parent().IsValid() && !s.Parent().IsRemote() {
+		// Wait for the rest of the trace.
+		k.lock.Unlock()
+		return
+	}
+	delete(k.pending, id)
+	k.lock.Unlock()
+	if s.Status().Code == codes.Error {
+		for _, span := range pt.spans {
+			k.next.OnEnd(sampledSpan{span})
+		}
+	}
+}
+
+// Drop the traces which have been waiting too long for their root span. The caller must hold the
+// lock.
+func (k *errorKeeper) evict() {
+	for id, pt := range k.pending {
+		if time.Since(pt.started) > pendingTraceTTL {
+			delete(k.pending, id)
+		}
+	}
+}
+
+func (k *errorKeeper) Shutdown(ctx context.Context) error {
+	return k.next.Shutdown(ctx)
+}
+
+func (k *errorKeeper) ForceFlush(ctx context.Context) error {
+	return k.next.ForceFlush(ctx)
+}
+
+// A span we decided to send after all, marked as sampled so that the exporter takes it.
+type sampledSpan struct {
+	sdktrace.ReadOnlySpan
+}
+
+func (s sampledSpan) SpanContext() trace.SpanContext {
+	sc := s.ReadOnlySpan.SpanContext()
+	return sc.WithTraceFlags(sc.TraceFlags().WithSampled(true))
+}
@@ -0,0 +1,44 @@
+package control
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"antithesis.com/glitch-grid/internal/listen"
+)
+
+// The prefix of a vault's address (e.g. "unix:///tmp/vault1.sock") which names the Unix domain
+// socket to dial rather than a TCP host and port, as it does for -listen.
+const unixScheme = listen.UnixScheme
+
+// The suffix of the made-up hostname under which we call a vault over a Unix socket.
+const unixHostSuffix = ".unix-socket"
+
+// Return the path of a vault's Unix socket, if it is to be spoken to over one.
+func unixSocket(vault string) (string, bool) {
+	return strings.CutPrefix(vault, unixScheme)
+}
+
+// Return the hostname under which we call the vault listening on a Unix socket. HTTP needs a
+// hostname, and each socket needs its own so that their connections are pooled apart, so the
+// socket's path is encoded into it, to be decoded again when we dial.
+func unixHost(path string) string {
+	return hex.EncodeToString([]byte(path)) + unixHostSuffix
+}
+
+// Dial a vault, over its Unix socket if the address is one of unixHost's hostnames, and over TCP
+// otherwise.
+func dialVault(dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if encoded, ok := strings.CutSuffix(host, unixHostSuffix); ok {
+				if path, err := hex.DecodeString(encoded); err == nil {
+					return dialer.DialContext(ctx, "unix", string(path))
+				}
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
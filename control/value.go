@@ -0,0 +1,71 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// The kind of value stored in the grid.
+// In integer mode, values are non-negative integers which may only increase. In blob mode, values
+// are opaque byte strings (e.g., small configuration strings or JSON documents) which the grid
+// protects with the same quorum machinery, but does not otherwise interpret.
+type valueType string
+
+const (
+	valueTypeInt  valueType = "int"
+	valueTypeBlob valueType = "blob"
+)
+
+// Convert a flag value into a valueType.
+func parseValueType(name string) (valueType, error) {
+	switch t := valueType(name); t {
+	case valueTypeInt, valueTypeBlob:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unknown value type %q (expected %q or %q)", name, valueTypeInt, valueTypeBlob)
+	}
+}
+
+// Validate a value received from a client or a vault, returning it in its canonical form.
+func (t valueType) parse(raw []byte) (string, error) {
+	if t == valueTypeBlob {
+		return string(raw), nil
+	}
+	n, err := strconv.Atoi(string(raw))
+	if err != nil {
+		return "", err
+	}
+	if n < 0 {
+		// We only store positive values.
+		return "", fmt.Errorf("negative value %d", n)
+	}
+	return strconv.Itoa(n), nil
+}
+
+// The value held by a freshly-started vault, before anything has been written to it.
+func (t valueType) initial() string {
+	if t == valueTypeBlob {
+		return ""
+	}
+	return "0"
+}
+
+// The value we report to clients when there is no consensus.
+func (t valueType) missing() string {
+	if t == valueTypeBlob {
+		return ""
+	}
+	return "-1"
+}
+
+// Render a value for inclusion in a JSON document: a number in integer mode, a string otherwise.
+func (t valueType) toJSON(value string) json.RawMessage {
+	if t == valueTypeInt {
+		if _, err := strconv.Atoi(value); err == nil {
+			return json.RawMessage(value)
+		}
+	}
+	b, _ := json.Marshal(value)
+	return b
+}
@@ -0,0 +1,69 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// The prefix of a -vaults value which names a file listing the vaults, as in
+// @/etc/glitchgrid/vaults.txt.
+const vaultFilePrefix = "@"
+
+// How often the vault file is read to see whether it has changed.
+const vaultFilePollInterval = time.Second
+
+// A file listing the vaults, one or more to a line separated by commas, with blank lines and
+// anything after a # ignored, and what it held when we last read it. It is polled rather than
+// watched through the filesystem, so that it works the same on every platform and volume,
+// including a Kubernetes ConfigMap, which is updated by swapping a symlink.
+type fileSource struct {
+	path     string
+	contents []byte
+}
+
+func (src *fileSource) watches() bool { return true }
+
+func (src *fileSource) String() string { return "vault file " + src.path }
+
+// Read the vaults from the file, after the first lookup waiting for its contents to change.
+func (src *fileSource) lookup(ctx context.Context) ([]string, error) {
+	contents, err := os.ReadFile(src.path)
+	if err != nil {
+		src.contents = nil
+		return nil, fmt.Errorf("could not read %s: %v", src, err)
+	}
+	if src.contents != nil {
+		ticker := time.NewTicker(vaultFilePollInterval)
+		defer ticker.Stop()
+		giveUp := time.After(discoveryWait)
+		for bytes.Equal(contents, src.contents) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-giveUp:
+				return parseVaultFile(contents, src.String())
+			case <-ticker.C:
+			}
+			if contents, err = os.ReadFile(src.path); err != nil {
+				src.contents = nil
+				return nil, fmt.Errorf("could not read %s: %v", src, err)
+			}
+		}
+	}
+	src.contents = contents
+	return parseVaultFile(contents, src.String())
+}
+
+// Parse the contents of a vault file.
+func parseVaultFile(contents []byte, source string) ([]string, error) {
+	var vaults []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		vaults = append(vaults, splitVaults(line)...)
+	}
+	return discoveredVaults(vaults, source)
+}
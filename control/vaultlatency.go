@@ -0,0 +1,97 @@
+package control
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// How many of a vault's most recent reads, and writes, its latency and error rate in /v1/status
+// are taken over.
+const latencyWindowSize = 128
+
+// The outcome of one call to a vault.
+type callSample struct {
+	latency time.Duration
+	failed  bool
+}
+
+// A vault's most recent calls of one kind, oldest overwritten first.
+type latencyWindow struct {
+	samples []callSample
+	next    int
+}
+
+func (lw *latencyWindow) add(sample callSample) {
+	if len(lw.samples) < latencyWindowSize {
+		lw.samples = append(lw.samples, sample)
+		return
+	}
+	lw.samples[lw.next] = sample
+	lw.next = (lw.next + 1) % latencyWindowSize
+}
+
+// How a vault's recent calls of one kind went, as reported by the status endpoint.
+type latencySummary struct {
+	Calls     int     `json:"calls"`
+	ErrorRate float64 `json:"errorRate"`
+	P50       float64 `json:"p50Ms"`
+	P90       float64 `json:"p90Ms"`
+	P99       float64 `json:"p99Ms"`
+}
+
+// A vault's recent reads and writes, either of which is nil if there have been none.
+type vaultLatency struct {
+	Read  *latencySummary `json:"read,omitempty"`
+	Write *latencySummary `json:"write,omitempty"`
+}
+
+// Summarize the window, or return nil if it is empty. Failed calls count towards the percentiles
+// as well as the error rate, since a vault which times out is the slowest of all.
+func (lw *latencyWindow) summary() *latencySummary {
+	if len(lw.samples) == 0 {
+		return nil
+	}
+	latencies := make([]time.Duration, len(lw.samples))
+	failed := 0
+	for i, sample := range lw.samples {
+		latencies[i] = sample.latency
+		if sample.failed {
+			failed++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) float64 {
+		return float64(latencies[int(p*float64(len(latencies)-1))]) / float64(time.Millisecond)
+	}
+	return &latencySummary{
+		Calls:     len(latencies),
+		ErrorRate: float64(failed) / float64(len(latencies)),
+		P50:       percentile(0.5),
+		P90:       percentile(0.9),
+		P99:       percentile(0.99),
+	}
+}
+
+// Record a call to a vault made for the client request a context belongs to: in the metrics, for
+// the status endpoint, and for the slow request log. A call we skipped took no time, and is only
+// counted. err is why the call failed or was skipped, if it was.
+func (s *ControlServer) recordVaultCall(ctx context.Context, vault string, op string, result string, err error, latency time.Duration) {
+	s.metrics.vaultCall(vault, op, result, vaultErrorCode(err), latency)
+	noteVaultCall(ctx, vault, op, result, latency)
+	if result == resultSkipped {
+		return
+	}
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	vs, ok := s.vaultStatus[vault]
+	if !ok {
+		return
+	}
+	sample := callSample{latency: latency, failed: result == resultFailure}
+	if op == opRead {
+		vs.reads.add(sample)
+	} else {
+		vs.writes.add(sample)
+	}
+}
@@ -0,0 +1,71 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// One vault's entry in /vaults.
+type vaultOverview struct {
+	Address   string          `json:"address"`
+	Reachable bool            `json:"reachable"`
+	LastValue json.RawMessage `json:"lastValue,omitempty"`
+	// Why the vault was last found down or failed a read, if it has been.
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorCode errorCode `json:"lastErrorCode,omitempty"`
+	// When the vault last passed a health check or answered a read or write, and how long ago.
+	LastSuccess        *time.Time `json:"lastSuccessAt,omitempty"`
+	SinceLastSuccessMs *float64   `json:"sinceLastSuccessMs,omitempty"`
+	// When the health checker last checked the vault, if it has.
+	Checked *time.Time `json:"checkedAt,omitempty"`
+}
+
+// Summarize every configured vault, as JSON, without calling any of them: a vault is reachable if
+// the health checker's latest check, while it is still fresh, found it healthy, and otherwise (or
+// without -health-interval) if the most recent read from it succeeded. The last value is the one
+// the most recent read returned.
+func (s *ControlServer) handleVaults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	now := time.Now()
+	overviews := []vaultOverview{}
+	for _, report := range s.vaultReports() {
+		o := vaultOverview{
+			Address:       report.Address,
+			Reachable:     report.Reachable,
+			LastValue:     report.LastValue,
+			LastError:     report.LastError,
+			LastErrorCode: report.LastErrorCode,
+		}
+		for _, t := range []*time.Time{report.LastSeen, report.LastWrite} {
+			if t != nil && (o.LastSuccess == nil || t.After(*o.LastSuccess)) {
+				o.LastSuccess = t
+			}
+		}
+		if h := report.Health; h != nil {
+			o.Checked = &h.Checked
+			if now.Sub(h.Checked) <= healthFreshIntervals*s.healthInterval {
+				o.Reachable = h.Healthy
+				if !h.Healthy {
+					o.LastError, o.LastErrorCode = h.Error, h.ErrorCode
+				}
+			}
+			if t := h.LastHealthy; t != nil && (o.LastSuccess == nil || t.After(*o.LastSuccess)) {
+				o.LastSuccess = t
+			}
+		}
+		if o.LastSuccess != nil {
+			since := float64(now.Sub(*o.LastSuccess).Microseconds()) / 1000
+			o.SinceLastSuccessMs = &since
+		}
+		overviews = append(overviews, o)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(overviews); err != nil {
+		logf(r.Context(), logWarning, "Could not write vaults response: %v", err)
+	}
+}
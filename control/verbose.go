@@ -0,0 +1,72 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// The body of a verbose read: the aggregated result, and what each vault told us.
+type verboseRead struct {
+	Value    json.RawMessage `json:"value"`
+	Version  int             `json:"version"`
+	Expired  bool            `json:"expired,omitempty"`
+	Agreeing int             `json:"agreeing"`
+	// Why there is no value, if there is none: NO_QUORUM or VALUE_EXPIRED.
+	ErrorCode errorCode      `json:"errorCode,omitempty"`
+	Vaults    []verboseVault `json:"vaults"`
+}
+
+// What a single vault told us during a verbose read.
+type verboseVault struct {
+	Address   string          `json:"address"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	Expired   bool            `json:"expired,omitempty"`
+	LatencyMs float64         `json:"latencyMs"`
+	Error     string          `json:"error,omitempty"`
+	ErrorCode errorCode       `json:"errorCode,omitempty"`
+}
+
+// Send the outcome of a read to the client as JSON, including each vault's response.
+func (s *ControlServer) writeVerbose(w http.ResponseWriter, statusCode int, result readResult, version int) {
+	value := result.value
+	if !result.ok || result.expired {
+		value = s.valueType.missing()
+	}
+	body := verboseRead{
+		Value:    s.valueType.toJSON(value),
+		Version:  version,
+		Expired:  result.ok && result.expired,
+		Agreeing: result.agreeing,
+		Vaults:   []verboseVault{},
+	}
+	for _, read := range result.reads {
+		v := verboseVault{Address: read.vault, LatencyMs: float64(read.latency.Microseconds()) / 1000}
+		if errors.Is(read.err, errValueExpired) {
+			v.Expired = true
+		} else if read.err != nil {
+			v.Error = read.err.Error()
+			v.ErrorCode = vaultErrorCode(read.err)
+		} else {
+			v.Value = s.valueType.toJSON(read.value)
+		}
+		body.Vaults = append(body.Vaults, v)
+	}
+	sort.Slice(body.Vaults, func(i, j int) bool { return body.Vaults[i].Address < body.Vaults[j].Address })
+	if !result.ok {
+		body.ErrorCode = codeNoQuorum
+	} else if result.expired {
+		body.ErrorCode = codeValueExpired
+	}
+	if body.ErrorCode != "" {
+		w.Header().Set(errorCodeHeader, string(body.ErrorCode))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		glog.Warningf("Could not write verbose response: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package control
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Probe every vault once before we start serving, so that the first client requests find
+// connections already open rather than each paying to dial every vault, and so that a vault
+// address which is wrong is reported at startup rather than at the first read. The probes run in
+// parallel and each is bounded by the vault timeout. A vault which does not answer is only
+// warned about, not marked down, since it may simply be starting alongside us.
+func (s *ControlServer) warmUp() {
+	start := time.Now()
+	vaults := s.vaultList()
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	ready := 0
+	for _, vault := range vaults {
+		wg.Add(1)
+		go func(vault string) {
+			defer wg.Done()
+			err := s.checkHealth(vault)
+			var dnsErr *net.DNSError
+			switch {
+			case err == nil:
+				s.recordHealth(vault, nil)
+				lock.Lock()
+				ready++
+				lock.Unlock()
+			case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+				glog.Errorf("Vault %s cannot be resolved; is its address right? %v", vault, err)
+			default:
+				glog.Warningf("Vault %s did not answer while warming up: %v", vault, err)
+			}
+		}(vault)
+	}
+	wg.Wait()
+	glog.Infof("Warmed up connections to %d of %d vaults in %v", ready, len(vaults), time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,110 @@
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The events we tell the webhook about.
+const (
+	eventConsensusLost     = "consensus_lost"
+	eventConsensusRestored = "consensus_restored"
+)
+
+// How many events may wait to be sent to the webhook; any more are dropped, and logged.
+const webhookQueueSize = 16
+
+// How many times we try to send each event to the webhook, and how long we wait for it to answer
+// each time.
+const (
+	webhookAttempts = 3
+	webhookTimeout  = 5 * time.Second
+)
+
+// What we POST to the webhook when the vaults stop or start agreeing again.
+type webhookEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// The control server which saw it, as given by -name.
+	Controller     string        `json:"controller"`
+	Agreeing       int           `json:"agreeing"`
+	MajorityNeeded int           `json:"majorityNeeded"`
+	Vaults         []vaultStatus `json:"vaults"`
+}
+
+// Note whether a quorum read found a majority of the vaults in agreement, and if that is a change,
+// queue an event for the webhook. We start out assuming that the vaults agree, so the first read
+// without consensus alerts.
+func (s *ControlServer) observeConsensus(agreeing int, numVaults int, ok bool) {
+	if s.webhooks == nil {
+		return
+	}
+	// A read at consistency "all" fails with only a majority agreeing, but consensus holds.
+	lost := !ok && (numVaults == 0 || agreeing < majorityOf(numVaults))
+	s.consensusLock.Lock()
+	changed := lost != s.consensusLost
+	s.consensusLost = lost
+	s.consensusLock.Unlock()
+	if !changed {
+		return
+	}
+	event := webhookEvent{
+		Event:          eventConsensusRestored,
+		Time:           time.Now().UTC(),
+		Controller:     s.name,
+		Agreeing:       agreeing,
+		MajorityNeeded: majorityOf(numVaults),
+		Vaults:         s.vaultReports(),
+	}
+	if lost {
+		event.Event = eventConsensusLost
+	}
+	select {
+	case s.webhooks <- event:
+	default:
+		glog.Warningf("Dropped %s webhook event; %d are already waiting to be sent", event.Event, webhookQueueSize)
+	}
+}
+
+// Send queued events to the webhook, one at a time and in order, until we shut down.
+func (s *ControlServer) sendWebhooks() {
+	client := &http.Client{Timeout: webhookTimeout}
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case event := <-s.webhooks:
+			body, _ := json.Marshal(event)
+			var err error
+			for attempt := 1; attempt <= webhookAttempts; attempt++ {
+				if err = postWebhook(client, s.webhookURL, body); err == nil {
+					glog.Infof("Sent %s webhook event", event.Event)
+					break
+				}
+				if attempt < webhookAttempts {
+					time.Sleep(time.Duration(attempt) * time.Second)
+				}
+			}
+			if err != nil {
+				glog.Errorf("Could not send %s webhook event after %d attempts: %v", event.Event, webhookAttempts, err)
+			}
+		}
+	}
+}
+
+func postWebhook(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
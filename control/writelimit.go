@@ -0,0 +1,28 @@
+package control
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// How long we ask a client to wait before retrying a write which we turned away.
+const writeRetryAfterSeconds = 1
+
+// Run a write handler only if fewer than the configured number of writes are in flight, and
+// otherwise answer 429 at once, so that a flood of writes is pushed back onto the clients rather
+// than piling up against the vaults.
+func (s *ControlServer) withWriteLimit(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
+	if s.writes == nil {
+		handler(w, r)
+		return
+	}
+	select {
+	case s.writes <- struct{}{}:
+		defer func() { <-s.writes }()
+		handler(w, r)
+	default:
+		w.Header().Set("Retry-After", fmt.Sprint(writeRetryAfterSeconds))
+		writeProblem(w, http.StatusTooManyRequests, codeTooManyWrites,
+			fmt.Sprintf("Already handling %d writes", cap(s.writes)), Details{"maxWrites": cap(s.writes)})
+	}
+}
@@ -0,0 +1,59 @@
+// Package buildinfo says what the glitchgrid binary was built from, for its version commands and
+// the servers' GET /version.
+package buildinfo
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// What was built, set at build time with e.g.
+//
+//	go build -ldflags "-X antithesis.com/glitch-grid/internal/buildinfo.version=v1.2.0 -X antithesis.com/glitch-grid/internal/buildinfo.commit=$(git rev-parse --short HEAD) -X antithesis.com/glitch-grid/internal/buildinfo.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" .
+//
+// as the Dockerfile does. A plain go build inside the git checkout still finds the commit and its
+// time in the build info Go embeds.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// What GET /version reports.
+type Info struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	// Whether the tree had changes which were not committed.
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Return what this binary was built from, under the name of what it is running as.
+func Current(name string) Info {
+	info := Info{Name: name, Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// Describe what was built on one line, as the version commands print it.
+func (info Info) String() string {
+	return fmt.Sprintf("%s %s (commit %s, built %s, %s)", info.Name, info.Version, info.Commit, info.BuildDate, info.GoVersion)
+}
@@ -0,0 +1,95 @@
+// Package flagconfig sets the control server's and the vault's flags from a configuration file
+// and from the environment, as well as from the command line.
+package flagconfig
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Apply a YAML or TOML configuration file, chosen by its extension, to the flags. Each key names a
+// flag without its dash, e.g. `vault-timeout: 2s`; a nested table's keys are joined to its own
+// name with a dash, so that the control server's `quarantine: {strikes: 3}` sets
+// -quarantine-strikes, and a vault's `wal: {retention-age: 1h}` sets -wal-retention-age; and a
+// list is joined with commas, e.g. for -vaults or -peers. Flags given on the command line, as
+// named in set, keep their values. Any key which does not name a flag is an error, so that a typo
+// is not ignored.
+func ApplyFile(path string, fs *flag.FlagSet, set map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+	var doc map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		return fmt.Errorf("config file %s must end in .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config file: %w", err)
+	}
+	settings := make(map[string]string)
+	flattenConfig("", doc, settings)
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("invalid config file: unknown setting %q", name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, settings[name]); err != nil {
+			return fmt.Errorf("invalid config file: %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Flatten a parsed configuration file into the flags it sets and their values, as they would be
+// written on the command line.
+func flattenConfig(prefix string, value any, settings map[string]string) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if prefix != "" {
+				key = prefix + "-" + key
+			}
+			flattenConfig(key, child, settings)
+		}
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = configScalar(item)
+		}
+		settings[prefix] = strings.Join(items, ",")
+	default:
+		settings[prefix] = configScalar(v)
+	}
+}
+
+// Render a single value from a configuration file as it would be written on the command line.
+func configScalar(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		// Not in exponent form, which the integer flags would reject.
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,41 @@
+package flagconfig
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The prefix of the environment variables which stand in for our flags.
+const envPrefix = "GLITCHGRID_"
+
+// Return the environment variable which stands in for a flag: its name in upper case, with dashes
+// and dots as underscores, after the prefix, e.g. GLITCHGRID_VAULT_TIMEOUT for the control
+// server's -vault-timeout, or GLITCHGRID_DATA_FILE for a vault's -data-file.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(flagName))
+}
+
+// Set each flag not given on the command line, as named in set, from its environment variable, if
+// that is set, adding it to set so that a config file does not override it in turn. Environment
+// variables under the prefix which name no flag are ignored, since some are set by others (such
+// as Kubernetes, for a service named glitchgrid).
+func ApplyEnv(fs *flag.FlagSet, set map[string]bool) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if e := fs.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("invalid %s: %v", envName(f.Name), e)
+			return
+		}
+		set[f.Name] = true
+	})
+	return err
+}
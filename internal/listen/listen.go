@@ -0,0 +1,52 @@
+// Package listen opens the sockets the control server and the vault serve on, as their -listen
+// flags name them.
+package listen
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// The prefix of a -listen address (e.g. "unix:///tmp/vault1.sock") which names a Unix domain
+// socket rather than a TCP host and port.
+const UnixScheme = "unix://"
+
+// Listen on an address: a Unix socket if it has the unix:// prefix, a socket systemd opened for us
+// if it has the systemd: prefix, and otherwise a TCP address. A socket file left behind by an
+// earlier run is removed first.
+func On(addr string) (net.Listener, error) {
+	if name, ok := strings.CutPrefix(addr, SystemdPrefix); ok {
+		return systemdSocket(name)
+	}
+	if path, ok := strings.CutPrefix(addr, UnixScheme); ok {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Return the port of a TCP listen address (e.g. "[::1]:8001"), or zero for a Unix socket. For a
+// socket from systemd, the port is the one it is bound to.
+func Port(addr string) (int, error) {
+	if strings.HasPrefix(addr, UnixScheme) {
+		return 0, nil
+	}
+	if name, ok := strings.CutPrefix(addr, SystemdPrefix); ok {
+		l, err := systemdSocket(name)
+		if err != nil {
+			return 0, err
+		}
+		if tcp, ok := l.Addr().(*net.TCPAddr); ok {
+			return tcp.Port, nil
+		}
+		return 0, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	return net.LookupPort("tcp", port)
+}
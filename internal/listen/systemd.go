@@ -0,0 +1,75 @@
+package listen
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The prefix of a -listen address which takes a socket systemd opened for us, under socket
+// activation, rather than opening one: systemd: for the first it passed, or systemd:<name> for the
+// one its unit names so with FileDescriptorName=.
+const SystemdPrefix = "systemd:"
+
+// The sockets systemd passed us, taken from the environment the first time one is asked for.
+var (
+	systemdOnce    sync.Once
+	systemdSockets []net.Listener
+	systemdNames   []string
+	systemdErr     error
+)
+
+// Take the sockets systemd passed us, as sd_listen_fds does: LISTEN_FDS of them, from file
+// descriptor 3 on, named by LISTEN_FDNAMES, if LISTEN_PID says they are meant for us. The variables
+// are then cleared, so that they do not leak into anything we start.
+func takeSystemdSockets() ([]net.Listener, []string, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil, fmt.Errorf("systemd passed us no sockets: LISTEN_PID is %q, and we are %d", pid, os.Getpid())
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, nil, fmt.Errorf("systemd passed us no sockets: LISTEN_FDS is %q", fds)
+	}
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(3+i), name)
+		// The listener has its own copy of the descriptor, which is not inherited by children.
+		listeners[i], err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("socket %d from systemd is not one we can listen on: %v", 3+i, err)
+		}
+	}
+	return listeners, names, nil
+}
+
+// Return the socket systemd passed us under the given name, or the first if the name is empty.
+func systemdSocket(name string) (net.Listener, error) {
+	systemdOnce.Do(func() {
+		systemdSockets, systemdNames, systemdErr = takeSystemdSockets()
+	})
+	if systemdErr != nil {
+		return nil, systemdErr
+	}
+	if name == "" {
+		return systemdSockets[0], nil
+	}
+	for i, l := range systemdSockets {
+		if i < len(systemdNames) && systemdNames[i] == name {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("systemd passed us no socket named %q, only %q", name, strings.Join(systemdNames, ", "))
+}
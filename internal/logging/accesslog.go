@@ -0,0 +1,65 @@
+// Package logging holds the logging the control server and the vault share: the access log, and
+// glog's verbosity, which both let operators change while they run.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"antithesis.com/glitch-grid/internal/metrics"
+)
+
+// Where we log every request we answer, one line each.
+type AccessLog struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+// Open the access log at path: "-" for stdout, or a file, appended to if it exists. An empty path
+// means no access log, and returns nil.
+func OpenAccessLog(path string) (*AccessLog, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return &AccessLog{w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open access log: %w", err)
+	}
+	return &AccessLog{w: f}, nil
+}
+
+// Wrap a handler so that each request it answers is logged once done, with when it arrived, who
+// sent it, what it asked for, its status, the size of the body we sent back, how long it took,
+// and its request ID, as found by id, e.g.
+//
+//	2026-10-14T09:27:28.714Z 127.0.0.1:53732 "POST /v1/value HTTP/1.1" 200 1 0.072ms id="abc-123"
+//
+// The ID is left out if the request has none. A nil access log leaves the handler alone.
+func (a *AccessLog) Wrap(next http.Handler, id func(*http.Request) string) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &metrics.StatusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.StatusCode == 0 {
+			rec.StatusCode = http.StatusOK
+		}
+		line := fmt.Sprintf("%s %s %q %d %d %.3fms", start.UTC().Format("2006-01-02T15:04:05.000Z"), r.RemoteAddr,
+			r.Method+" "+r.URL.RequestURI()+" "+r.Proto, rec.StatusCode, rec.Bytes, float64(time.Since(start))/float64(time.Millisecond))
+		if id := id(r); id != "" {
+			line += fmt.Sprintf(" id=%q", id)
+		}
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		io.WriteString(a.w, line+"\n")
+	})
+}
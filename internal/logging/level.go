@@ -0,0 +1,22 @@
+package logging
+
+import (
+	"flag"
+	"strconv"
+)
+
+// The highest glog verbosity we accept; nothing logs above V(2), so this is plenty.
+const MaxLevel = 10
+
+// Return how verbosely we log: glog's -v.
+func Level() int {
+	level, _ := strconv.Atoi(flag.Lookup("v").Value.String())
+	return level
+}
+
+// Change how verbosely we log, from now on, returning the level we logged at before.
+func SetLevel(level int) int {
+	previous := Level()
+	flag.Set("v", strconv.Itoa(level))
+	return previous
+}
@@ -0,0 +1,54 @@
+// Package metrics holds what the control server's and the vault's Prometheus metrics have in
+// common: a registry which also exports the Go runtime's and the process's own metrics, its
+// handler, and a way to see what each request was answered with.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Return a registry for a server's metrics, already holding the Go runtime's and the process's.
+func NewRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return registry
+}
+
+// Return the handler for /metrics, serving what is in a registry.
+func Handler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Captures the status code and body size written by a handler, while passing everything through
+// to the client. A status of zero means the handler has written nothing yet.
+type StatusRecorder struct {
+	http.ResponseWriter
+	StatusCode int
+	Bytes      int64
+}
+
+func (rec *StatusRecorder) WriteHeader(statusCode int) {
+	if rec.StatusCode == 0 {
+		rec.StatusCode = statusCode
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *StatusRecorder) Write(b []byte) (int, error) {
+	if rec.StatusCode == 0 {
+		rec.StatusCode = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.Bytes += int64(n)
+	return n, err
+}
+
+// Return the writer we record, so that http.ResponseController can reach what it offers besides
+// writing, such as hijacking the connection.
+func (rec *StatusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
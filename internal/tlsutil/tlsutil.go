@@ -0,0 +1,25 @@
+// Package tlsutil holds what the control server and the vault share for talking TLS to the
+// servers they call.
+package tlsutil
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// Return the certificate authorities in a PEM file, as well as the system's.
+func LoadCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,6 @@
+// Package vaultpb holds the code generated from proto/vault.proto, which the control server
+// calls and the vault serves. It is its own package so that both can be linked into one binary:
+// the protobuf runtime refuses to register the same .proto file twice.
+package vaultpb
+
+//go:generate protoc --proto_path=../../proto --go_out=. --go_opt=paths=source_relative --go_opt=Mvault.proto=antithesis.com/glitch-grid/internal/vaultpb;vaultpb --go-grpc_out=. --go-grpc_opt=paths=source_relative --go-grpc_opt=Mvault.proto=antithesis.com/glitch-grid/internal/vaultpb;vaultpb vault.proto
@@ -0,0 +1,50 @@
+// The glitchgrid binary, which runs as either of the grid's roles: the control server, which
+// clients call, or one of the vaults it keeps the value in. It lives at the root of the module,
+// where the Antithesis instrumentor puts its catalog of assertions, so that the catalog is built
+// into it.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"antithesis.com/glitch-grid/control"
+	"antithesis.com/glitch-grid/internal/buildinfo"
+	"antithesis.com/glitch-grid/vault"
+)
+
+// The roles this binary runs as, given as its first argument, each with its own commands and flags.
+const usage = `Usage: %s <role> [command] [flags]
+
+Roles:
+  control   Run the control server, or one of its other commands
+  vault     Run a vault, or one of its other commands
+
+Commands:
+  version   Print what this binary was built from
+  help      Print this message
+
+Run "%s <role> help" for the commands of a role.
+`
+
+func main() {
+	name := os.Args[0]
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, usage, name, name)
+		os.Exit(2)
+	}
+	role, args := os.Args[1], os.Args[2:]
+	switch role {
+	case "control":
+		control.Main(name+" control", args)
+	case "vault":
+		vault.Main(name+" vault", args)
+	case "version":
+		fmt.Println(buildinfo.Current("glitchgrid"))
+	case "help", "-h", "-help", "--help":
+		fmt.Printf(usage, name, name)
+	default:
+		fmt.Printf("unknown role %q; run %s help for the roles\n", role, name)
+		os.Exit(2)
+	}
+}
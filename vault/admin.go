@@ -0,0 +1,40 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// Report or change whether the vault is in read-only maintenance mode, during which it keeps
+// serving reads (and so stays in the read quorum) but refuses writes with a 503.
+// GET reports the mode; POST with `?enabled=true|false` changes it.
+func (s *VaultServer) handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid or missing enabled parameter"))
+			return
+		}
+		s.lock.Lock()
+		s.readOnly = enabled
+		s.lock.Unlock()
+		glog.Infof("Vault :%d read-only mode: %v", s.port, enabled)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	s.lock.Lock()
+	readOnly := s.readOnly
+	s.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"read_only": readOnly})
+}
@@ -0,0 +1,38 @@
+package vault
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/golang/glog"
+
+	"antithesis.com/glitch-grid/internal/listen"
+)
+
+// Serve the profiling endpoints of net/http/pprof under /debug/pprof/ on a listener of their own,
+// apart from the data port, so that CPU, heap and goroutine profiles can be taken during a load
+// test without exposing them to clients, along with admin, our metrics and admin endpoints. The
+// address should be one which only operators can reach, e.g. localhost:6061, so that fault
+// injection and the like can be firewalled apart from the data port, and never queue behind the
+// control server's calls.
+func serveAdminPort(addr string, admin http.Handler) error {
+	l, err := listen.On(addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on admin address %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/", admin)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			glog.Errorf("Admin listener stopped: %v", err)
+		}
+	}()
+	glog.Infof("Serving profiles and the admin endpoints on %s", addr)
+	return nil
+}
@@ -0,0 +1,40 @@
+package vault
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Check that a request which changes our state carries the shared secret, responding with a 401
+// if not. If no secret is configured, anyone who can reach us may write, as before.
+func (s *VaultServer) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if s.authToken == "" {
+		return true
+	}
+	if !s.hasToken(r.Header.Get("Authorization")) {
+		glog.Warningf("Rejected unauthorized %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		s.metrics.rejected.WithLabelValues(rejectUnauthorized).Inc()
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Missing or invalid token"))
+		return false
+	}
+	return true
+}
+
+// Return whether an Authorization header (or gRPC metadata) carries the shared secret, which it
+// cannot if we have none.
+func (s *VaultServer) hasToken(authorization string) bool {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	return ok && s.authToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.authToken)) == 1
+}
+
+// Add the shared secret, if we have one, to a request we send to a peer.
+func (s *VaultServer) addAuth(req *http.Request) {
+	if s.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.authToken)
+	}
+}
@@ -0,0 +1,125 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The path of the compare-and-swap endpoint for the value at the root path; named keys are at
+// /cas/<name>.
+const casPath = "/cas"
+
+// Returned when a compare-and-swap finds a value other than the one it expected.
+var errPreconditionFailed = errors.New("value does not match the expected value")
+
+// The body of a compare-and-swap request.
+type casRequest struct {
+	// The value the key must hold for the swap to happen. An expired value counts as the key's
+	// initial value, as does a key which has never been written.
+	Expected string `json:"expected"`
+	// The value to store in its place.
+	Value string `json:"value"`
+}
+
+// Atomically replace a key's value with a new one, only if it currently holds the expected value,
+// so that higher-level protocols (two-phase commit, Paxos, fencing) can be built on conditional
+// updates rather than blind overwrites. Responds with the new value on success, and a 412 with the
+// current value if it did not match. Accepts the same TTL and sequence number headers as a write.
+func (s *VaultServer) handleCAS(w http.ResponseWriter, r *http.Request) {
+	key := defaultKey
+	if r.URL.Path != casPath {
+		name, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, casPath+"/"))
+		if err != nil || name == "" {
+			http.NotFound(w, r)
+			return
+		}
+		key = name
+	}
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.authorize(w, r) {
+		return
+	}
+	var req casRequest
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		s.metrics.rejected.WithLabelValues(rejectBadRequest).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid compare-and-swap request"))
+		return
+	}
+	ttl, sequence, ok := s.writeHeaders(w, r)
+	if !ok {
+		return
+	}
+	expected, err1 := s.validValue([]byte(req.Expected))
+	value, err2 := s.validValue([]byte(req.Value))
+	if err1 != nil || err2 != nil {
+		s.metrics.rejected.WithLabelValues(rejectBadRequest).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid expected or new value"))
+		return
+	}
+	writer := r.Header.Get(writerHeader)
+	if writer == "" {
+		writer = r.RemoteAddr
+	}
+	v := storedValue{Value: value, Sequence: sequence, Writer: writer}
+	if ttl > 0 {
+		v.Expires = time.Now().Add(ttl)
+	}
+	var current []byte
+	err = s.writeIf(key, v, r.RemoteAddr, false, func(k *slot) error {
+		current = k.value
+		if k.expired {
+			current = s.initialValue()
+		}
+		if string(current) != string(expected) {
+			return errPreconditionFailed
+		}
+		return nil
+	})
+	if errors.Is(err, errPreconditionFailed) {
+		s.metrics.rejected.WithLabelValues(rejectPrecondition).Inc()
+		glog.V(1).Infof("Compare-and-swap of Vault :%d %s failed: expected %q, found %q", s.port, keyName(key), expected, current)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		w.Write(current)
+		return
+	}
+	if err != nil {
+		s.writeFailed(w, err)
+		return
+	}
+	glog.Infof("Swapped Vault :%d %s from %q to %q", s.port, keyName(key), expected, value)
+	if r.Header.Get(replicatedHeader) == "" {
+		// Peers take the new value unconditionally, as they do for any other write.
+		s.replicate(key, value, ttl, sequence, writer)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(value)
+}
+
+// Return a value as we would store it, or errInvalidValue if it is not valid for this vault.
+func (s *VaultServer) validValue(value []byte) ([]byte, error) {
+	if s.valueType == valueTypeBlob {
+		return value, nil
+	}
+	n, err := strconv.Atoi(string(value))
+	if err != nil || n < 0 {
+		return nil, errInvalidValue
+	}
+	return []byte(strconv.Itoa(n)), nil
+}
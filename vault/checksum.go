@@ -0,0 +1,24 @@
+package vault
+
+import (
+	"hash/crc32"
+	"net/http"
+)
+
+// The status with which we answer a read whose value no longer matches its checksum, so that the
+// control server can tell bit-rot apart from a vault which simply disagrees with the others.
+const corruptedStatus = http.StatusUnprocessableEntity
+
+// The checksum stored alongside every value.
+func checksum(value []byte) uint32 {
+	return crc32.ChecksumIEEE(value)
+}
+
+// Return the checksum recorded for a value, or compute one if none was recorded (e.g. it was
+// persisted before we kept checksums).
+func recordedChecksum(recorded *uint32, value []byte) uint32 {
+	if recorded != nil {
+		return *recorded
+	}
+	return checksum(value)
+}
@@ -0,0 +1,58 @@
+package vault
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The commands the vault runs, given after its name, e.g. glitchgrid vault serve. With none, or
+// with flags straight away, it serves, as it did before it had commands.
+const commandsUsage = `Usage: %s [command] [flags]
+
+Commands:
+  serve     Run the vault (the default)
+  check     Check the flags and the files they name, as serve would, then exit
+  version   Print what this binary was built from
+  help      Print this message
+
+Run "%s serve -h" for the flags; check takes the same ones. To benchmark a vault, run the control
+server's bench command against it.
+`
+
+// Print the commands, under the name we were run as, then the flags of serve, which are defined by
+// then.
+func usage(name string) {
+	fmt.Fprintf(flag.CommandLine.Output(), commandsUsage, name, name)
+	fmt.Fprintf(flag.CommandLine.Output(), "\nFlags of serve:\n")
+	flag.PrintDefaults()
+}
+
+// Print what this binary was built from, on one line.
+func printVersion() {
+	fmt.Println(currentBuild())
+}
+
+// Run the vault's command line: args are what follow name, the way it was run, e.g.
+// "glitchgrid vault".
+func Main(name string, args []string) {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		runServer(name, args, false)
+		return
+	}
+	command, args := args[0], args[1:]
+	switch command {
+	case "serve":
+		runServer(name, args, false)
+	case "check":
+		runServer(name, args, true)
+	case "version":
+		printVersion()
+	case "help":
+		fmt.Printf(commandsUsage, name, name)
+	default:
+		fmt.Printf("unknown command %q; run %s help for the commands\n", command, name)
+		os.Exit(2)
+	}
+}
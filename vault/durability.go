@@ -0,0 +1,98 @@
+package vault
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// How hard the vault tries to make sure an acknowledged write survives a crash.
+type durability string
+
+const (
+	// Never fsync: writes reach the operating system, but may be lost if the machine crashes.
+	durabilityNone durability = "none"
+	// Fsync every write before acknowledging it. The slowest, and the only level under which no
+	// acknowledged write can be lost.
+	durabilityFsync durability = "fsync"
+	// Fsync in the background at a fixed interval, so a crash loses at most that much.
+	durabilityBatch durability = "fsync-batch"
+)
+
+func parseDurability(s string) (durability, error) {
+	switch d := durability(s); d {
+	case durabilityNone, durabilityFsync, durabilityBatch:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown durability %q", s)
+}
+
+// Fsyncs something periodically, if it has been written since the last time, for the
+// fsync-batch durability level.
+type batchSyncer struct {
+	dirty bool
+	lock  sync.Mutex
+	sync  func() error
+}
+
+// Start syncing at the given interval, calling sync whenever we have been marked dirty.
+func newBatchSyncer(interval time.Duration, sync func() error) *batchSyncer {
+	b := &batchSyncer{sync: sync}
+	go func() {
+		for range time.Tick(interval) {
+			if err := b.flush(); err != nil {
+				glog.Errorf("Batched fsync failed: %v", err)
+			}
+		}
+	}()
+	return b
+}
+
+// Note that there is something to sync.
+func (b *batchSyncer) markDirty() {
+	b.lock.Lock()
+	b.dirty = true
+	b.lock.Unlock()
+}
+
+// Sync now, if there is anything to sync.
+func (b *batchSyncer) flush() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.dirty {
+		return nil
+	}
+	if err := b.sync(); err != nil {
+		// Leave it dirty, so that we try again next time.
+		return err
+	}
+	b.dirty = false
+	return nil
+}
+
+// Fsync a directory, so that renames and creations within it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Fsync a file and the directory containing it.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
@@ -0,0 +1,143 @@
+package vault
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Faults injected into a running vault through the admin API, as JSON.
+type faultSpec struct {
+	// Delay added to every read and write (e.g. "250ms").
+	Latency string `json:"latency,omitempty"`
+	// Fraction of reads and writes, from 0 to 1, answered with a 500.
+	ErrorRate float64 `json:"error_rate,omitempty"`
+	// Fraction of reads and writes, from 0 to 1, whose connection is dropped without a response.
+	ResetRate float64 `json:"reset_rate,omitempty"`
+	// If set when injecting faults, flip a bit of every stored value without updating its
+	// checksum, as if it had rotted. This happens once, and is not reported back.
+	Corrupt bool `json:"corrupt,omitempty"`
+}
+
+// The faults currently being injected.
+type faults struct {
+	latency   time.Duration
+	errorRate float64
+	resetRate float64
+}
+
+func (f faults) spec() faultSpec {
+	spec := faultSpec{ErrorRate: f.errorRate, ResetRate: f.resetRate}
+	if f.latency > 0 {
+		spec.Latency = f.latency.String()
+	}
+	return spec
+}
+
+// Inject faults into the vault without restarting it, for chaos experiments:
+// - GET /admin/faults reports the faults currently being injected;
+// - POST /admin/faults replaces them with those in the body (and corrupts the values if asked);
+// - DELETE /admin/faults stops injecting faults.
+// The fault API requires the vault's auth token, and is disabled if there is none.
+func (s *VaultServer) handleFaults(w http.ResponseWriter, r *http.Request) {
+	if s.authToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.authorize(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid or missing POST body"))
+			return
+		}
+		var spec faultSpec
+		var f faults
+		if err := json.Unmarshal(body, &spec); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid faults"))
+			return
+		}
+		if spec.Latency != "" {
+			if f.latency, err = time.ParseDuration(spec.Latency); err != nil || f.latency < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Invalid latency"))
+				return
+			}
+		}
+		if spec.ErrorRate < 0 || spec.ErrorRate > 1 || spec.ResetRate < 0 || spec.ResetRate > 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Rates must be between 0 and 1"))
+			return
+		}
+		f.errorRate, f.resetRate = spec.ErrorRate, spec.ResetRate
+		s.lock.Lock()
+		s.faults = f
+		s.lock.Unlock()
+		if spec.Corrupt {
+			s.corruptAll()
+		}
+		glog.Warningf("Injecting faults into Vault :%d: %+v", s.port, spec)
+	case http.MethodDelete:
+		s.lock.Lock()
+		s.faults = faults{}
+		s.lock.Unlock()
+		glog.Infof("Stopped injecting faults into Vault :%d", s.port)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	s.lock.Lock()
+	spec := s.faults.spec()
+	s.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(spec)
+}
+
+// Flip a bit of every stored value, leaving its checksum alone, so that reads see bit-rot.
+func (s *VaultServer) corruptAll() {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+	for _, k := range s.keys {
+		k.lock.Lock()
+		k.value = s.flipBit(k)
+		k.lock.Unlock()
+	}
+}
+
+// Wrap a handler on the data path so that it suffers whatever faults are being injected.
+func (s *VaultServer) withFaults(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		f := s.faults
+		s.lock.Unlock()
+		if f.latency > 0 {
+			time.Sleep(f.latency)
+		}
+		if f.resetRate > 0 && rand.Float64() < f.resetRate {
+			// The writer may be wrapped, by the request or access log, so hijack it through a
+			// controller, which unwraps it to the connection's own.
+			if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+				glog.Warningf("Injected fault: resetting connection from %s", r.RemoteAddr)
+				conn.Close()
+				return
+			}
+		}
+		if f.errorRate > 0 && rand.Float64() < f.errorRate {
+			glog.Warningf("Injected fault: failing %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Injected fault"))
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,65 @@
+package vault
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// The ways in which a vault may deliberately serve the wrong value.
+const (
+	// Flip a random bit of the value.
+	glitchFlip = "flip"
+	// Serve the value from before the most recent write.
+	glitchStale = "stale"
+	// Serve random bytes instead of the value.
+	glitchGarbage = "garbage"
+)
+
+// Check that the glitch flags make sense.
+func validateGlitch(rate float64, mode string) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("glitch rate %v must be between 0 and 1", rate)
+	}
+	if mode != glitchFlip && mode != glitchStale && mode != glitchGarbage {
+		return fmt.Errorf("unknown glitch mode %q", mode)
+	}
+	return nil
+}
+
+// Decide whether this read of a key should glitch and, if so, return the wrong value to serve
+// instead of the real one. The caller must hold the key's lock.
+func (s *VaultServer) maybeGlitch(k *slot) ([]byte, bool) {
+	if s.glitchRate == 0 || rand.Float64() >= s.glitchRate {
+		return nil, false
+	}
+	var glitched []byte
+	switch s.glitchMode {
+	case glitchFlip:
+		glitched = s.flipBit(k)
+	case glitchStale:
+		glitched = k.previous
+	case glitchGarbage:
+		glitched = make([]byte, 1+rand.Intn(16))
+		rand.Read(glitched)
+	}
+	glog.Warningf("Glitching Vault :%d read of %s (%s): serving %q instead of %q", s.port, keyName(k.key), s.glitchMode, glitched, k.value)
+	return glitched, true
+}
+
+// Return a key's current value with a single random bit flipped. In integer mode the result is still a
+// valid non-negative integer, so the glitch can only be spotted by comparing against other vaults.
+func (s *VaultServer) flipBit(k *slot) []byte {
+	if s.valueType == valueTypeInt {
+		n, _ := strconv.Atoi(string(k.value))
+		return []byte(strconv.Itoa(n ^ (1 << rand.Intn(31))))
+	}
+	if len(k.value) == 0 {
+		return []byte{byte(1 << rand.Intn(8))}
+	}
+	glitched := append([]byte(nil), k.value...)
+	glitched[rand.Intn(len(glitched))] ^= byte(1 << rand.Intn(8))
+	return glitched
+}
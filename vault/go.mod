@@ -1,5 +0,0 @@
-module antithesis.com/glitch-grid-vault
-
-go 1.20
-
-require github.com/golang/glog v1.2.0
@@ -0,0 +1,60 @@
+package vault
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Every interval, pull the snapshots of up to fanout random peers and adopt any key for which a
+// peer has a write with a higher sequence number than ours. Since every vault does the same, a
+// write which reached any vault spreads epidemically to all of them, even if the control server
+// and replication both missed some.
+func (s *VaultServer) gossipEvery(interval time.Duration, fanout int) {
+	go func() {
+		for range time.Tick(interval) {
+			peers := append([]string(nil), s.peers...)
+			rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+			if len(peers) > fanout {
+				peers = peers[:fanout]
+			}
+			for _, peer := range peers {
+				if err := s.gossipWith(peer); err != nil {
+					glog.V(1).Infof("Could not gossip with peer %s: %v", peer, err)
+				}
+			}
+		}
+	}()
+}
+
+// Adopt the keys for which a peer has newer writes than ours.
+func (s *VaultServer) gossipWith(peer string) error {
+	keys, err := s.fetchSnapshot(peer)
+	if err != nil {
+		return err
+	}
+	for key, ks := range keys {
+		if ks.Value == nil {
+			ks.Value = []byte{}
+		}
+		v := storedValue{Value: ks.Value, Expires: ks.Expires, Sequence: ks.Sequence, Written: ks.Written, Writer: ks.Writer}
+		var ours int64
+		err := s.writeIf(key, v, peer, false, func(k *slot) error {
+			ours = k.sequence
+			if ks.Sequence <= k.sequence {
+				return errStaleSequence
+			}
+			return nil
+		})
+		if errors.Is(err, errStaleSequence) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		s.metrics.repairs.Inc()
+		glog.Infof("Gossip: Vault :%d adopted %s %q at sequence %d (was %d) from peer %s", s.port, keyName(key), ks.Value, ks.Sequence, ours, peer)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"antithesis.com/glitch-grid/internal/vaultpb"
+)
+
+// Serves the same reads and writes as the root path and /keys/, over gRPC. Failures are reported
+// with typed status codes rather than HTTP statuses, and a caller's deadline is honoured.
+type vaultService struct {
+	vaultpb.UnimplementedVaultServiceServer
+	s *VaultServer
+}
+
+// Create a gRPC server for the vault, with the same rate limits and faults as the HTTP interface.
+func (s *VaultServer) newGRPCServer() *grpc.Server {
+	g := grpc.NewServer(grpc.ChainUnaryInterceptor(grpcRequestLog, s.grpcRateLimit, s.grpcFaults))
+	vaultpb.RegisterVaultServiceServer(g, &vaultService{s: s})
+	return g
+}
+
+func (v *vaultService) Get(ctx context.Context, req *vaultpb.GetRequest) (*vaultpb.GetResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	value, meta, err := v.s.read(req.Key)
+	switch {
+	case errors.Is(err, errUnknownKey), errors.Is(err, errExpired):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errCorrupted):
+		return nil, status.Error(codes.DataLoss, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &vaultpb.GetResponse{Value: value, Sequence: meta.Sequence, Writer: meta.Writer}
+	if !meta.Written.IsZero() {
+		resp.WrittenUnixNanos = meta.Written.UnixNano()
+	}
+	return resp, nil
+}
+
+func (v *vaultService) Set(ctx context.Context, req *vaultpb.SetRequest) (*vaultpb.SetResponse, error) {
+	if err := v.s.authorizeGRPC(ctx); err != nil {
+		return nil, err
+	}
+	if req.TtlMillis < 0 || req.Sequence < 0 {
+		v.s.metrics.rejected.WithLabelValues(rejectBadRequest).Inc()
+		return nil, status.Error(codes.InvalidArgument, "TTL and sequence number may not be negative")
+	}
+	if err := ctx.Err(); err != nil {
+		// Do not apply a write whose caller has already given up on it.
+		return nil, status.FromContextError(err).Err()
+	}
+	from := "grpc"
+	if p, ok := peer.FromContext(ctx); ok {
+		from = p.Addr.String()
+	}
+	ttl := time.Duration(req.TtlMillis) * time.Millisecond
+	err := v.s.set(req.Key, req.Value, ttl, req.Sequence, from, req.Writer, true)
+	if errors.Is(err, errInvalidValue) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		v.s.metrics.rejected.WithLabelValues(rejectReason(err)).Inc()
+		switch {
+		case errors.Is(err, errStaleSequence):
+			glog.Warningf("Refusing write: %v", err)
+			return nil, status.Error(codes.Aborted, err.Error())
+		case errors.Is(err, errReadOnly), errors.Is(err, errDraining):
+			return nil, status.Error(codes.Unavailable, err.Error())
+		default:
+			glog.Errorf("Could not persist value: %v", err)
+			return nil, status.Error(codes.Internal, "could not persist value")
+		}
+	}
+	return &vaultpb.SetResponse{}, nil
+}
+
+// Check that a write carries the shared secret as `authorization: Bearer <token>` metadata, as
+// authorize does for HTTP requests.
+func (s *VaultServer) authorizeGRPC(ctx context.Context) error {
+	if s.authToken == "" {
+		return nil
+	}
+	if !s.hasToken(grpcAuthorization(ctx)) {
+		glog.Warningf("Rejected unauthorized gRPC write")
+		s.metrics.rejected.WithLabelValues(rejectUnauthorized).Inc()
+		return status.Error(codes.Unauthenticated, "missing or invalid token")
+	}
+	return nil
+}
+
+// Return the authorization metadata of a gRPC call, if any.
+func grpcAuthorization(ctx context.Context) string {
+	if md, found := metadata.FromIncomingContext(ctx); found {
+		if values := md.Get("authorization"); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// Inject the faults configured through the admin API into gRPC calls. Latency is cut short by the
+// caller's deadline, and both errors and resets surface as UNAVAILABLE, since gRPC gives us no way
+// to drop the connection from inside a call.
+func (s *VaultServer) grpcFaults(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	s.lock.Lock()
+	f := s.faults
+	s.lock.Unlock()
+	if f.latency > 0 {
+		select {
+		case <-time.After(f.latency):
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if rate := f.errorRate + f.resetRate; rate > 0 && rand.Float64() < rate {
+		glog.Warningf("Injected fault: failing %s", info.FullMethod)
+		return nil, status.Error(codes.Unavailable, "injected fault")
+	}
+	return handler(ctx, req)
+}
@@ -0,0 +1,66 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// The answer to a health check, as JSON.
+type healthReport struct {
+	// "ok", "degraded" if we could not persist the most recent write, or "draining" if we are
+	// shutting down.
+	Status    string        `json:"status"`
+	Port      int           `json:"port"`
+	ValueType string        `json:"value_type"`
+	Storage   storageHealth `json:"storage"`
+	// Whether we are in read-only maintenance mode.
+	ReadOnly bool `json:"read_only"`
+	// When we last accepted a write, if ever.
+	LastWrite *time.Time `json:"last_write,omitempty"`
+}
+
+// How the vault persists its value, and whether that is working.
+type storageHealth struct {
+	// Where the value is kept: "memory", "file", "mmap" or "sqlite".
+	Kind string `json:"kind"`
+	WAL  bool   `json:"wal"`
+	// How hard we try to make sure acknowledged writes survive a crash.
+	Durability durability `json:"durability"`
+	// The error from the most recent failed attempt to persist a write, cleared once one succeeds.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Report whether the vault is alive and able to persist writes, without touching the value.
+// Responds with a 503 if storage is failing or we are shutting down, since the vault cannot
+// acknowledge writes.
+func (s *VaultServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.NotFound(w, r)
+		return
+	}
+	report := healthReport{Status: "ok", Port: s.port, ValueType: s.valueType}
+	report.Storage.Kind = s.storageKind
+	report.Storage.WAL = s.wal != nil
+	report.Storage.Durability = s.durability
+	s.lock.Lock()
+	if !s.lastWrite.IsZero() {
+		lastWrite := s.lastWrite
+		report.LastWrite = &lastWrite
+	}
+	report.Storage.LastError = s.storageError
+	report.ReadOnly = s.readOnly
+	draining := s.draining
+	s.lock.Unlock()
+	statusCode := http.StatusOK
+	if draining {
+		report.Status = "draining"
+		statusCode = http.StatusServiceUnavailable
+	} else if report.Storage.LastError != "" {
+		report.Status = "degraded"
+		statusCode = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,173 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The key stored at the root path, which is the one the control server reads and writes.
+const defaultKey = ""
+
+// Named keys are addressed as /keys/<name>.
+const keysPrefix = "/keys/"
+
+// The value stored under one key, with its own lock so that writes to different keys do not
+// contend with each other.
+type slot struct {
+	key   string
+	value []byte
+	// The checksum of the value as written, which must still match it when it is read.
+	checksum uint32
+	// The value before the most recent write, which a stale glitch serves.
+	previous []byte
+	// Set once a value written with a TTL expires, until the next write.
+	expired bool
+	// Counts writes, so that an expiry timer can tell whether its value has since been replaced.
+	writes int
+	// When the current value expires, if it was written with a TTL.
+	expires time.Time
+	// The highest sequence number of any write we have applied to this key.
+	sequence int64
+	// When the current value was written, and by whom, if we know.
+	written time.Time
+	writer  string
+	lock    sync.Mutex
+}
+
+// A slot which writes to a key which has never been written are creating, shared by them until
+// one succeeds and publishes it, and unseen by anything else until then, so that a write which is
+// refused or fails leaves no key behind. Counts the writes using it, so that it is forgotten once
+// the last of them has failed.
+type pendingSlot struct {
+	slot    *slot
+	writers int
+}
+
+// Return the slot for a key, creating it (with the initial value) if create is set; otherwise,
+// return nil if the key has never been written.
+func (s *VaultServer) slot(key string, create bool) *slot {
+	s.keysLock.RLock()
+	k := s.keys[key]
+	s.keysLock.RUnlock()
+	if k != nil || !create {
+		return k
+	}
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+	if k = s.keys[key]; k == nil {
+		k = s.newSlot(key)
+		s.keys[key] = k
+	}
+	return k
+}
+
+// Create the slot for a key, holding the initial value.
+func (s *VaultServer) newSlot(key string) *slot {
+	k := &slot{key: key, value: s.initialValue()}
+	k.checksum = checksum(k.value)
+	k.previous = k.value
+	return k
+}
+
+// Return the slot a write to a key goes to: the key's own, or, if it has never been written, a
+// pending one. The write must call finishWrite once it is done with the slot.
+func (s *VaultServer) slotForWrite(key string) *slot {
+	if k := s.slot(key, false); k != nil {
+		return k
+	}
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+	if k := s.keys[key]; k != nil {
+		return k
+	}
+	p := s.pendingKeys[key]
+	if p == nil {
+		p = &pendingSlot{slot: s.newSlot(key)}
+		s.pendingKeys[key] = p
+	}
+	p.writers++
+	return p.slot
+}
+
+// Publish a pending slot once a write to it has succeeded, or forget it once every write to it
+// has failed. The caller must not hold the slot's lock.
+func (s *VaultServer) finishWrite(key string, k *slot, ok bool) {
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+	p := s.pendingKeys[key]
+	if p == nil || p.slot != k {
+		// The slot was published already, by this write or another.
+		return
+	}
+	p.writers--
+	if ok {
+		s.keys[key] = k
+		delete(s.pendingKeys, key)
+	} else if p.writers == 0 {
+		delete(s.pendingKeys, key)
+	}
+}
+
+// The value of a key which has never been written.
+func (s *VaultServer) initialValue() []byte {
+	if s.valueType == valueTypeBlob {
+		return []byte{}
+	}
+	return []byte("0")
+}
+
+// The path at which a key is read and written.
+func keyPath(key string) string {
+	if key == defaultKey {
+		return "/"
+	}
+	return keysPrefix + url.PathEscape(key)
+}
+
+// A human-readable name for a key, for the logs.
+func keyName(key string) string {
+	if key == defaultKey {
+		return "value"
+	}
+	return "key " + key
+}
+
+// Handle GET and POST requests to /keys/<name>, and list the named keys on GET /keys/.
+func (s *VaultServer) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, keysPrefix)
+	if key == "" {
+		if r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		s.listKeys(w)
+		return
+	}
+	if r.Method == http.MethodGet {
+		s.get(w, r, key)
+	} else if r.Method == http.MethodPost {
+		s.post(w, r, key)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// Respond with the names of the keys which have been written, sorted, as a JSON array.
+func (s *VaultServer) listKeys(w http.ResponseWriter) {
+	s.keysLock.RLock()
+	names := make([]string, 0, len(s.keys))
+	for key := range s.keys {
+		if key != defaultKey {
+			names = append(names, key)
+		}
+	}
+	s.keysLock.RUnlock()
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
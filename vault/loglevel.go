@@ -0,0 +1,40 @@
+package vault
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"antithesis.com/glitch-grid/internal/logging"
+)
+
+// Report or change how verbosely the vault logs (glog's -v), without restarting, e.g. to log
+// every read carrying a request ID during an incident. GET reports the level; PUT sets it to the
+// level in the body.
+func (s *VaultServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		level, e := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err != nil || e != nil || level < 0 || level > logging.MaxLevel {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid or missing log level"))
+			return
+		}
+		logging.SetLevel(level)
+		glog.Infof("Vault :%d log level: %d", s.port, level)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"level": logging.Level()})
+}
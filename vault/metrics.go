@@ -0,0 +1,103 @@
+package vault
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"antithesis.com/glitch-grid/internal/metrics"
+)
+
+// Why a vault refused a write, as the "reason" label of the rejected writes counter.
+const (
+	rejectBadRequest    = "bad_request"
+	rejectStaleSequence = "stale_sequence"
+	rejectStorage       = "storage"
+	rejectReadOnly      = "read_only"
+	rejectUnauthorized  = "unauthorized"
+	rejectDraining      = "draining"
+	rejectPrecondition  = "precondition"
+)
+
+// Which endpoint a client was calling when it was throttled, as the "endpoint" label of the
+// throttled requests counter.
+const (
+	endpointValue    = "value"
+	endpointKeys     = "keys"
+	endpointCAS      = "cas"
+	endpointSnapshot = "snapshot"
+	endpointRestore  = "restore"
+	endpointAdmin    = "admin"
+	endpointGRPC     = "grpc"
+)
+
+// The Prometheus metrics exported by a vault on /metrics, so that its behavior (glitches
+// included) can be watched on dashboards.
+type vaultMetrics struct {
+	registry    *prometheus.Registry
+	reads       prometheus.Counter
+	writes      prometheus.Counter
+	rejected    *prometheus.CounterVec
+	corruptions prometheus.Counter
+	throttled   *prometheus.CounterVec
+	repairs     prometheus.Counter
+}
+
+// Create the metrics for a vault, reading its current value when scraped.
+func newVaultMetrics(s *VaultServer) *vaultMetrics {
+	m := &vaultMetrics{
+		registry: metrics.NewRegistry(),
+		reads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "glitchgrid_vault_reads_total",
+			Help: "Reads of the value served by the vault.",
+		}),
+		writes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "glitchgrid_vault_writes_total",
+			Help: "Writes accepted by the vault.",
+		}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "glitchgrid_vault_rejected_writes_total",
+			Help: "Writes refused by the vault, by reason.",
+		}, []string{"reason"}),
+		corruptions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "glitchgrid_vault_corruption_events_total",
+			Help: "Times the vault saw or served a value it should not have, such as an integer going backwards.",
+		}),
+		throttled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "glitchgrid_vault_throttled_requests_total",
+			Help: "Requests refused because the client exceeded its rate limit, by endpoint.",
+		}, []string{"endpoint"}),
+		repairs: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "glitchgrid_vault_gossip_repairs_total",
+			Help: "Keys the vault adopted from a peer through gossip because the peer had a newer write.",
+		}),
+	}
+	value := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "glitchgrid_vault_value",
+		Help: "The value stored in the vault at the root path: the integer itself, or the size in bytes of a blob.",
+	}, func() float64 {
+		k := s.slot(defaultKey, true)
+		k.lock.Lock()
+		defer k.lock.Unlock()
+		if s.valueType == valueTypeBlob {
+			return float64(len(k.value))
+		}
+		n, _ := strconv.Atoi(string(k.value))
+		return float64(n)
+	})
+	for _, reason := range []string{rejectBadRequest, rejectStaleSequence, rejectStorage, rejectReadOnly, rejectUnauthorized, rejectDraining, rejectPrecondition} {
+		// Export every reason from the start, so that rates work before the first rejection.
+		m.rejected.WithLabelValues(reason)
+	}
+	for _, endpoint := range []string{endpointValue, endpointKeys, endpointCAS, endpointSnapshot, endpointRestore, endpointAdmin, endpointGRPC} {
+		m.throttled.WithLabelValues(endpoint)
+	}
+	m.registry.MustRegister(m.reads, m.writes, m.rejected, m.corruptions, m.throttled, m.repairs, value)
+	return m
+}
+
+// The handler for /metrics.
+func (m *vaultMetrics) handler() http.Handler {
+	return metrics.Handler(m.registry)
+}
@@ -0,0 +1,283 @@
+//go:build unix
+
+package vault
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Each record in an mmap data file is a fixed-size header followed by the key, the writer and the
+// value. The marker is written last, so that a record whose marker is present is complete.
+// Records written before we kept the write time and writer have a marker of their own, a shorter
+// header, and no writer; they are rewritten in the current form when the file is compacted.
+const (
+	mmapMarker       = 0xA6
+	mmapHeaderSize   = 42
+	mmapMarkerV1     = 0xA5
+	mmapHeaderSizeV1 = 30
+)
+
+// Returned when the mapped region has no room for another record.
+var errMmapFull = errors.New("mmap storage is full")
+
+// Stores values in an append-only file which is memory-mapped, rather than in the Go heap: the
+// values we hand back point into the mapping, so even a large number of keys costs the heap only
+// an index entry each. Superseded records are dropped when the file is reopened.
+// The mapping has a fixed size (the file is sparse, so unused space costs nothing), which must be
+// large enough for every write made until the next restart.
+type mmapStorage struct {
+	f          *os.File
+	data       []byte
+	durability durability
+	batch      *batchSyncer
+	// The offset of the latest record for each key, and of the end of the last record.
+	index map[string]int
+	tail  int
+	lock  sync.Mutex
+}
+
+// One record in an mmap data file.
+type mmapRecord struct {
+	key string
+	v   storedValue
+}
+
+func newMmapStorage(path string, d durability, interval time.Duration, size int64) (storage, error) {
+	if err := compactMmapFile(path, size); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	m := &mmapStorage{f: f, data: data, durability: d, index: make(map[string]int)}
+	offset := 0
+	for {
+		rec, n, ok := decodeMmapRecord(data[offset:])
+		if !ok {
+			break
+		}
+		m.index[rec.key] = offset
+		offset += n
+	}
+	m.tail = offset
+	if d == durabilityBatch {
+		m.batch = newBatchSyncer(interval, f.Sync)
+	}
+	return m, nil
+}
+
+// Rewrite a data file so that it holds only the latest record for each key, and is sized for the
+// mapping. Creates the file if it does not exist. The old file is mapped rather than read, and
+// the records streamed out of it, so that compacting costs the heap no more than the index does.
+func compactMmapFile(path string, size int64) error {
+	var data []byte
+	old, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		defer old.Close()
+		info, err := old.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() > 0 {
+			data, err = syscall.Mmap(int(old.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+			if err != nil {
+				return err
+			}
+			defer syscall.Munmap(data)
+		}
+	}
+	if len(data) > 0 && data[0] != mmapMarker && data[0] != mmapMarkerV1 {
+		// Don't clobber a data file written by some other kind of storage.
+		return fmt.Errorf("%s is not an mmap data file", path)
+	}
+	// The offset of the latest record for each key, in the order the keys were first written.
+	latest := make(map[string]int)
+	var order []string
+	for offset := 0; ; {
+		rec, n, ok := decodeMmapRecord(data[offset:])
+		if !ok {
+			break
+		}
+		if _, seen := latest[rec.key]; !seen {
+			order = append(order, rec.key)
+		}
+		latest[rec.key] = offset
+		offset += n
+	}
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	out := bufio.NewWriter(tmp)
+	var live int64
+	for _, key := range order {
+		rec, _, _ := decodeMmapRecord(data[latest[key]:])
+		encoded := encodeMmapRecord(key, rec.v)
+		if live += int64(len(encoded)); live > size {
+			tmp.Close()
+			return fmt.Errorf("%w: the live data does not fit in %d bytes", errMmapFull, size)
+		}
+		out.Write(encoded)
+	}
+	if err := out.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Truncate(size); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Encode a record, marker last.
+func encodeMmapRecord(key string, v storedValue) []byte {
+	rec := make([]byte, mmapHeaderSize+len(key)+len(v.Writer)+len(v.Value))
+	binary.LittleEndian.PutUint32(rec[1:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(rec[5:], uint32(len(v.Value)))
+	if !v.Expires.IsZero() {
+		binary.LittleEndian.PutUint64(rec[9:], uint64(v.Expires.UnixNano()))
+	}
+	binary.LittleEndian.PutUint64(rec[17:], uint64(v.Sequence))
+	if v.Checksum != nil {
+		rec[25] = 1
+		binary.LittleEndian.PutUint32(rec[26:], *v.Checksum)
+	}
+	if !v.Written.IsZero() {
+		binary.LittleEndian.PutUint64(rec[30:], uint64(v.Written.UnixNano()))
+	}
+	binary.LittleEndian.PutUint32(rec[38:], uint32(len(v.Writer)))
+	copy(rec[mmapHeaderSize:], key)
+	copy(rec[mmapHeaderSize+len(key):], v.Writer)
+	copy(rec[mmapHeaderSize+len(key)+len(v.Writer):], v.Value)
+	rec[0] = mmapMarker
+	return rec
+}
+
+// Decode the record at the start of data, returning its length, or false if there is no
+// (complete) record there. The value points into data rather than being copied.
+func decodeMmapRecord(data []byte) (mmapRecord, int, bool) {
+	var rec mmapRecord
+	headerSize := mmapHeaderSize
+	if len(data) > 0 && data[0] == mmapMarkerV1 {
+		headerSize = mmapHeaderSizeV1
+	} else if len(data) == 0 || data[0] != mmapMarker {
+		return rec, 0, false
+	}
+	if len(data) < headerSize {
+		return rec, 0, false
+	}
+	keyLen := int(binary.LittleEndian.Uint32(data[1:]))
+	valueLen := int(binary.LittleEndian.Uint32(data[5:]))
+	writerLen := 0
+	if headerSize == mmapHeaderSize {
+		writerLen = int(binary.LittleEndian.Uint32(data[38:]))
+	}
+	n := headerSize + keyLen + writerLen + valueLen
+	if keyLen < 0 || writerLen < 0 || valueLen < 0 || n > len(data) {
+		return rec, 0, false
+	}
+	rec.key = string(data[headerSize : headerSize+keyLen])
+	rec.v.Writer = string(data[headerSize+keyLen : headerSize+keyLen+writerLen])
+	rec.v.Value = data[headerSize+keyLen+writerLen : n : n]
+	if headerSize == mmapHeaderSize {
+		if written := int64(binary.LittleEndian.Uint64(data[30:])); written != 0 {
+			rec.v.Written = time.Unix(0, written)
+		}
+	}
+	if expires := int64(binary.LittleEndian.Uint64(data[9:])); expires != 0 {
+		rec.v.Expires = time.Unix(0, expires)
+	}
+	rec.v.Sequence = int64(binary.LittleEndian.Uint64(data[17:]))
+	if data[25] == 1 {
+		sum := binary.LittleEndian.Uint32(data[26:])
+		rec.v.Checksum = &sum
+	}
+	return rec, n, true
+}
+
+func (m *mmapStorage) load() (map[string]storedValue, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	values := make(map[string]storedValue, len(m.index))
+	for key, offset := range m.index {
+		rec, _, _ := decodeMmapRecord(m.data[offset:])
+		values[key] = rec.v
+	}
+	return values, nil
+}
+
+// Append a record for the key. Records are never overwritten, so values handed out by load and
+// view stay valid for as long as the mapping exists.
+func (m *mmapStorage) save(key string, v storedValue) error {
+	rec := encodeMmapRecord(key, v)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.tail+len(rec) > len(m.data) {
+		return errMmapFull
+	}
+	// Write the marker last, so that if the process dies partway through, there is no half-written
+	// record. This says nothing of a crash of the machine: mapped pages may be written back in any
+	// order, so a record written since the file was last synced may reach the disk with its marker
+	// but not the rest. Only what the durability level has synced is safe from that.
+	copy(m.data[m.tail+1:], rec[1:])
+	m.data[m.tail] = rec[0]
+	m.index[key] = m.tail
+	m.tail += len(rec)
+	switch m.durability {
+	case durabilityFsync:
+		// On the platforms we support, fsync also writes back the mapped pages.
+		return m.f.Sync()
+	case durabilityBatch:
+		m.batch.markDirty()
+	}
+	return nil
+}
+
+// Return the stored copy of a key's value, which lives in the mapping rather than the heap.
+func (m *mmapStorage) view(key string) []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	offset, ok := m.index[key]
+	if !ok {
+		return nil
+	}
+	rec, _, _ := decodeMmapRecord(m.data[offset:])
+	return rec.v.Value
+}
+
+// Flush the file. The mapping is left in place, since values still point into it.
+func (m *mmapStorage) close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.f.Sync()
+}
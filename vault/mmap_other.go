@@ -0,0 +1,12 @@
+//go:build !unix
+
+package vault
+
+import (
+	"errors"
+	"time"
+)
+
+func newMmapStorage(path string, d durability, interval time.Duration, size int64) (storage, error) {
+	return nil, errors.New("mmap storage is not supported on this platform")
+}
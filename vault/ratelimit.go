@@ -0,0 +1,178 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// How many clients' buckets we keep before forgetting those which have refilled, so that a
+// client cycling through addresses cannot exhaust our memory.
+const maxRateBuckets = 1024
+
+// Limits how fast each client may call us, by its IP address, so that one misbehaving client
+// cannot starve the others (in particular the control server). Each client has a token bucket
+// which refills at rate tokens per second, up to burst tokens, and every request takes one.
+// Requests carrying the shared secret, as the control server's and our peers' do, are never
+// limited, and nor are those from the exempt networks: the control server calls us from one
+// address for every client it serves, so it would be the first to be throttled.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	exempt  []*net.IPNet
+	buckets map[string]*rateBucket
+	lock    sync.Mutex
+}
+
+// The tokens left in one client's bucket, as of the last time it was refilled.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Create a rate limiter allowing each client rate requests per second on average, and up to burst
+// at once, except those in the exempt networks. Returns nil, which allows everything, if the rate
+// is not positive.
+func newRateLimiter(rate float64, burst int, exempt []*net.IPNet) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), exempt: exempt, buckets: make(map[string]*rateBucket)}
+}
+
+// Parse a comma-separated list of IP addresses and CIDR networks exempt from the rate limit.
+func parseRateLimitExempt(list string) ([]*net.IPNet, error) {
+	var exempt []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			exempt = append(exempt, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit exemption %q: it must be an IP address or CIDR network", entry)
+		}
+		exempt = append(exempt, network)
+	}
+	return exempt, nil
+}
+
+// Return whether a client, by IP address, is exempt from the rate limit.
+func (l *rateLimiter) exempts(client string) bool {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return false
+	}
+	for _, network := range l.exempt {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Take a token from a client's bucket, returning false (and how long until one is available) if
+// the bucket is empty.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	if l == nil || l.exempts(client) {
+		return true, 0
+	}
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.forgetIdle(now)
+		}
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Forget the buckets which would have refilled by now, since they are the same as new ones. The
+// caller must hold the lock.
+func (l *rateLimiter) forgetIdle(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Return the IP address of whoever sent a request, which is what we rate limit by.
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Wrap a handler so that clients calling it too fast are answered with a 429, and counted as
+// throttled under the given endpoint name. Requests carrying the shared secret are not limited.
+func (s *VaultServer) withRateLimit(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientIP(r.RemoteAddr)
+		if s.hasToken(r.Header.Get("Authorization")) {
+			handler(w, r)
+			return
+		}
+		if ok, wait := s.rateLimit.allow(client); !ok {
+			s.metrics.throttled.WithLabelValues(endpoint).Inc()
+			glog.V(1).Infof("Throttled %s %s from %s", r.Method, r.URL.Path, client)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("Too many requests"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Rate limit gRPC calls the same way, failing them with RESOURCE_EXHAUSTED.
+func (s *VaultServer) grpcRateLimit(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	client := "unknown"
+	if p, ok := peer.FromContext(ctx); ok {
+		client = clientIP(p.Addr.String())
+	}
+	if s.hasToken(grpcAuthorization(ctx)) {
+		return handler(ctx, req)
+	}
+	if ok, _ := s.rateLimit.allow(client); !ok {
+		s.metrics.throttled.WithLabelValues(endpointGRPC).Inc()
+		glog.V(1).Infof("Throttled %s from %s", info.FullMethod, client)
+		return nil, status.Error(codes.ResourceExhausted, "too many requests")
+	}
+	return handler(ctx, req)
+}
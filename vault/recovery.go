@@ -0,0 +1,90 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// If we started without any stored state, seed ourselves from our peers' snapshots, taking the
+// newest copy of each key by sequence number, or failing that from the control server's consensus
+// value, so that we do not vote for the initial value and skew consensus. This should be called
+// before we start serving.
+func (s *VaultServer) recover(control string) {
+	if s.restored {
+		return
+	}
+	keys := make(map[string]keySnapshot)
+	for _, peer := range s.peers {
+		snap, err := s.fetchSnapshot(peer)
+		if err != nil {
+			glog.Warningf("Could not recover from peer %s: %v", peer, err)
+			continue
+		}
+		for key, ks := range snap {
+			if current, ok := keys[key]; !ok || ks.Sequence > current.Sequence {
+				keys[key] = ks
+			}
+		}
+	}
+	if len(keys) > 0 {
+		if err := s.restoreKeys(keys, "peers"); err != nil {
+			glog.Errorf("Could not restore state recovered from peers: %v", err)
+		}
+		return
+	}
+	if control == "" {
+		if len(s.peers) > 0 {
+			glog.Warningf("Could not recover from any peer; starting with the initial value")
+		}
+		return
+	}
+	value, err := s.fetchConsensus(control)
+	if err != nil {
+		glog.Warningf("Could not recover from control server %s: %v; starting with the initial value", control, err)
+		return
+	}
+	if err := s.write(defaultKey, storedValue{Value: value}, control, true); err != nil {
+		glog.Errorf("Could not restore value recovered from control server: %v", err)
+		return
+	}
+	glog.Infof("Recovered Vault :%d value %q from control server %s", s.port, value, control)
+}
+
+// Fetch and check a peer's snapshot.
+func (s *VaultServer) fetchSnapshot(peer string) (map[string]keySnapshot, error) {
+	resp, err := s.client.Get(serverURL(peer, "/snapshot"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer responded with %s", resp.Status)
+	}
+	var snap snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		return nil, err
+	}
+	return s.snapshotKeys(snap)
+}
+
+// Fetch the consensus value from the control server, in its plain form.
+func (s *VaultServer) fetchConsensus(control string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, serverURL(control, "/v1/value"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("control server responded with %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
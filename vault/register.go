@@ -0,0 +1,276 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The prefixes of a -register URL naming a Consul agent and the service to register us in, as in
+// consul://localhost:8500/vault, or an etcd endpoint and the key prefix to register us under, as
+// in etcd://localhost:2379/glitchgrid/vaults/. The control server discovers us by watching the
+// same. Both are reached over plain HTTP, as a local agent usually is.
+const (
+	consulScheme = "consul://"
+	etcdScheme   = "etcd://"
+)
+
+const (
+	// How long a registration in etcd lasts without being renewed, so how long the control server
+	// goes on calling a vault which died without deregistering.
+	etcdLeaseTTL = 10 * time.Second
+	// How often our Consul registration is made again, in case the agent has lost it.
+	consulRefreshInterval = 30 * time.Second
+	// How long to wait before trying again after failing to register.
+	registerRetryInterval = 5 * time.Second
+)
+
+// Somewhere we register ourselves for the control server to discover us.
+type registry interface {
+	// Register us, or renew our registration, and return how soon it must be renewed.
+	register(ctx context.Context, client *http.Client) (time.Duration, error)
+	// Remove our registration.
+	deregister(ctx context.Context, client *http.Client) error
+	String() string
+}
+
+// Set up a registry from a -register URL, in which to register us as address, the address the
+// control server calls us at, e.g. vault1:8001 or https://vault1:8001. Our health can be checked
+// on the same host at httpPort, over HTTPS if secure.
+func newRegistry(raw string, address string, httpPort int, secure bool) (registry, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("invalid -register %q: it must be consul://host:port/<service> or etcd://host:port/<prefix>", raw)
+	}
+	base, name := "http://"+u.Host, strings.Trim(u.Path, "/")
+	switch {
+	case strings.HasPrefix(raw, consulScheme):
+		scheme, hostPort := "", address
+		if before, after, found := strings.Cut(address, "://"); found {
+			scheme, hostPort = before, after
+		}
+		host, portString, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -register-address %q: %v", address, err)
+		}
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -register-address %q: %v", address, err)
+		}
+		healthURL := "http://" + net.JoinHostPort(host, strconv.Itoa(httpPort)) + "/healthz"
+		if secure {
+			healthURL = "https://" + strings.TrimPrefix(healthURL, "http://")
+		}
+		return &consulRegistry{
+			base:      base,
+			service:   name,
+			id:        fmt.Sprintf("%s-%s-%d", name, host, port),
+			host:      host,
+			port:      port,
+			scheme:    scheme,
+			healthURL: healthURL,
+		}, nil
+	case strings.HasPrefix(raw, etcdScheme):
+		return &etcdRegistry{base: base, key: "/" + name + "/" + address, address: address}, nil
+	}
+	return nil, fmt.Errorf("invalid -register %q: it must be consul://host:port/<service> or etcd://host:port/<prefix>", raw)
+}
+
+// Keep us registered, until we stop registering, then deregister. A registration which fails is
+// tried again shortly, without holding up anything else.
+func (s *VaultServer) startRegistering(r registry) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	s.stopRegistering = func() {
+		cancel()
+		<-stopped
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := r.deregister(ctx, s.client); err != nil {
+			glog.Warningf("Could not deregister from %s: %v", r, err)
+			return
+		}
+		glog.Infof("Deregistered from %s", r)
+	}
+	go func() {
+		defer close(stopped)
+		registered := false
+		for {
+			next, err := r.register(ctx, s.client)
+			if ctx.Err() != nil {
+				return
+			}
+			switch {
+			case err != nil:
+				glog.Warningf("Could not register in %s: %v", r, err)
+				registered, next = false, registerRetryInterval
+			case !registered:
+				glog.Infof("Registered in %s", r)
+				registered = true
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(next):
+			}
+		}
+	}()
+}
+
+// Read an answer from a registry, failing unless it is a 200, and decode it into answer if given.
+func registryAnswer(resp *http.Response, answer interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %v: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if answer == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(answer)
+}
+
+// Send a request to a registry's HTTP API, with a JSON body if given.
+func registryRequest(ctx context.Context, client *http.Client, method string, u string, body interface{}, header http.Header, answer interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return registryAnswer(resp, answer)
+}
+
+// A service registered with the local Consul agent, with an HTTP health check on /healthz which
+// takes us out of the control server's set as soon as we fail it, and deregisters us if we go on
+// failing it.
+type consulRegistry struct {
+	base      string
+	service   string
+	id        string
+	host      string
+	port      int
+	scheme    string
+	healthURL string
+}
+
+func (c *consulRegistry) String() string { return "Consul service " + c.service }
+
+// The header carrying the Consul ACL token, if CONSUL_HTTP_TOKEN gives one.
+func consulHeader() http.Header {
+	header := http.Header{}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		header.Set("X-Consul-Token", token)
+	}
+	return header
+}
+
+func (c *consulRegistry) register(ctx context.Context, client *http.Client) (time.Duration, error) {
+	service := map[string]interface{}{
+		"ID":      c.id,
+		"Name":    c.service,
+		"Address": c.host,
+		"Port":    c.port,
+		"Check": map[string]interface{}{
+			"HTTP":     c.healthURL,
+			"Interval": "5s",
+			"Timeout":  "2s",
+			// The check only asks whether we are up, not who we are.
+			"TLSSkipVerify":                  strings.HasPrefix(c.healthURL, "https://"),
+			"DeregisterCriticalServiceAfter": "1m",
+		},
+	}
+	if c.scheme != "" {
+		// The control server calls us over this, rather than plain HTTP.
+		service["Meta"] = map[string]string{"scheme": c.scheme}
+	}
+	err := registryRequest(ctx, client, http.MethodPut, c.base+"/v1/agent/service/register", service, consulHeader(), nil)
+	return consulRefreshInterval, err
+}
+
+func (c *consulRegistry) deregister(ctx context.Context, client *http.Client) error {
+	return registryRequest(ctx, client, http.MethodPut, c.base+"/v1/agent/service/deregister/"+url.PathEscape(c.id), nil, consulHeader(), nil)
+}
+
+// A key in etcd holding our address, attached to a lease which we keep alive, so that the key
+// goes away of its own accord if we die. etcd is reached through its JSON gateway, which sends
+// 64-bit numbers as strings.
+type etcdRegistry struct {
+	base    string
+	key     string
+	address string
+	// The lease our key is attached to, if we have one.
+	lease string
+}
+
+func (e *etcdRegistry) String() string { return "etcd key " + e.key }
+
+// Renew our lease, or, if it has run out (or we have none yet), take out a new one and put our key
+// under it again.
+func (e *etcdRegistry) register(ctx context.Context, client *http.Client) (time.Duration, error) {
+	renewEvery := etcdLeaseTTL / 3
+	if e.lease != "" {
+		var answer struct {
+			Result struct {
+				TTL string
+			}
+		}
+		if err := registryRequest(ctx, client, http.MethodPost, e.base+"/v3/lease/keepalive", map[string]string{"ID": e.lease}, nil, &answer); err != nil {
+			return 0, fmt.Errorf("could not renew lease: %w", err)
+		}
+		if ttl, _ := strconv.Atoi(answer.Result.TTL); ttl > 0 {
+			return renewEvery, nil
+		}
+		glog.Warningf("Our lease in etcd ran out; registering again")
+		e.lease = ""
+	}
+	var grant struct {
+		ID    string
+		Error string
+	}
+	if err := registryRequest(ctx, client, http.MethodPost, e.base+"/v3/lease/grant", map[string]int{"TTL": int(etcdLeaseTTL.Seconds())}, nil, &grant); err != nil {
+		return 0, fmt.Errorf("could not take out a lease: %w", err)
+	}
+	if grant.ID == "" {
+		return 0, fmt.Errorf("could not take out a lease: %s", grant.Error)
+	}
+	put := map[string]interface{}{"key": []byte(e.key), "value": []byte(e.address), "lease": grant.ID}
+	if err := registryRequest(ctx, client, http.MethodPost, e.base+"/v3/kv/put", put, nil, nil); err != nil {
+		return 0, fmt.Errorf("could not put %s: %w", e.key, err)
+	}
+	e.lease = grant.ID
+	return renewEvery, nil
+}
+
+// Revoke our lease, which deletes our key with it.
+func (e *etcdRegistry) deregister(ctx context.Context, client *http.Client) error {
+	if e.lease == "" {
+		return nil
+	}
+	return registryRequest(ctx, client, http.MethodPost, e.base+"/v3/lease/revoke", map[string]string{"ID": e.lease}, nil, nil)
+}
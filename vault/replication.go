@@ -0,0 +1,61 @@
+package vault
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The header with which a vault marks a write it is replicating to its peers, so that the peers
+// apply it without replicating it any further.
+const replicatedHeader = "X-Replicated-From"
+
+// Asynchronously send a write we have accepted to each of our peers, so that the grid heals even
+// if the control server never revisits a stale vault. The peers refuse it if they already have a
+// newer write, so late replication cannot roll them backwards. The write stays attributed to the
+// original writer.
+func (s *VaultServer) replicate(key string, value []byte, ttl time.Duration, sequence int64, writer string) {
+	for _, peer := range s.peers {
+		go func(peer string) {
+			if err := s.replicateTo(peer, key, value, ttl, sequence, writer); err != nil {
+				glog.Warningf("Could not replicate Vault :%d %s to peer %s: %v", s.port, keyName(key), peer, err)
+			}
+		}(peer)
+	}
+}
+
+// Send a single write to a peer, at the same path it was sent to us.
+func (s *VaultServer) replicateTo(peer string, key string, value []byte, ttl time.Duration, sequence int64, writer string) error {
+	req, err := http.NewRequest(http.MethodPost, serverURL(peer, keyPath(key)), bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set(replicatedHeader, strconv.Itoa(s.port))
+	req.Header.Set(writerHeader, writer)
+	s.addAuth(req)
+	if ttl > 0 {
+		req.Header.Set(ttlHeader, ttl.String())
+	}
+	if sequence > 0 {
+		req.Header.Set(sequenceHeader, strconv.FormatInt(sequence, 10))
+	}
+	r, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	if r.StatusCode == http.StatusConflict {
+		// The peer already has a newer write, which is fine.
+		glog.V(1).Infof("Peer %s already has a newer write than sequence %d", peer, sequence)
+		return nil
+	} else if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer responded with %s", r.Status)
+	}
+	glog.V(1).Infof("Replicated Vault :%d %s to peer %s", s.port, keyName(key), peer)
+	return nil
+}
@@ -0,0 +1,79 @@
+package vault
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"antithesis.com/glitch-grid/internal/metrics"
+	"antithesis.com/glitch-grid/internal/vaultpb"
+)
+
+// The header in which the control server passes on the ID of the client request a call was made
+// for, so that one write can be followed through the control server's logs and every vault's.
+const requestIDHeader = "X-Request-ID"
+
+// The longest request ID we log; longer ones are cut short.
+const maxRequestIDLength = 128
+
+// Return the ID the control server passed on for the client request a request was made for, cut
+// short if need be, or "" if it passed none.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if len(id) > maxRequestIDLength {
+		id = id[:maxRequestIDLength]
+	}
+	return id
+}
+
+// Wrap a handler so that each request carrying a request ID is logged under it once answered:
+// writes always, and reads with -v=1, since there are many more of them. The ID is echoed in the
+// response.
+func withRequestLog(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r)
+		if id == "" {
+			handler(w, r)
+			return
+		}
+		w.Header().Set(requestIDHeader, id)
+		start := time.Now()
+		rec := &metrics.StatusRecorder{ResponseWriter: w}
+		handler(rec, r)
+		if rec.StatusCode == 0 {
+			rec.StatusCode = http.StatusOK
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			glog.V(1).Infof("Request %q: %s %s from %s answered %d in %v", id, r.Method, r.URL.Path, r.RemoteAddr, rec.StatusCode, time.Since(start))
+			return
+		}
+		glog.Infof("Request %q: %s %s from %s answered %d in %v", id, r.Method, r.URL.Path, r.RemoteAddr, rec.StatusCode, time.Since(start))
+	}
+}
+
+// Log each gRPC call carrying a request ID under it once answered, as withRequestLog does for
+// HTTP.
+func grpcRequestLog(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ids := md.Get("x-request-id")
+	if len(ids) == 0 || ids[0] == "" {
+		return handler(ctx, req)
+	}
+	id := ids[0]
+	if len(id) > maxRequestIDLength {
+		id = id[:maxRequestIDLength]
+	}
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	if info.FullMethod == vaultpb.VaultService_Get_FullMethodName {
+		glog.V(1).Infof("Request %q: %s answered %s in %v", id, info.FullMethod, status.Code(err), time.Since(start))
+	} else {
+		glog.Infof("Request %q: %s answered %s in %v", id, info.FullMethod, status.Code(err), time.Since(start))
+	}
+	return resp, err
+}
@@ -0,0 +1,109 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+)
+
+// Returned when we are asked to write while shutting down.
+var errDraining = errors.New("vault is shutting down")
+
+// Serve until we receive SIGTERM or SIGINT, then shut down gracefully: refuse new writes, take
+// ourselves out of the registry the control server discovers us in and tell it we are leaving (if
+// asked to), wait up to the timeout for in-flight requests to finish, and flush and close our
+// storage, instead of dropping connections mid-write. The gRPC server, if we have one, is drained
+// the same way. We serve HTTPS if we have a certificate.
+func (s *VaultServer) serveUntilSignalled(srv *http.Server, l net.Listener, g *grpc.Server, timeout time.Duration, leaveURL, leaveToken string) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	errs := make(chan error, 1)
+	go func() {
+		if s.tlsCert != "" {
+			errs <- srv.ServeTLS(l, s.tlsCert, s.tlsKey)
+		} else {
+			errs <- srv.Serve(l)
+		}
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		glog.Infof("Received %v; shutting down Vault :%d", sig, s.port)
+	}
+	s.lock.Lock()
+	s.draining = true
+	s.lock.Unlock()
+	if s.stopRegistering != nil {
+		s.stopRegistering()
+	}
+	if leaveURL != "" {
+		if err := s.leave(leaveURL, leaveToken); err != nil {
+			glog.Warningf("Could not tell the control server we are leaving: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		glog.Warningf("In-flight requests did not finish in %v: %v", timeout, err)
+	}
+	if g != nil {
+		stopped := make(chan struct{})
+		go func() {
+			g.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			glog.Warningf("In-flight gRPC calls did not finish in %v", timeout)
+			g.Stop()
+		}
+	}
+	if err := s.close(); err != nil {
+		return err
+	}
+	glog.Flush()
+	return http.ErrServerClosed
+}
+
+// Flush and close the storage and WAL.
+func (s *VaultServer) close() error {
+	var errs []error
+	if s.storage != nil {
+		errs = append(errs, s.storage.close())
+	}
+	if s.wal != nil {
+		errs = append(errs, s.wal.close())
+	}
+	return errors.Join(errs...)
+}
+
+// Ask the control server to stop sending us requests, by deleting us through its admin API.
+func (s *VaultServer) leave(url string, token string) error {
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("control server responded with %s", resp.Status)
+	}
+	return nil
+}
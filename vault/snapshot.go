@@ -0,0 +1,150 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The full state of a vault, as copied between vaults by /snapshot and /restore.
+// The value at the root path is at the top level, and any named keys are under "keys".
+type snapshot struct {
+	ValueType string `json:"value_type"`
+	keySnapshot
+	Keys map[string]keySnapshot `json:"keys,omitempty"`
+}
+
+// The state of one key in a snapshot.
+type keySnapshot struct {
+	Value []byte `json:"value"`
+	// When the value expires, if it was written with a TTL. It may already have passed.
+	Expires time.Time `json:"expires"`
+	Expired bool      `json:"expired"`
+	// The highest sequence number of any write the vault has applied to the key.
+	Sequence int64 `json:"sequence"`
+	// The checksum recorded for the value, which a restore verifies if it is present.
+	Checksum *uint32 `json:"checksum,omitempty"`
+	// When the value was written, and by whom, if known.
+	Written time.Time `json:"written,omitempty"`
+	Writer  string    `json:"writer,omitempty"`
+}
+
+// Return the vault's full state as JSON, so that it can be restored into another vault.
+func (s *VaultServer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	snap := snapshot{ValueType: s.valueType}
+	s.keysLock.RLock()
+	slots := make([]*slot, 0, len(s.keys))
+	for _, k := range s.keys {
+		slots = append(slots, k)
+	}
+	s.keysLock.RUnlock()
+	for _, k := range slots {
+		k.lock.Lock()
+		sum := k.checksum
+		ks := keySnapshot{Value: k.value, Expires: k.expires, Expired: k.expired, Sequence: k.sequence, Checksum: &sum, Written: k.written, Writer: k.writer}
+		k.lock.Unlock()
+		if k.key == defaultKey {
+			snap.keySnapshot = ks
+		} else {
+			if snap.Keys == nil {
+				snap.Keys = make(map[string]keySnapshot)
+			}
+			snap.Keys[k.key] = ks
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snap)
+}
+
+// Replace the vault's state with a snapshot taken from (typically) another vault. The restored
+// values are persisted like any other write. Unlike a normal write, a restore may move an integer
+// value backwards, since the point is to make this vault a copy of the other. Keys which are not
+// in the snapshot are left alone.
+func (s *VaultServer) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.authorize(w, r) {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid or missing POST body"))
+		return
+	}
+	var snap snapshot
+	if err := json.Unmarshal(body, &snap); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid snapshot"))
+		return
+	}
+	keys, err := s.snapshotKeys(snap)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := s.restoreKeys(keys, r.RemoteAddr); err != nil {
+		s.writeFailed(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Returned when a snapshot cannot be restored into this vault.
+var errInvalidSnapshot = errors.New("invalid snapshot")
+
+// Return the state of every key in a snapshot, keyed by key, having checked that it can be
+// restored into this vault.
+func (s *VaultServer) snapshotKeys(snap snapshot) (map[string]keySnapshot, error) {
+	if snap.ValueType != s.valueType {
+		return nil, fmt.Errorf("%w: value type %q does not match this vault", errInvalidSnapshot, snap.ValueType)
+	}
+	keys := map[string]keySnapshot{defaultKey: snap.keySnapshot}
+	for key, ks := range snap.Keys {
+		if key != defaultKey {
+			keys[key] = ks
+		}
+	}
+	for key, ks := range keys {
+		if n, err := strconv.Atoi(string(ks.Value)); s.valueType == valueTypeInt && (err != nil || n < 0) {
+			return nil, fmt.Errorf("%w: invalid value for %s", errInvalidSnapshot, keyName(key))
+		}
+		if ks.Checksum != nil && *ks.Checksum != checksum(ks.Value) {
+			// Refuse to copy bit-rot from another vault.
+			return nil, fmt.Errorf("%w: %s does not match its checksum", errInvalidSnapshot, keyName(key))
+		}
+	}
+	return keys, nil
+}
+
+// Replace the state of the given keys, as if by a write from the given address.
+func (s *VaultServer) restoreKeys(keys map[string]keySnapshot, from string) error {
+	for key, ks := range keys {
+		if ks.Value == nil {
+			ks.Value = []byte{}
+		}
+		if ks.Expired && ks.Expires.IsZero() {
+			// The other vault knows its value expired but not when; treat it as having just expired.
+			ks.Expires = time.Now()
+		}
+		v := storedValue{Value: ks.Value, Expires: ks.Expires, Sequence: ks.Sequence, Written: ks.Written, Writer: ks.Writer}
+		if err := s.write(key, v, from, true); err != nil {
+			return err
+		}
+		glog.Infof("Restored Vault :%d %s %q from a snapshot sent by %s", s.port, keyName(key), ks.Value, from)
+	}
+	return nil
+}
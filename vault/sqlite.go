@@ -0,0 +1,147 @@
+package vault
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Stores values in a SQLite database, giving transactional durability and a file which can be
+// inspected offline (e.g. `sqlite3 vault.db 'SELECT * FROM vault_values'`) to see what a vault
+// believes.
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+// The SQLite synchronous setting for each durability level. There is no fixed interval under
+// fsync-batch: in WAL mode, SQLite syncs whenever it checkpoints.
+var sqliteSynchronous = map[durability]string{
+	durabilityNone:  "OFF",
+	durabilityFsync: "FULL",
+	durabilityBatch: "NORMAL",
+}
+
+func newSQLiteStorage(path string, d durability) (storage, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows only one writer at a time anyway.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA synchronous = " + sqliteSynchronous[d],
+		`CREATE TABLE IF NOT EXISTS vault_values (
+			key      TEXT PRIMARY KEY,
+			value    BLOB NOT NULL,
+			expires  INTEGER,
+			sequence INTEGER NOT NULL,
+			checksum INTEGER,
+			written  INTEGER,
+			writer   TEXT
+		)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("initializing %s: %w", path, err)
+		}
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating %s: %w", path, err)
+	}
+	return &sqliteStorage{db: db}, nil
+}
+
+// Add the columns which databases created before we kept the write time and writer lack.
+func migrateSQLite(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('vault_values')")
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		columns[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, column := range []string{"written INTEGER", "writer TEXT"} {
+		if columns[strings.Fields(column)[0]] {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE vault_values ADD COLUMN " + column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *sqliteStorage) load() (map[string]storedValue, error) {
+	rows, err := q.db.Query("SELECT key, value, expires, sequence, checksum, written, writer FROM vault_values")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make(map[string]storedValue)
+	for rows.Next() {
+		var key string
+		var v storedValue
+		var expires, sum, written sql.NullInt64
+		var writer sql.NullString
+		if err := rows.Scan(&key, &v.Value, &expires, &v.Sequence, &sum, &written, &writer); err != nil {
+			return nil, err
+		}
+		if expires.Valid {
+			v.Expires = time.Unix(0, expires.Int64)
+		}
+		if sum.Valid {
+			checksum := uint32(sum.Int64)
+			v.Checksum = &checksum
+		}
+		if written.Valid {
+			v.Written = time.Unix(0, written.Int64)
+		}
+		v.Writer = writer.String
+		values[key] = v
+	}
+	return values, rows.Err()
+}
+
+func (q *sqliteStorage) save(key string, v storedValue) error {
+	var expires, sum, written sql.NullInt64
+	if !v.Expires.IsZero() {
+		expires = sql.NullInt64{Int64: v.Expires.UnixNano(), Valid: true}
+	}
+	if !v.Written.IsZero() {
+		written = sql.NullInt64{Int64: v.Written.UnixNano(), Valid: true}
+	}
+	writer := sql.NullString{String: v.Writer, Valid: v.Writer != ""}
+	if v.Checksum != nil {
+		sum = sql.NullInt64{Int64: int64(*v.Checksum), Valid: true}
+	}
+	value := v.Value
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := q.db.Exec(`INSERT INTO vault_values (key, value, expires, sequence, checksum, written, writer)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires = excluded.expires,
+			sequence = excluded.sequence, checksum = excluded.checksum, written = excluded.written,
+			writer = excluded.writer`,
+		key, value, expires, v.Sequence, sum, written, writer)
+	return err
+}
+
+func (q *sqliteStorage) close() error {
+	return q.db.Close()
+}
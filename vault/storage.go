@@ -0,0 +1,177 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The kinds of storage a vault may use.
+const (
+	// Keep values in memory only, so that they are lost on restart.
+	storageMemory = "memory"
+	// Keep values in a single JSON file, replaced atomically on every write.
+	storageFile = "file"
+	// Keep values in a memory-mapped append-only file, outside the Go heap.
+	storageMmap = "mmap"
+	// Keep values in a SQLite database.
+	storageSQLite = "sqlite"
+)
+
+// Open the given kind of storage, kept at the given path, or return nil for memory storage.
+func openStorage(kind string, path string, d durability, interval time.Duration, mmapSize int64) (storage, error) {
+	switch kind {
+	case storageMemory, "":
+		return nil, nil
+	case storageFile:
+		return newFileStorage(path, d, interval), nil
+	case storageMmap:
+		return newMmapStorage(path, d, interval, mmapSize)
+	case storageSQLite:
+		return newSQLiteStorage(path, d)
+	}
+	return nil, fmt.Errorf("unknown storage %q", kind)
+}
+
+// Storage which can hand back its own copy of a stored value, so that we need not keep ours.
+type viewableStorage interface {
+	view(key string) []byte
+}
+
+// Where a vault keeps its values, so that restarting a vault doesn't silently reset them.
+type storage interface {
+	// Return the stored values, keyed by key. The default key is the empty string.
+	load() (map[string]storedValue, error)
+	// Durably store a key's value before returning.
+	save(key string, v storedValue) error
+	// Flush anything not yet durable, before we exit.
+	close() error
+}
+
+// The state of one key as it is persisted.
+type storedValue struct {
+	Value []byte `json:"value"`
+	// When the value expires, if it was written with a TTL.
+	Expires time.Time `json:"expires"`
+	// The sequence number of the write which stored the value.
+	Sequence int64 `json:"sequence"`
+	// The checksum of the value, which is absent in files written before we kept checksums.
+	Checksum *uint32 `json:"checksum,omitempty"`
+	// When the value was written, and by whom, if we know.
+	Written time.Time `json:"written,omitempty"`
+	Writer  string    `json:"writer,omitempty"`
+}
+
+// The contents of a data file.
+type storedValues struct {
+	Keys map[string]storedValue `json:"keys"`
+}
+
+// Stores every key's value in a single file, which is replaced atomically on every write.
+type fileStorage struct {
+	path       string
+	durability durability
+	// Syncs the file in the background, under the fsync-batch durability level.
+	batch *batchSyncer
+	// What is in the file, so that we can rewrite it with one key changed.
+	values map[string]storedValue
+	lock   sync.Mutex
+}
+
+func newFileStorage(path string, d durability, interval time.Duration) *fileStorage {
+	f := &fileStorage{path: path, durability: d, values: make(map[string]storedValue)}
+	if d == durabilityBatch {
+		f.batch = newBatchSyncer(interval, func() error { return syncFile(path) })
+	}
+	return f
+}
+
+func (f *fileStorage) load() (map[string]storedValue, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var stored storedValues
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	values := make(map[string]storedValue, len(stored.Keys))
+	for key, v := range stored.Keys {
+		f.values[key] = v
+		values[key] = v
+	}
+	return values, nil
+}
+
+// Write the values to a temporary file alongside the real one, fsync it (depending on the
+// durability level), and rename it into place, so that a crash at any point leaves either the old
+// or the new values on disk, never a mixture.
+func (f *fileStorage) save(key string, v storedValue) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	previous, existed := f.values[key]
+	f.values[key] = v
+	if err := f.write(); err != nil {
+		// Keep what we remember in step with what is on disk.
+		if existed {
+			f.values[key] = previous
+		} else {
+			delete(f.values, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Atomically replace the file with the current values. The caller must hold the lock.
+func (f *fileStorage) write() error {
+	data, err := json.Marshal(storedValues{Keys: f.values})
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(f.path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if f.durability == durabilityFsync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+	switch f.durability {
+	case durabilityFsync:
+		// Make sure the rename itself is durable.
+		return syncDir(dir)
+	case durabilityBatch:
+		f.batch.markDirty()
+	}
+	return nil
+}
+
+func (f *fileStorage) close() error {
+	if f.batch != nil {
+		return f.batch.flush()
+	}
+	return nil
+}
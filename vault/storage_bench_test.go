@@ -0,0 +1,104 @@
+package vault
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// How many keys the benchmarks write, round robin, and load back.
+const benchKeys = 1000
+
+// The in-memory map a vault keeps its values in with -storage=memory, as a storage, so that the
+// other kinds can be measured against it.
+type mapStorage struct {
+	values map[string]storedValue
+	lock   sync.Mutex
+}
+
+func (m *mapStorage) load() (map[string]storedValue, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	values := make(map[string]storedValue, len(m.values))
+	for key, v := range m.values {
+		values[key] = v
+	}
+	return values, nil
+}
+
+func (m *mapStorage) save(key string, v storedValue) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[key] = v
+	return nil
+}
+
+func (m *mapStorage) close() error { return nil }
+
+// The kinds of storage the benchmarks compare.
+var benchKinds = []string{storageMemory, storageFile, storageMmap, storageSQLite}
+
+// Open a kind of storage in a fresh directory, without fsyncs, so that what is measured is the
+// storage rather than the disk.
+func openBenchStorage(b *testing.B, kind string) storage {
+	if kind == storageMemory {
+		return &mapStorage{values: make(map[string]storedValue)}
+	}
+	st, err := openStorage(kind, filepath.Join(b.TempDir(), "data"), durabilityNone, time.Second, 1<<30)
+	if err != nil {
+		b.Skipf("could not open %s storage: %v", kind, err)
+	}
+	return st
+}
+
+func benchValue(sequence int64) storedValue {
+	value := []byte(strconv.FormatInt(sequence, 10))
+	sum := checksum(value)
+	return storedValue{Value: value, Sequence: sequence, Checksum: &sum, Written: time.Now(), Writer: "bench"}
+}
+
+// Store a value under one of benchKeys keys at a time, as a vault does on every write.
+func BenchmarkSave(b *testing.B) {
+	for _, kind := range benchKinds {
+		b.Run(kind, func(b *testing.B) {
+			st := openBenchStorage(b, kind)
+			defer st.close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := st.save(fmt.Sprintf("key%d", i%benchKeys), benchValue(int64(i))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Load benchKeys keys back, as a vault does when it starts.
+func BenchmarkLoad(b *testing.B) {
+	for _, kind := range benchKinds {
+		b.Run(kind, func(b *testing.B) {
+			st := openBenchStorage(b, kind)
+			defer st.close()
+			for i := 0; i < benchKeys; i++ {
+				if err := st.save(fmt.Sprintf("key%d", i), benchValue(int64(i))); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				values, err := st.load()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(values) != benchKeys {
+					b.Fatalf("loaded %d keys, want %d", len(values), benchKeys)
+				}
+			}
+		})
+	}
+}
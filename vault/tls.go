@@ -0,0 +1,34 @@
+package vault
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"antithesis.com/glitch-grid/internal/tlsutil"
+)
+
+// The prefix of a peer or control server address (e.g. "https://vault2:8002") which says to talk
+// to it over HTTPS instead of plain HTTP.
+const httpsScheme = "https://"
+
+// Return the URL of a path on a peer or control server, which is spoken to over plain HTTP unless
+// its address says otherwise.
+func serverURL(addr string, path string) string {
+	if strings.HasPrefix(addr, httpsScheme) {
+		return addr + path
+	}
+	return "http://" + addr + path
+}
+
+// Return a transport which trusts the certificate authorities in a PEM file, as well as the
+// system's, for connecting to peers and the control server over HTTPS.
+func transportTrusting(path string) (*http.Transport, error) {
+	pool, err := tlsutil.LoadCAs(path)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return transport, nil
+}
@@ -1,38 +1,291 @@
-package main
+package vault
 
 import (
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+
+	"antithesis.com/glitch-grid/internal/flagconfig"
+	"antithesis.com/glitch-grid/internal/listen"
+	"antithesis.com/glitch-grid/internal/logging"
+)
+
+// The kinds of value a vault may store: non-negative integers, or opaque blobs.
+const (
+	valueTypeInt  = "int"
+	valueTypeBlob = "blob"
+)
+
+// The header with which a writer may ask for the value to expire after a duration (e.g. "30s").
+const ttlHeader = "X-Value-TTL"
+
+// The header with which the control server stamps each write with an increasing sequence number.
+const sequenceHeader = "X-Write-Sequence"
+
+// The headers with which we report, on reads, the sequence number of the write which stored the
+// value, when it was written and by whom. A writer (normally the control server) identifies itself
+// with the writer header; otherwise we record its address.
+const (
+	versionHeader = "X-Value-Version"
+	writtenHeader = "X-Value-Written"
+	writerHeader  = "X-Value-Writer"
 )
 
+// Returned when we are asked to write while in read-only maintenance mode.
+var errReadOnly = errors.New("vault is read-only")
+
+// Returned when a write carries a lower sequence number than one we have already applied.
+var errStaleSequence = errors.New("stale sequence number")
+
+// Settings for a vault server, typically populated from command-line flags.
+type VaultConfig struct {
+	// The port on which we will listen.
+	Port int
+	// Whether we store non-negative integers or opaque blobs.
+	ValueType string
+	// How the values are persisted: memory (not at all), file, mmap or sqlite.
+	Storage string
+	// The file in which the values are persisted across restarts, unless storage is memory.
+	DataFile string
+	// The size of the mapping for mmap storage.
+	MmapSize int64
+	// If set, the file to which every accepted write is appended before it is acknowledged.
+	WALFile string
+	// How long to keep superseded WAL entries, and how large to let the WAL grow, before
+	// compacting them away (no limit if zero), and how often to check.
+	WALRetentionAge    time.Duration
+	WALRetentionSize   int64
+	WALCompactInterval time.Duration
+	// How hard to try to make sure an acknowledged write survives a crash.
+	Durability durability
+	// How often to fsync under the fsync-batch durability level.
+	FsyncInterval time.Duration
+	// The fraction of reads, from 0 to 1, for which we deliberately serve the wrong value.
+	GlitchRate float64
+	// How we get the value wrong when we glitch: flip, stale or garbage.
+	GlitchMode string
+	// Comma-separated list of other vaults to which we replicate accepted writes.
+	Peers string
+	// Whether to start in read-only maintenance mode.
+	ReadOnly bool
+	// If set, the shared secret which writers must present as a bearer token.
+	AuthToken string
+	// How many requests per second each client may make on average (no limit if zero), and how
+	// many at once.
+	RateLimit float64
+	RateBurst int
+	// The networks whose clients are not rate limited, besides those presenting AuthToken.
+	RateLimitExempt []*net.IPNet
+	// If set, the certificate and key with which we serve HTTPS instead of HTTP.
+	TLSCert string
+	TLSKey  string
+	// If set, a PEM file of extra certificate authorities to trust when connecting to peers.
+	TLSCA string
+	// How often to gossip with our peers (not at all if zero), and with how many at a time.
+	GossipInterval time.Duration
+	GossipFanout   int
+	// Whether the metrics and admin endpoints are served only on the admin listener, and not on
+	// the data port.
+	AdminExclusive bool
+}
+
 // A vault server which maintains a list of vaults which will store the data (value).
-// We only store positive values.
+// In integer mode we only store positive values; in blob mode we store whatever we are sent.
+// As well as the value at the root path, which the control server uses, any number of named keys
+// may be stored under /keys/, each with a lock of its own.
 type VaultServer struct {
-	mux   *http.ServeMux
-	port  int
-	value int
+	mux *http.ServeMux
+	// The metrics and admin endpoints, for the admin listener.
+	adminMux  *http.ServeMux
+	port      int
+	valueType string
+	// The value of each key, keyed by key; the default key is always present. Keys which writes
+	// are creating are kept apart until one of the writes succeeds. Both are guarded by keysLock.
+	keys        map[string]*slot
+	pendingKeys map[string]*pendingSlot
+	keysLock    sync.RWMutex
+	// When we last accepted a write, and why we last failed to persist one (if we did).
+	lastWrite    time.Time
+	storageError string
+	// While set, we serve reads but refuse writes.
+	readOnly bool
+	// Guards the fields above which are not keys.
+	lock sync.Mutex
+	// Where the values are persisted, if anywhere, and how.
+	storage     storage
+	storageKind string
+	// Where accepted writes are logged, if anywhere.
+	wal     *writeAheadLog
+	metrics *vaultMetrics
+	// How hard the storage and WAL try to make acknowledged writes survive a crash.
+	durability durability
+	// How often, and how, we deliberately serve the wrong value.
+	glitchRate float64
+	glitchMode string
+	// The other vaults to which we replicate accepted writes.
+	peers []string
+	// The client for our calls to peers, the control server and registries.
+	client *http.Client
+	// The shared secret which writers must present, if any.
+	authToken string
+	// Whether we found any state in storage or the WAL when we started.
+	restored bool
+	// The faults being injected through the admin API, guarded by lock.
+	faults faults
+	// Set once we have started shutting down, after which we refuse writes.
+	draining bool
+	// Limits how fast each client may call us, if at all.
+	rateLimit *rateLimiter
+	// The certificate and key with which we serve HTTPS, if any.
+	tlsCert string
+	tlsKey  string
+	// Stops keeping us registered for discovery, and deregisters us, if we are registered.
+	stopRegistering func()
 }
 
 // Create and return a new Vault server instance.
-// Provide the port on which we will listen.
+// Provide the configuration, including the port on which we will listen.
 // We store the port of the vault and not the controller, since the port is how we will
 // distinguish the vaults in the logs when run via `docker-compose up`
-func NewVaultServer(port int) *VaultServer {
+// If the vault has a data file, the values are reloaded from it.
+func NewVaultServer(config VaultConfig) (*VaultServer, error) {
 	s := new(VaultServer)
 	s.mux = http.NewServeMux()
-	s.value = 0
-	s.port = port
-	s.mux.HandleFunc("/", s.handle)
-	http.DefaultClient.Timeout = time.Second
-	return s
+	s.valueType = config.ValueType
+	s.keys = make(map[string]*slot)
+	s.pendingKeys = make(map[string]*pendingSlot)
+	s.slot(defaultKey, true)
+	s.port = config.Port
+	s.glitchRate = config.GlitchRate
+	s.glitchMode = config.GlitchMode
+	s.readOnly = config.ReadOnly
+	s.authToken = config.AuthToken
+	s.durability = config.Durability
+	s.rateLimit = newRateLimiter(config.RateLimit, config.RateBurst, config.RateLimitExempt)
+	s.tlsCert, s.tlsKey = config.TLSCert, config.TLSKey
+	if config.Peers != "" {
+		s.peers = strings.Split(config.Peers, ",")
+	}
+	s.metrics = newVaultMetrics(s)
+	s.storageKind = config.Storage
+	st, err := openStorage(config.Storage, config.DataFile, config.Durability, config.FsyncInterval, config.MmapSize)
+	if err != nil {
+		return nil, err
+	}
+	if st != nil {
+		s.storage = st
+		if err := s.restore(); err != nil {
+			return nil, err
+		}
+	}
+	if config.WALFile != "" {
+		wal, entries, err := openWAL(config.WALFile, config.Durability, config.FsyncInterval)
+		if err != nil {
+			return nil, err
+		}
+		s.wal = wal
+		s.replay(entries)
+		if config.WALRetentionAge > 0 || config.WALRetentionSize > 0 {
+			wal.compactEvery(config.WALCompactInterval, config.WALRetentionAge, config.WALRetentionSize)
+		}
+	}
+	// Health checks and metrics scrapes are not rate limited, so that throttling stays visible.
+	s.mux.HandleFunc("/", withRequestLog(s.withRateLimit(endpointValue, s.withFaults(s.handle))))
+	s.mux.HandleFunc(keysPrefix, withRequestLog(s.withRateLimit(endpointKeys, s.withFaults(s.handleKey))))
+	s.mux.HandleFunc(casPath, withRequestLog(s.withRateLimit(endpointCAS, s.withFaults(s.handleCAS))))
+	s.mux.HandleFunc(casPath+"/", withRequestLog(s.withRateLimit(endpointCAS, s.withFaults(s.handleCAS))))
+	s.mux.HandleFunc("/snapshot", s.withRateLimit(endpointSnapshot, s.handleSnapshot))
+	s.mux.HandleFunc("/restore", s.withRateLimit(endpointRestore, s.handleRestore))
+	s.mux.HandleFunc("/healthz", s.handleHealth)
+	s.mux.HandleFunc("/version", s.handleVersion)
+	// The metrics and admin endpoints are also served on the admin listener, if there is one, and
+	// may be kept to it, away from the control server's calls.
+	s.adminMux = http.NewServeMux()
+	handleAdmin := func(pattern string, handler http.Handler) {
+		s.adminMux.Handle(pattern, handler)
+		if !config.AdminExclusive {
+			s.mux.Handle(pattern, handler)
+		}
+	}
+	handleAdmin("/metrics", s.metrics.handler())
+	handleAdmin("/admin/readonly", s.withRateLimit(endpointAdmin, s.handleReadOnly))
+	handleAdmin("/admin/faults", s.withRateLimit(endpointAdmin, s.handleFaults))
+	handleAdmin("/admin/loglevel", s.withRateLimit(endpointAdmin, s.handleLogLevel))
+	s.client = &http.Client{Timeout: time.Second}
+	if config.TLSCA != "" {
+		transport, err := transportTrusting(config.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		s.client.Transport = transport
+	}
+	if config.GossipInterval > 0 && len(s.peers) > 0 {
+		s.gossipEvery(config.GossipInterval, config.GossipFanout)
+	}
+	return s, nil
+}
+
+// Reload the values from storage, if anything was stored there.
+func (s *VaultServer) restore() error {
+	values, err := s.storage.load()
+	if err != nil {
+		return err
+	}
+	for key, v := range values {
+		s.restored = true
+		k := s.slot(key, true)
+		k.lock.Lock()
+		k.value = v.Value
+		k.checksum = recordedChecksum(v.Checksum, v.Value)
+		k.sequence = v.Sequence
+		k.written, k.writer = v.Written, v.Writer
+		k.setExpiry(v.Expires, s.port)
+		glog.Infof("Restored Vault :%d %s %q (expired: %v)", s.port, keyName(key), k.value, k.expired)
+		k.lock.Unlock()
+	}
+	return nil
+}
+
+// Recover from a crash by replaying the write-ahead log. Every entry in the log was appended before
+// the data file was updated, so the last entry for each key is at least as new as anything
+// restored from there.
+func (s *VaultServer) replay(entries []walEntry) {
+	last := make(map[string]walEntry)
+	for _, e := range entries {
+		last[e.Key] = e
+	}
+	for key, e := range last {
+		s.restored = true
+		k := s.slot(key, true)
+		k.lock.Lock()
+		k.value = e.Value
+		k.checksum = recordedChecksum(e.Checksum, e.Value)
+		k.sequence = e.Sequence
+		k.written, k.writer = e.Time, e.Writer
+		if k.writer == "" {
+			k.writer = e.From
+		}
+		k.writes++
+		k.setExpiry(e.Expires, s.port)
+		glog.Infof("Replayed WAL; Vault :%d %s %q (expired: %v)", s.port, keyName(key), k.value, k.expired)
+		k.lock.Unlock()
+	}
+	if len(entries) > 0 {
+		glog.Infof("Replayed %d WAL entries for %d keys", len(entries), len(last))
+	}
 }
 
 // Handle GET and POST requests to the root path.
@@ -43,55 +296,591 @@ func (s *VaultServer) handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if r.Method == http.MethodGet {
-		s.get(w, r)
+		s.get(w, r, defaultKey)
 	} else if r.Method == http.MethodPost {
-		s.post(w, r)
+		s.post(w, r, defaultKey)
 	} else {
 		// Do not support PATCH, DELETE, etc, operations.
 		http.NotFound(w, r)
 	}
 }
 
-// Return the value stored in the vault. This should always be a success.
-func (s *VaultServer) get(w http.ResponseWriter, r *http.Request) {
+// Returned when reading a named key which has never been written.
+var errUnknownKey = errors.New("unknown key")
+
+// Returned when reading a value which was written with a TTL which has since elapsed.
+var errExpired = errors.New("value expired")
+
+// Returned when reading a value which no longer matches its checksum.
+var errCorrupted = errors.New("value corrupted")
+
+// Returned when asked to store a value which is not valid for this vault.
+var errInvalidValue = errors.New("invalid value")
+
+// Return the value stored under a key. This should always be a success, unless the value was
+// written with a TTL which has since elapsed, in which case we respond with a 410, a named key
+// has never been written, in which case we respond with a 404, or the value no longer matches
+// its checksum, in which case we respond with a 422. The value's metadata is reported in headers.
+func (s *VaultServer) get(w http.ResponseWriter, r *http.Request, key string) {
+	value, meta, err := s.read(key)
+	if errors.Is(err, errUnknownKey) {
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, errCorrupted) {
+		w.WriteHeader(corruptedStatus)
+		w.Write([]byte("Value corrupted"))
+		return
+	}
+	if errors.Is(err, errExpired) {
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte("Value expired"))
+		return
+	}
+	if meta.Sequence > 0 {
+		w.Header().Set(versionHeader, strconv.FormatInt(meta.Sequence, 10))
+	}
+	if !meta.Written.IsZero() {
+		w.Header().Set(writtenHeader, meta.Written.UTC().Format(time.RFC3339Nano))
+	}
+	if meta.Writer != "" {
+		w.Header().Set(writerHeader, meta.Writer)
+	}
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("%d", s.value)))
+	w.Write(value)
+}
+
+// What we know about the write which stored a value, so that readers can judge how stale it is.
+type valueMeta struct {
+	// The sequence number of the write, or zero if it did not have one.
+	Sequence int64
+	// When it was written and by whom, if we know.
+	Written time.Time
+	Writer  string
+}
+
+// Return the value stored under a key and its metadata, whichever interface it was asked for
+// through, or errUnknownKey, errExpired or errCorrupted. This is where reads may glitch.
+func (s *VaultServer) read(key string) ([]byte, valueMeta, error) {
+	k := s.slot(key, false)
+	if k == nil {
+		return nil, valueMeta{}, errUnknownKey
+	}
+	k.lock.Lock()
+	value, expired := k.value, k.expired
+	meta := valueMeta{Sequence: k.sequence, Written: k.written, Writer: k.writer}
+	corrupted := checksum(k.value) != k.checksum
+	glitched, glitch := s.maybeGlitch(k)
+	k.lock.Unlock()
+	s.metrics.reads.Inc()
+	if glitch {
+		// Serve the wrong value even if the real one has expired (or rotted).
+		s.metrics.corruptions.Inc()
+		value, expired, corrupted = glitched, false, false
+	}
+	if corrupted {
+		s.metrics.corruptions.Inc()
+		glog.Errorf("Vault :%d %s %q does not match its checksum", s.port, keyName(key), value)
+		return nil, meta, errCorrupted
+	}
+	if expired {
+		return nil, meta, errExpired
+	}
+	return value, meta, nil
+}
+
+// Store a new value under a key, replacing any previous one. If the TTL is positive, the value
+// will expire once it elapses (unless it has been replaced by then). If the sequence number is
+// positive and lower than that of a write we have already applied to the key, the write is
+// refused with errStaleSequence.
+// If we have a WAL or storage, the value is persisted before we return, and not stored at all if
+// that fails. The writer's address is recorded in the WAL, and its identity (its address, unless
+// it gave one) with the value.
+func (s *VaultServer) store(key string, value []byte, ttl time.Duration, sequence int64, from string, writer string) error {
+	v := storedValue{Value: value, Sequence: sequence, Writer: writer}
+	if ttl > 0 {
+		v.Expires = time.Now().Add(ttl)
+	}
+	return s.write(key, v, from, false)
+}
+
+// Persist and apply a key's value. The expiry time is zero if the value never expires and may
+// already have passed (e.g. when restoring a snapshot of an expired value). A restore replaces our
+// state outright, including the sequence number; otherwise, stale sequence numbers are refused.
+func (s *VaultServer) write(key string, v storedValue, from string, restore bool) error {
+	return s.writeIf(key, v, from, restore, nil)
+}
+
+// Write a key's value as write does, but only if the precondition (if any) returns nil when called
+// with the key's slot, locked, so that nothing else can write between the check and the write.
+func (s *VaultServer) writeIf(key string, v storedValue, from string, restore bool, precondition func(k *slot) error) (err error) {
+	now := time.Now()
+	s.lock.Lock()
+	readOnly, draining := s.readOnly, s.draining
+	s.lock.Unlock()
+	if draining {
+		return errDraining
+	}
+	if readOnly {
+		return errReadOnly
+	}
+	k := s.slotForWrite(key)
+	// Deferred first, so that it runs once we have let go of the slot.
+	defer func() { s.finishWrite(key, k, err == nil) }()
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if precondition != nil {
+		if err := precondition(k); err != nil {
+			return err
+		}
+	}
+	if !restore {
+		if v.Sequence > 0 && v.Sequence < k.sequence {
+			return errStaleSequence
+		}
+		if v.Sequence < k.sequence {
+			// Writes without a sequence number do not reset ours.
+			v.Sequence = k.sequence
+		}
+	}
+	sum := checksum(v.Value)
+	v.Checksum = &sum
+	if v.Written.IsZero() {
+		v.Written = now
+	}
+	if v.Writer == "" {
+		v.Writer = from
+	}
+	err = s.persist(now, key, v, from)
+	s.lock.Lock()
+	if err != nil {
+		s.storageError = err.Error()
+	} else {
+		s.storageError = ""
+		s.lastWrite = now
+	}
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	s.metrics.writes.Inc()
+	k.previous = k.value
+	k.value = v.Value
+	if viewable, ok := s.storage.(viewableStorage); ok {
+		// Keep the value where the storage keeps it (e.g. outside the heap) rather than our copy.
+		k.value = viewable.view(key)
+	}
+	k.checksum = sum
+	k.sequence = v.Sequence
+	k.written, k.writer = v.Written, v.Writer
+	k.writes++
+	k.setExpiry(v.Expires, s.port)
+	return nil
 }
 
-// Update the value stored in the vault.
+// Log and store a key's value, if we have a WAL or storage.
+func (s *VaultServer) persist(now time.Time, key string, v storedValue, from string) error {
+	if s.wal != nil {
+		e := walEntry{Time: now, From: from, Key: key, Value: v.Value, Expires: v.Expires, Sequence: v.Sequence, Checksum: v.Checksum, Writer: v.Writer}
+		if err := s.wal.append(e); err != nil {
+			return err
+		}
+	}
+	if s.storage != nil {
+		return s.storage.save(key, v)
+	}
+	return nil
+}
+
+// Record when the current value expires, and arrange for it to expire at that time (if it is set),
+// unless it has been replaced by then. The caller must hold the lock.
+func (k *slot) setExpiry(expires time.Time, port int) {
+	k.expires = expires
+	k.expired = !expires.IsZero() && !time.Now().Before(expires)
+	if expires.IsZero() || k.expired {
+		return
+	}
+	write := k.writes
+	time.AfterFunc(time.Until(expires), func() {
+		k.lock.Lock()
+		defer k.lock.Unlock()
+		if k.writes == write {
+			k.expired = true
+			glog.Infof("Expired Vault :%d %s", port, keyName(k.key))
+		}
+	})
+}
+
+// Update the value stored under a key.
 // Logs a warning if the value decreases for whatever reason (but still update it).
-func (s *VaultServer) post(w http.ResponseWriter, r *http.Request) {
+func (s *VaultServer) post(w http.ResponseWriter, r *http.Request, key string) {
+	if !s.authorize(w, r) {
+		return
+	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		// Make sure we actually get a valid body from the client.
 		glog.Warningf("Could not read body: %v\n", err)
+		s.metrics.rejected.WithLabelValues(rejectBadRequest).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid or missing POST body"))
+		return
+	}
+	ttl, sequence, ok := s.writeHeaders(w, r)
+	if !ok {
+		return
+	}
+	err = s.set(key, body, ttl, sequence, r.RemoteAddr, r.Header.Get(writerHeader), r.Header.Get(replicatedHeader) == "")
+	if errors.Is(err, errInvalidValue) {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Invalid or missing POST body"))
 		return
 	}
+	if err != nil {
+		s.writeFailed(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// Return the TTL and sequence number a writer asked for in the request headers (zero if it did not),
+// or respond with a 400 and return false if they are invalid.
+func (s *VaultServer) writeHeaders(w http.ResponseWriter, r *http.Request) (time.Duration, int64, bool) {
+	var ttl time.Duration
+	var err error
+	if h := r.Header.Get(ttlHeader); h != "" {
+		if ttl, err = time.ParseDuration(h); err != nil || ttl <= 0 {
+			s.metrics.rejected.WithLabelValues(rejectBadRequest).Inc()
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid TTL"))
+			return 0, 0, false
+		}
+	}
+	var sequence int64
+	if h := r.Header.Get(sequenceHeader); h != "" {
+		if sequence, err = strconv.ParseInt(h, 10, 64); err != nil || sequence <= 0 {
+			s.metrics.rejected.WithLabelValues(rejectBadRequest).Inc()
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid sequence number"))
+			return 0, 0, false
+		}
+	}
+	return ttl, sequence, true
+}
+
+// Validate and store a value written through either interface, replicating it to our peers unless
+// it was itself replicated. Returns errInvalidValue if the value is not valid for this vault, and
+// otherwise any error from store, which the caller must report as a rejection. The writer is
+// whoever the value should be attributed to, if it is not the sender.
+func (s *VaultServer) set(key string, body []byte, ttl time.Duration, sequence int64, from string, writer string, replicate bool) error {
+	if writer == "" {
+		writer = from
+	}
+	if s.valueType == valueTypeBlob {
+		// Blobs are opaque to us, so there is nothing to validate.
+		if err := s.store(key, body, ttl, sequence, from, writer); err != nil {
+			return err
+		}
+		glog.Infof("Set Vault :%d Blob %s (%d bytes)", s.port, keyName(key), len(body))
+		if replicate {
+			s.replicate(key, body, ttl, sequence, writer)
+		}
+		return nil
+	}
 	v := string(body)
 	n, e := strconv.Atoi(v)
-	if n >= 0 && e == nil {
-		// We only store positive values.
-		if n < s.value {
-			glog.Warningf("THIS SHOULD NEVER HAPPEN: Counter value regressed from %d to %d", s.value, n)
-		}
-		s.value = n
-		glog.Infof("Set Vault :%d Counter %d", s.port, s.value)
-		w.WriteHeader(http.StatusOK)
-		w.Write(body)
-	} else {
+	if n < 0 || e != nil {
 		// Either the body was not a valid integer, or it was negative.
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid or missing POST body"))
+		s.metrics.rejected.WithLabelValues(rejectBadRequest).Inc()
+		return errInvalidValue
+	}
+	// We only store positive values.
+	current := 0
+	if k := s.slot(key, false); k != nil {
+		k.lock.Lock()
+		current, _ = strconv.Atoi(string(k.value))
+		k.lock.Unlock()
 	}
+	if n < current {
+		s.metrics.corruptions.Inc()
+		glog.Warningf("THIS SHOULD NEVER HAPPEN: Counter %s regressed from %d to %d", keyName(key), current, n)
+	}
+	if err := s.store(key, []byte(strconv.Itoa(n)), ttl, sequence, from, writer); err != nil {
+		return err
+	}
+	glog.Infof("Set Vault :%d Counter %s %d", s.port, keyName(key), n)
+	if replicate {
+		s.replicate(key, []byte(strconv.Itoa(n)), ttl, sequence, writer)
+	}
+	return nil
+}
+
+// Tell the writer we did not store their value, so it must not count as acknowledged: it was older
+// than one we already have, we are read-only or shutting down, or we could not persist it.
+func (s *VaultServer) writeFailed(w http.ResponseWriter, err error) {
+	s.metrics.rejected.WithLabelValues(rejectReason(err)).Inc()
+	if errors.Is(err, errStaleSequence) {
+		glog.Warningf("Refusing write: %v", err)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Stale sequence number"))
+		return
+	}
+	if errors.Is(err, errReadOnly) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Vault is read-only"))
+		return
+	}
+	if errors.Is(err, errDraining) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Vault is shutting down"))
+		return
+	}
+	glog.Errorf("Could not persist value: %v", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte("Could not persist value"))
 }
 
-func main() {
-	portPtr := flag.Int("port", 8001, "Port on which to listen for requests")
-	flag.Parse()
-	s := NewVaultServer(*portPtr)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", s.port), s.mux)
+// Return the reason under which to count a write which store refused with the given error.
+func rejectReason(err error) string {
+	switch {
+	case errors.Is(err, errStaleSequence):
+		return rejectStaleSequence
+	case errors.Is(err, errReadOnly):
+		return rejectReadOnly
+	case errors.Is(err, errDraining):
+		return rejectDraining
+	case errors.Is(err, errPreconditionFailed):
+		return rejectPrecondition
+	default:
+		return rejectStorage
+	}
+}
+
+// Run the vault with the given flags or, if check is set, only check them and the files they name,
+// as far as we can without opening the storage or serving. name is how we were run, for the usage
+// message.
+func runServer(name string, args []string, check bool) {
+	portPtr := flag.Int("port", 8001, "Deprecated: use -listen=:<port>. Still names the vault when it listens on a Unix socket")
+	listenPtr := flag.String("listen", ":8001", "Address on which to listen, e.g. localhost:8001, [::1]:8001, unix:///tmp/vault1.sock for a Unix socket, or systemd: for a socket passed by systemd socket activation (systemd:<name> for one named with FileDescriptorName=)")
+	valueTypePtr := flag.String("value-type", valueTypeInt, "Type of value to store: int or blob")
+	storagePtr := flag.String("storage", "", "How to persist values: memory, file, mmap or sqlite (file if -data-file is set, memory otherwise)")
+	dataFilePtr := flag.String("data-file", "", "File in which to persist the value across restarts (in-memory only if empty)")
+	mmapSizePtr := flag.Int64("mmap-size", 256<<20, "Size in bytes of the mapping for -storage=mmap, which must hold every write until the next restart")
+	walFilePtr := flag.String("wal-file", "", "File to which every accepted write is logged before it is acknowledged (no log if empty)")
+	walRetentionAgePtr := flag.Duration("wal-retention-age", 0, "Compact away superseded WAL entries older than this (kept forever if 0)")
+	walRetentionSizePtr := flag.Int64("wal-retention-size", 0, "Compact away the oldest superseded WAL entries while the WAL is larger than this many bytes (no limit if 0)")
+	walCompactIntervalPtr := flag.Duration("wal-compact-interval", time.Minute, "How often to compact the WAL, if it has a retention limit")
+	glitchRatePtr := flag.Float64("glitch-rate", 0, "Fraction of reads, from 0 to 1, for which to deliberately serve the wrong value")
+	glitchModePtr := flag.String("glitch-mode", glitchFlip, "How to get the value wrong when glitching: flip, stale or garbage")
+	peersPtr := flag.String("peers", "", "Comma-separated list of other vaults to which to replicate accepted writes")
+	readOnlyPtr := flag.Bool("read-only", false, "Start in read-only maintenance mode, refusing writes")
+	authTokenPtr := flag.String("auth-token", "", "Shared secret which writers must present as a bearer token (anyone may write if empty)")
+	durabilityPtr := flag.String("durability", string(durabilityFsync), "How hard to try to make sure acknowledged writes survive a crash: none, fsync or fsync-batch")
+	fsyncIntervalPtr := flag.Duration("fsync-interval", 100*time.Millisecond, "How often to fsync under -durability=fsync-batch")
+	recoverFromPtr := flag.String("recover-from", "", "Control server from which to recover the value on startup if we have no stored state and no peer can provide it")
+	shutdownTimeoutPtr := flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for in-flight requests to finish when shutting down")
+	leaveURLPtr := flag.String("leave-url", "", "Control server admin URL to DELETE when shutting down, e.g. http://control:8000/admin/vaults/vault1:8001")
+	leaveTokenPtr := flag.String("leave-token", "", "Bearer token for -leave-url")
+	registerPtr := flag.String("register", "", "Consul service or etcd key prefix to register in while we run, for the control server to discover us, e.g. consul://localhost:8500/vault or etcd://localhost:2379/glitchgrid/vaults/ (none if empty)")
+	registerAddressPtr := flag.String("register-address", "", "Address to register under -register, as the control server should call us, e.g. vault1:8001 or grpc://vault1:9001 (our hostname and port, over HTTPS if we serve it, if empty)")
+	rateLimitPtr := flag.Float64("rate-limit", 0, "Requests per second each client may make on average, by IP address (no limit if 0)")
+	rateBurstPtr := flag.Int("rate-burst", 50, "Requests each client may make at once under -rate-limit")
+	rateLimitExemptPtr := flag.String("rate-limit-exempt", "", "Comma-separated IP addresses and CIDR networks, e.g. of the control servers, not subject to -rate-limit; requests carrying the -auth-token never are")
+	tlsCertPtr := flag.String("tls-cert", "", "Certificate file with which to serve HTTPS (plain HTTP if empty)")
+	tlsKeyPtr := flag.String("tls-key", "", "Private key file for -tls-cert")
+	tlsCAPtr := flag.String("tls-ca", "", "PEM file of extra certificate authorities to trust for https:// peers and control servers")
+	gossipIntervalPtr := flag.Duration("gossip-interval", 0, "How often to pull newer writes from random -peers (no gossip if 0)")
+	gossipFanoutPtr := flag.Int("gossip-fanout", 2, "How many random peers to gossip with each -gossip-interval")
+	adminListenPtr := flag.String("admin-listen", "", "Address on which to serve profiles under /debug/pprof/, the metrics and the admin endpoints, apart from the data port, e.g. localhost:6061 (none if empty)")
+	adminExclusivePtr := flag.Bool("admin-exclusive", false, "Serve the metrics and the admin endpoints only on -admin-listen, and not on the data port")
+	accessLogPtr := flag.String("access-log", "", "Where to log every request: - for stdout, or a file to append to (no access log if empty)")
+	grpcPortPtr := flag.Int("grpc-port", 0, "Port on which to also serve reads and writes over gRPC (disabled if 0)")
+	versionPtr := flag.Bool("version", false, "Print what this binary was built from, and exit")
+	configPtr := flag.String("config", "", "YAML or TOML file of flag settings, e.g. port: 8001, which flags given on the command line or in GLITCHGRID_* environment variables override (none if empty)")
+	flag.Usage = func() { usage(name) }
+	flag.CommandLine.Parse(args)
+	if *versionPtr {
+		printVersion()
+		os.Exit(0)
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if err := flagconfig.ApplyEnv(flag.CommandLine, set); err != nil {
+		glog.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if *configPtr != "" {
+		if err := flagconfig.ApplyFile(*configPtr, flag.CommandLine, set); err != nil {
+			glog.Errorf("%v", err)
+			os.Exit(1)
+		}
+	}
+	if *valueTypePtr != valueTypeInt && *valueTypePtr != valueTypeBlob {
+		glog.Errorf("unknown value type %q", *valueTypePtr)
+		os.Exit(1)
+	}
+	if err := validateGlitch(*glitchRatePtr, *glitchModePtr); err != nil {
+		glog.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if *storagePtr == "" {
+		*storagePtr = storageMemory
+		if *dataFilePtr != "" {
+			*storagePtr = storageFile
+		}
+	}
+	if (*storagePtr == storageMemory) != (*dataFilePtr == "") {
+		glog.Errorf("-data-file is required with -storage=%s, and only then", *storagePtr)
+		os.Exit(1)
+	}
+	if *walRetentionAgePtr < 0 || *walRetentionSizePtr < 0 || *walCompactIntervalPtr <= 0 {
+		glog.Errorf("WAL retention limits must not be negative, and the compaction interval must be positive")
+		os.Exit(1)
+	}
+	if *gossipIntervalPtr < 0 || *gossipFanoutPtr < 1 {
+		glog.Errorf("gossip interval must not be negative, and the fanout must be positive")
+		os.Exit(1)
+	}
+	if (*tlsCertPtr == "") != (*tlsKeyPtr == "") {
+		glog.Errorf("-tls-cert and -tls-key must be given together")
+		os.Exit(1)
+	}
+	if *adminExclusivePtr && *adminListenPtr == "" {
+		glog.Errorf("-admin-exclusive needs an -admin-listen for the admin endpoints to be served on")
+		os.Exit(1)
+	}
+	rateLimitExempt, err := parseRateLimitExempt(*rateLimitExemptPtr)
+	if err != nil {
+		glog.Errorf("%v", err)
+		os.Exit(1)
+	}
+	durability, err := parseDurability(*durabilityPtr)
+	if err != nil {
+		glog.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if durability == durabilityBatch && *fsyncIntervalPtr <= 0 {
+		glog.Errorf("fsync interval %v must be positive", *fsyncIntervalPtr)
+		os.Exit(1)
+	}
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	addr := *listenPtr
+	if given["port"] && !given["listen"] {
+		// The deprecated -port listens on every interface, as it always has.
+		addr = fmt.Sprintf(":%d", *portPtr)
+	}
+	port, err := listen.Port(addr)
+	if err != nil {
+		glog.Errorf("invalid listen address %q: %v", addr, err)
+		os.Exit(1)
+	}
+	if port == 0 {
+		// A Unix socket has no port, so the vault is still known by -port.
+		port = *portPtr
+	}
+	var reg registry
+	if *registerPtr != "" {
+		address := *registerAddressPtr
+		if address == "" {
+			if strings.HasPrefix(addr, listen.UnixScheme) {
+				glog.Errorf("-register-address is required to register a vault listening on a Unix socket")
+				os.Exit(1)
+			}
+			hostname, err := os.Hostname()
+			if err != nil {
+				glog.Errorf("could not work out the address to register: %v", err)
+				os.Exit(1)
+			}
+			address = net.JoinHostPort(hostname, strconv.Itoa(port))
+			if *tlsCertPtr != "" {
+				address = "https://" + address
+			}
+		}
+		if reg, err = newRegistry(*registerPtr, address, port, *tlsCertPtr != ""); err != nil {
+			glog.Errorf("%v", err)
+			os.Exit(1)
+		}
+	}
+	access, err := logging.OpenAccessLog(*accessLogPtr)
+	if err != nil {
+		glog.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if check {
+		fmt.Printf("Configuration OK: listening on %s, storing the value in %s\n", addr, *storagePtr)
+		return
+	}
+	s, err := NewVaultServer(VaultConfig{
+		Port:               port,
+		ValueType:          *valueTypePtr,
+		Storage:            *storagePtr,
+		DataFile:           *dataFilePtr,
+		MmapSize:           *mmapSizePtr,
+		WALFile:            *walFilePtr,
+		WALRetentionAge:    *walRetentionAgePtr,
+		WALRetentionSize:   *walRetentionSizePtr,
+		WALCompactInterval: *walCompactIntervalPtr,
+		Durability:         durability,
+		FsyncInterval:      *fsyncIntervalPtr,
+		GlitchRate:         *glitchRatePtr,
+		GlitchMode:         *glitchModePtr,
+		Peers:              *peersPtr,
+		ReadOnly:           *readOnlyPtr,
+		AuthToken:          *authTokenPtr,
+		RateLimit:          *rateLimitPtr,
+		RateBurst:          *rateBurstPtr,
+		RateLimitExempt:    rateLimitExempt,
+		TLSCert:            *tlsCertPtr,
+		TLSKey:             *tlsKeyPtr,
+		TLSCA:              *tlsCAPtr,
+		GossipInterval:     *gossipIntervalPtr,
+		GossipFanout:       *gossipFanoutPtr,
+		AdminExclusive:     *adminExclusivePtr,
+	})
+	if err != nil {
+		glog.Errorf("error starting vault: %s", err)
+		os.Exit(1)
+	}
+	s.recover(*recoverFromPtr)
+	handler := access.Wrap(s.mux, requestID)
+	if *tlsCertPtr == "" {
+		// Accept HTTP/2 without TLS (h2c) as well as HTTP/1.1, so that the control server can
+		// multiplex its calls to us over a single connection. Over TLS, HTTP/2 is negotiated anyway.
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	if *adminListenPtr != "" {
+		if err := serveAdminPort(*adminListenPtr, access.Wrap(s.adminMux, requestID)); err != nil {
+			glog.Errorf("%v", err)
+			os.Exit(1)
+		}
+	}
+	l, err := listen.On(addr)
+	if err != nil {
+		glog.Errorf("error starting server: %s", err)
+		os.Exit(1)
+	}
+	srv := &http.Server{Handler: handler}
+	var g *grpc.Server
+	if *grpcPortPtr > 0 {
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *grpcPortPtr))
+		if err != nil {
+			glog.Errorf("error starting gRPC server: %s", err)
+			os.Exit(1)
+		}
+		g = s.newGRPCServer()
+		go func() {
+			if err := g.Serve(lis); err != nil {
+				glog.Errorf("error serving gRPC: %s", err)
+			}
+		}()
+		glog.Infof("Serving gRPC on :%d", *grpcPortPtr)
+	}
+	if reg != nil {
+		s.startRegistering(reg)
+	}
+	err = s.serveUntilSignalled(srv, l, g, *shutdownTimeoutPtr, *leaveURLPtr, *leaveTokenPtr)
 	if errors.Is(err, http.ErrServerClosed) {
 		glog.Info("server closed")
 	} else if err != nil {
@@ -0,0 +1,24 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"antithesis.com/glitch-grid/internal/buildinfo"
+)
+
+// Return what this binary was built from.
+func currentBuild() buildinfo.Info {
+	return buildinfo.Current("glitch-grid-vault")
+}
+
+// Report what this binary was built from, so that a bug report or a grid running mixed versions
+// can say exactly what is running.
+func (s *VaultServer) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentBuild())
+}
@@ -0,0 +1,226 @@
+package vault
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// One accepted write, as recorded in the write-ahead log.
+type walEntry struct {
+	// When the vault accepted the write.
+	Time time.Time `json:"time"`
+	// The address of whoever sent it (normally the control server).
+	From string `json:"from"`
+	// The key written, which is empty for the default key.
+	Key   string `json:"key,omitempty"`
+	Value []byte `json:"value"`
+	// When the value expires, if it was written with a TTL.
+	Expires time.Time `json:"expires"`
+	// The sequence number the control server stamped on the write, if any.
+	Sequence int64 `json:"sequence"`
+	// The checksum of the value, which is absent in entries written before we kept checksums.
+	Checksum *uint32 `json:"checksum,omitempty"`
+	// The control server which wrote the value, if it said, and otherwise the same as From.
+	Writer string `json:"writer,omitempty"`
+}
+
+// An append-only log of every write the vault has accepted, one JSON entry per line. Each entry
+// is appended (and by default fsynced) before the write is acknowledged, so that the log can be
+// replayed after a crash and serves as an audit trail of what the vault was told and when.
+type writeAheadLog struct {
+	f          *os.File
+	path       string
+	durability durability
+	// Syncs the log in the background, under the fsync-batch durability level.
+	batch *batchSyncer
+	lock  sync.Mutex
+}
+
+// Open the log at the given path, creating it if necessary, and return the entries already in it.
+// A torn entry at the end of the log (from a crash partway through an append) is discarded.
+func openWAL(path string, d durability, interval time.Duration) (*writeAheadLog, []walEntry, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	var entries []walEntry
+	var good int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		var e walEntry
+		if err := json.Unmarshal(bytes.TrimSpace(line), &e); err != nil {
+			break
+		}
+		entries = append(entries, e)
+		good += int64(len(line))
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > good {
+		glog.Warningf("Discarding %d bytes of torn entries at the end of %s", info.Size()-good, path)
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	l := &writeAheadLog{f: f, path: path, durability: d}
+	if d == durabilityBatch {
+		l.batch = newBatchSyncer(interval, l.sync)
+	}
+	return l, entries, nil
+}
+
+// Append an entry to the log, syncing it as the durability level requires.
+func (l *writeAheadLog) append(e walEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	if _, err := l.f.Write(append(data, '\n')); err != nil {
+		l.lock.Unlock()
+		return err
+	}
+	if l.durability == durabilityFsync {
+		err = l.f.Sync()
+	}
+	l.lock.Unlock()
+	if l.durability == durabilityBatch {
+		// Not under our lock, since the batch syncer takes it to sync.
+		l.batch.markDirty()
+	}
+	return err
+}
+
+// Fsync the log.
+func (l *writeAheadLog) sync() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.f.Sync()
+}
+
+// Flush the log and close it.
+func (l *writeAheadLog) close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.f.Sync(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// Compact the log at the given interval, so that a long-running vault does not fill its disk. The
+// newest entry for each key is always kept, so that replaying the log still recovers every value;
+// older entries are dropped once they are older than maxAge, or (oldest first) for as long as the
+// log is larger than maxSize. Either limit is ignored if it is zero.
+func (l *writeAheadLog) compactEvery(interval time.Duration, maxAge time.Duration, maxSize int64) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := l.compact(maxAge, maxSize); err != nil {
+				glog.Errorf("Could not compact %s: %v", l.path, err)
+			}
+		}
+	}()
+}
+
+// Rewrite the log without the entries which have fallen out of retention, replacing it atomically.
+// Writes wait while we do so.
+func (l *writeAheadLog) compact(maxAge time.Duration, maxSize int64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := l.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var lines [][]byte
+	var keys []string
+	var times []time.Time
+	var size int64
+	newest := make(map[string]int)
+	reader := bufio.NewReader(l.f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		var e walEntry
+		if err := json.Unmarshal(bytes.TrimSpace(line), &e); err != nil {
+			return err
+		}
+		newest[e.Key] = len(lines)
+		lines = append(lines, line)
+		keys = append(keys, e.Key)
+		times = append(times, e.Time)
+		size += int64(len(line))
+	}
+	if _, err := l.f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	keep := make([]bool, len(lines))
+	dropped := 0
+	for i := range lines {
+		keep[i] = newest[keys[i]] == i
+		if keep[i] {
+			continue
+		}
+		if (maxAge > 0 && times[i].Before(cutoff)) || (maxSize > 0 && size > maxSize) {
+			size -= int64(len(lines[i]))
+			dropped++
+			continue
+		}
+		keep[i] = true
+	}
+	if dropped == 0 {
+		return nil
+	}
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for i, line := range lines {
+		if keep[i] {
+			w.Write(line)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncDir(filepath.Dir(l.path)); err != nil {
+		glog.Warningf("Could not sync the directory of %s: %v", l.path, err)
+	}
+	l.f.Close()
+	l.f = f
+	glog.Infof("Compacted %s: dropped %d of %d entries, leaving %d bytes", l.path, dropped, len(lines), size)
+	return nil
+}